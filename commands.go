@@ -0,0 +1,219 @@
+package main
+
+/*
+ * admin commands, run as ./server [redis flags] <command> [flags]
+ */
+
+import (
+	rdb "./db"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var commands = map[string]func(args []string) error{
+	"migrate": migrateCommand,
+	"export":  exportCommand,
+	"import":  importCommand,
+	"fsck":    fsckCommand,
+	"reindex": reindexCommand,
+}
+
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		var names []string
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, one of: %s", name,
+			strings.Join(names, ", "))
+	}
+	return cmd(args)
+}
+
+/*
+ * migrate brings the stored data to the latest key schema
+ *
+ * ./server migrate -status
+ * ./server migrate -dry-run
+ * ./server migrate -to 1
+ */
+func migrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	status := fs.Bool("status", false, "print the schema version and the pending migrations")
+	dryRun := fs.Bool("dry-run", false, "count the keys each migration would change")
+	to := fs.Int("to", 0, "schema version to migrate to, 0 is the latest")
+	batch := fs.Int("batch", 0, "keys scanned at once")
+	fs.Parse(args)
+
+	db := openDB()
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > rdb.LatestSchema {
+		return fmt.Errorf("schema version %d is newer than this server knows, %d",
+			version, rdb.LatestSchema)
+	}
+	if *status {
+		fmt.Printf("schema version %d of %d\n", version, rdb.LatestSchema)
+		for _, m := range rdb.Migrations()[version:] {
+			fmt.Printf("pending %d: %s\n", m.Version, m.Name)
+		}
+		return nil
+	}
+
+	// progress of the running step on one line of stderr
+	step := 0
+	results, err := db.Migrate(rdb.MigrateOptions{To: *to, DryRun: *dryRun,
+		Batch: *batch, Progress: func(r rdb.MigrationResult) {
+			if step != 0 && step != r.Version {
+				fmt.Fprintln(os.Stderr)
+			}
+			step = r.Version
+			fmt.Fprintf(os.Stderr, "\r%d: scanned %d changed %d", r.Version,
+				r.Scanned, r.Changed)
+		}})
+	if step != 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+	verb := "changed"
+	if *dryRun {
+		verb = "would change"
+	}
+	for _, r := range results {
+		fmt.Printf("%d: %s: scanned %d keys, %s %d\n", r.Version, r.Name,
+			r.Scanned, verb, r.Changed)
+	}
+	return err
+}
+
+/*
+ * export writes the data to a JSON Lines archive
+ *
+ * ./server export -o backup.jsonl
+ * ./server -redis-namespace tenant export -o tenant.jsonl
+ */
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "-", "archive to write, - is stdout")
+	fs.Parse(args)
+
+	w := os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	summary, err := openDB().Export(w)
+	if err != nil {
+		return err
+	}
+	printSummary(summary)
+	if w != os.Stdout {
+		return w.Close()
+	}
+	return nil
+}
+
+/*
+ * import loads an archive into an empty redis database or namespace
+ *
+ * ./server -redis-addr staging:6379 import -verify backup.jsonl
+ */
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	verify := fs.Bool("verify", false, "export the imported data again and compare the checksums")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: import [-verify] <archive>, - reads stdin")
+	}
+
+	r := os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	summary, err := openDB().Import(r, *verify)
+	if err != nil {
+		return err
+	}
+	printSummary(summary)
+	return nil
+}
+
+// prints the record counts of an archive to stderr, stdout may be the
+// archive itself
+func printSummary(s rdb.ExportSummary) {
+	var types []string
+	for typ := range s.Checksums {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	fmt.Fprintf(os.Stderr, "archive format %d, schema version %d\n", s.Format, s.Schema)
+	for _, typ := range types {
+		fmt.Fprintf(os.Stderr, "%10d %s\n", s.Checksums[typ].Count, typ)
+	}
+}
+
+/*
+ * fsck checks the counters, follow edges, timelines and logins
+ *
+ * ./server fsck
+ * ./server fsck -repair
+ */
+func fsckCommand(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "fix the problems found")
+	fs.Parse(args)
+
+	summary, err := openDB().Fsck(rdb.FsckOptions{Repair: *repair,
+		Problem: func(p rdb.FsckProblem) {
+			fmt.Println(p)
+		}})
+	if err != nil {
+		return err
+	}
+	for _, skipped := range summary.Skipped {
+		fmt.Println("not checked:", skipped)
+	}
+	fmt.Printf("%d problems, %d repaired\n", summary.Total(), summary.Repaired)
+	// a non zero exit for scripts
+	if summary.Total() > summary.Repaired {
+		os.Exit(1)
+	}
+	return nil
+}
+
+/*
+ * reindex writes the status and user search indexes again
+ *
+ * ./server reindex
+ */
+func reindexCommand(args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	fs.Parse(args)
+
+	db := openDB()
+	n, err := db.RebuildSearch()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("indexed %d statuses\n", n)
+	if n, err = db.RebuildUserSearch(); err != nil {
+		return err
+	}
+	fmt.Printf("indexed %d users\n", n)
+	return nil
+}
@@ -0,0 +1,130 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+)
+
+/*
+ * capped timelines
+ *
+ * with MaxTimeline every timeline:<uid> zset is trimmed to its newest
+ * entries whenever a status is pushed to it. pages past the cap are not
+ * lost, they are rebuilt from posts:<uid> of the reader and of everyone
+ * the reader follows, which keep every status ever written.
+ */
+
+// MaxTimeline keeps only the newest n entries of every timeline, older
+// pages are rebuilt from the statuses of the followees. 0 never trims.
+func MaxTimeline(n int) Option {
+	return func(db *DB) {
+		db.maxTimeline = n
+	}
+}
+
+// archivedTimeline builds a page that reaches past the timeline cap
+func (db *DB) archivedTimeline(c redis.Conn, uid int, pulled []int, page, count int) ([]int, error) {
+	start, stop := (page-1)*count, page*count-1
+
+	kept, err := db.timelineHeads(c, []string{db.idKey("timeline:", uid)},
+		db.maxTimeline-1)
+	if err != nil {
+		return nil, err
+	}
+	head := kept[0]
+	if len(head) < db.maxTimeline {
+		// the timeline never reached the cap, nothing was trimmed
+		if len(pulled) > 0 {
+			return db.mergedTimeline(c, uid, pulled, page, count)
+		}
+		return pageOf(head, start, stop), nil
+	}
+	oldest := head[len(head)-1]
+
+	// the entries still in the timeline, with the pulled statuses that
+	// are not older than its oldest entry
+	var pulledKeys []string
+	for _, author := range pulled {
+		pulledKeys = append(pulledKeys, db.idKey("posts:", author))
+	}
+	newer, err := db.entriesSince(c, pulledKeys, oldest.posted)
+	if err != nil {
+		return nil, err
+	}
+	var live []timelineEntry
+	for _, e := range mergeEntries(append(newer, head)...) {
+		if !oldest.before(e) {
+			live = append(live, e)
+		}
+	}
+	if stop < len(live) {
+		return pageOf(live, start, stop), nil
+	}
+
+	// everything older is rebuilt from what the user and the followees wrote
+	followees, err := redis.Ints(c.Do("ZRANGE", db.idKey("following:", uid), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{db.idKey("posts:", uid)}
+	for _, followee := range followees {
+		keys = append(keys, db.idKey("posts:", followee))
+	}
+	older, err := db.entriesAfter(c, keys, oldest, stop-len(live)+1)
+	if err != nil {
+		return nil, err
+	}
+	return pageOf(append(live, older...), start, stop), nil
+}
+
+// entriesSince reads the entries of every key posted at or after since
+func (db *DB) entriesSince(c redis.Conn, keys []string, since int64) ([][]timelineEntry, error) {
+	for _, key := range keys {
+		c.Send("ZREVRANGEBYSCORE", key, "+inf", since, "WITHSCORES")
+	}
+	return receiveEntries(c, len(keys))
+}
+
+// entriesAfter merges the first n entries of the keys that are listed
+// after e, in timeline order
+func (db *DB) entriesAfter(c redis.Conn, keys []string, e timelineEntry, n int) ([]timelineEntry, error) {
+	for _, key := range keys {
+		// entries posted in the same second may go either side of e
+		c.Send("ZREVRANGEBYSCORE", key, e.posted, e.posted, "WITHSCORES")
+		c.Send("ZREVRANGEBYSCORE", key, "("+strconv.FormatInt(e.posted, 10), "-inf",
+			"WITHSCORES", "LIMIT", 0, n)
+	}
+	lists, err := receiveEntries(c, 2*len(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	var after []timelineEntry
+	for _, o := range mergeEntries(lists...) {
+		if len(after) == n {
+			break
+		}
+		if e.before(o) {
+			after = append(after, o)
+		}
+	}
+	return after, nil
+}
+
+// receiveEntries flushes the pipeline and reads n WITHSCORES replies
+func receiveEntries(c redis.Conn, n int) ([][]timelineEntry, error) {
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+	lists := make([][]timelineEntry, n)
+	for i := range lists {
+		r, err := redis.Values(c.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if lists[i], err = scanEntries(r); err != nil {
+			return nil, err
+		}
+	}
+	return lists, nil
+}
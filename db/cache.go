@@ -0,0 +1,358 @@
+package myredisDB
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * read-through cache
+ *
+ * with Cache GetUser, GetStatus and GetStatuses keep what they read from
+ * redis in a bounded LRU in process memory, entries expire after a ttl.
+ * every write that changes a user or status hash drops its entry and
+ * publishes the key on cache:invalidate, so the other servers running
+ * StartCacheSync drop it too. a server that loses its subscription
+ * clears its whole cache, it may have missed invalidations.
+ */
+
+const (
+	// wait before subscribing again after the connection failed
+	cacheResubscribe = time.Second
+)
+
+var errCacheSyncStopped = errors.New("myredisDB: cache sync stopped")
+
+// Cache keeps up to size users and statuses in memory for at most ttl,
+// 0 keeps them until they are evicted or invalidated
+func Cache(size int, ttl time.Duration) Option {
+	return func(db *DB) {
+		if size > 0 {
+			db.cache = newCache(size, ttl)
+		}
+	}
+}
+
+// CacheStats counts how the cache was used since the DB was opened
+type CacheStats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+	// entries held now
+	Size int `json:"size"`
+}
+
+/*********************************************
+************ LRU ****************************/
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+type cache struct {
+	size int
+	ttl  time.Duration
+	// names this server in published invalidations
+	origin string
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	// bumped by every invalidation, a value read from redis before the
+	// bump may be stale and is not stored
+	gen   uint64
+	stats CacheStats
+}
+
+func newCache(size int, ttl time.Duration) *cache {
+	host, _ := os.Hostname()
+	return &cache{size: size, ttl: ttl, lru: list.New(),
+		items:  make(map[string]*list.Element),
+		origin: fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())}
+}
+
+// get returns the value of key and the generation to pass to put on a miss
+func (ca *cache) get(key string) (interface{}, uint64, bool) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if e, ok := ca.items[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		if ca.ttl == 0 || time.Now().Before(entry.expires) {
+			ca.lru.MoveToFront(e)
+			ca.stats.Hits++
+			return entry.value, ca.gen, true
+		}
+		ca.remove(e)
+	}
+	ca.stats.Misses++
+	return nil, ca.gen, false
+}
+
+// put stores value unless the cache was invalidated since gen
+func (ca *cache) put(key string, value interface{}, gen uint64) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if gen != ca.gen {
+		return
+	}
+	entry := &cacheEntry{key: key, value: value,
+		expires: time.Now().Add(ca.ttl)}
+	if e, ok := ca.items[key]; ok {
+		e.Value = entry
+		ca.lru.MoveToFront(e)
+		return
+	}
+	ca.items[key] = ca.lru.PushFront(entry)
+	for ca.lru.Len() > ca.size {
+		ca.remove(ca.lru.Back())
+		ca.stats.Evictions++
+	}
+}
+
+func (ca *cache) remove(e *list.Element) {
+	ca.lru.Remove(e)
+	delete(ca.items, e.Value.(*cacheEntry).key)
+}
+
+// drop removes keys, without keys it clears the cache
+func (ca *cache) drop(keys ...string) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	ca.gen++
+	ca.stats.Invalidations++
+	if len(keys) == 0 {
+		ca.lru.Init()
+		ca.items = make(map[string]*list.Element)
+		return
+	}
+	for _, key := range keys {
+		if e, ok := ca.items[key]; ok {
+			ca.remove(e)
+		}
+	}
+}
+
+func (ca *cache) snapshot() CacheStats {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	stats := ca.stats
+	stats.Size = ca.lru.Len()
+	return stats
+}
+
+/*********************************************
+************ DB side ************************/
+
+func userCacheKey(uid int) string   { return fmt.Sprintf("user:%d", uid) }
+func statusCacheKey(sid int) string { return fmt.Sprintf("status:%d", sid) }
+
+// CacheStats reports the use of the cache, ok is false without Cache
+func (db *DB) CacheStats() (stats CacheStats, ok bool) {
+	if db.cache == nil {
+		return stats, false
+	}
+	return db.cache.snapshot(), true
+}
+
+// invalidate drops keys from this server's cache and tells the others.
+// the write already happened, so a failed publish is only logged, the
+// other servers catch up when their entries expire.
+func (db *DB) invalidate(c redis.Conn, keys ...string) {
+	if db.cache == nil {
+		return
+	}
+	db.cache.drop(keys...)
+	// the message is the origin followed by the keys
+	msg := db.cache.origin + " " + strings.Join(keys, " ")
+	if _, err := c.Do("PUBLISH", db.key("cache:invalidate"), msg); err != nil {
+		log.Printf("cache invalidation of %v: %v\n", keys, err)
+	}
+}
+
+// cachedStatuses splits ids into the statuses found in the cache and the
+// ids that have to be read from redis
+func (db *DB) cachedStatuses(ids []int) (map[int]Status, []int, uint64) {
+	var gen uint64
+	if db.cache == nil {
+		return nil, ids, gen
+	}
+	found := make(map[int]Status)
+	var fetch []int
+	for j, sid := range ids {
+		v, g, ok := db.cache.get(statusCacheKey(sid))
+		// the oldest generation, so no fetched status outlives a bump
+		if j == 0 {
+			gen = g
+		}
+		if ok {
+			found[sid] = v.(Status)
+		} else {
+			fetch = append(fetch, sid)
+		}
+	}
+	return found, fetch, gen
+}
+
+/*********************************************
+************ Invalidation listener **********/
+
+// CacheSync applies the invalidations published by other servers
+type CacheSync struct {
+	db   *DB
+	stop chan struct{}
+	done chan struct{}
+
+	mu   sync.Mutex
+	conn redis.Conn
+}
+
+// StartCacheSync subscribes to the invalidations of the other servers,
+// it returns once the subscription is confirmed
+func (db *DB) StartCacheSync() (*CacheSync, error) {
+	if db.cache == nil {
+		return nil, errors.New("myredisDB: the DB has no cache")
+	}
+	s := &CacheSync{db: db, stop: make(chan struct{}),
+		done: make(chan struct{})}
+	psc, err := s.subscribe()
+	if err != nil {
+		return nil, err
+	}
+	go s.listen(psc)
+	return s, nil
+}
+
+// Stats reports the use of the cache
+func (s *CacheSync) Stats() CacheStats {
+	stats, _ := s.db.CacheStats()
+	return stats
+}
+
+// Stop unsubscribes and waits for the listener to return
+func (s *CacheSync) Stop() {
+	s.mu.Lock()
+	close(s.stop)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+func (s *CacheSync) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// listen applies invalidations and subscribes again when the connection
+// fails, until Stop
+func (s *CacheSync) listen(psc *redis.PubSubConn) {
+	defer close(s.done)
+	for {
+		if psc != nil {
+			err := s.receive(psc)
+			psc.Close()
+			if s.stopped() {
+				return
+			}
+			log.Printf("cache invalidation listener: %v\n", err)
+			// invalidations may have been missed while not subscribed
+			s.db.cache.drop()
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(cacheResubscribe):
+		}
+		var err error
+		if psc, err = s.subscribe(); err != nil {
+			log.Printf("cache invalidation listener: %v\n", err)
+		}
+	}
+}
+
+// subscribe opens a connection and waits for the subscription
+func (s *CacheSync) subscribe() (*redis.PubSubConn, error) {
+	c, err := s.db.subscriber()
+	if err != nil {
+		return nil, err
+	}
+	// Stop closes the connection to interrupt Receive
+	s.mu.Lock()
+	if s.stopped() {
+		s.mu.Unlock()
+		c.Close()
+		return nil, errCacheSyncStopped
+	}
+	s.conn = c
+	s.mu.Unlock()
+
+	psc := &redis.PubSubConn{Conn: c}
+	if err := psc.Subscribe(s.db.key("cache:invalidate")); err != nil {
+		c.Close()
+		return nil, err
+	}
+	for {
+		switch m := psc.Receive().(type) {
+		case redis.Subscription:
+			return psc, nil
+		case error:
+			c.Close()
+			return nil, m
+		}
+	}
+}
+
+// receive applies invalidations until the connection fails
+func (s *CacheSync) receive(psc *redis.PubSubConn) error {
+	for {
+		switch m := psc.Receive().(type) {
+		case redis.Message:
+			fields := strings.Fields(string(m.Data))
+			// our own invalidations were applied when publishing
+			if len(fields) > 1 && fields[0] != s.db.cache.origin {
+				s.db.cache.drop(fields[1:]...)
+			}
+		case error:
+			return m
+		}
+	}
+}
+
+// subscriber opens a connection for SUBSCRIBE outside of the pool and
+// without a read timeout, it waits for messages. a cluster delivers
+// published messages to every node, so any master will do.
+func (db *DB) subscriber() (redis.Conn, error) {
+	o := db.options
+	o.ReadTimeout = 0
+	if db.cluster == nil {
+		return o.dial(o.Addr, db.tls)
+	}
+	masters, err := db.cluster.masters()
+	if err != nil {
+		return nil, err
+	}
+	if len(masters) == 0 {
+		return nil, errors.New("myredisDB: no cluster masters")
+	}
+	return o.dial(masters[0], db.tls)
+}
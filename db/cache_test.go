@@ -0,0 +1,104 @@
+package myredisDB
+
+import (
+	"testing"
+	"time"
+)
+
+// tests eviction, expiry and the generation check of the LRU
+func TestCacheLRU(t *testing.T) {
+	ca := newCache(2, 0)
+	_, gen, _ := ca.get("a")
+	ca.put("a", 1, gen)
+	ca.put("b", 2, gen)
+	// a is used, so b is the least recently used
+	if v, _, ok := ca.get("a"); !ok || v.(int) != 1 {
+		t.Errorf("a == %v, %v\n", v, ok)
+	}
+	ca.put("c", 3, gen)
+	if _, _, ok := ca.get("b"); ok {
+		t.Error("b was not evicted")
+	}
+
+	// a value read before an invalidation is not stored
+	ca.drop("a")
+	ca.put("a", 1, gen)
+	if _, _, ok := ca.get("a"); ok {
+		t.Error("stale a was stored")
+	}
+
+	stats := ca.snapshot()
+	if stats.Hits != 1 || stats.Misses != 3 || stats.Evictions != 1 ||
+		stats.Invalidations != 1 || stats.Size != 1 {
+		t.Errorf("stats == %+v\n", stats)
+	}
+
+	ca = newCache(10, time.Millisecond)
+	_, gen, _ = ca.get("a")
+	ca.put("a", 1, gen)
+	time.Sleep(5 * time.Millisecond)
+	if _, _, ok := ca.get("a"); ok {
+		t.Error("a did not expire")
+	}
+}
+
+// tests that writes invalidate cached users, on this server and others
+func TestCacheInvalidation(t *testing.T) {
+	db := newTestDB(t, "cache")
+	defer db.DropNamespace()
+	// two servers sharing the data
+	a := NewDB("localhost:6379", Namespace("test:cache"), Cache(100, 0))
+	b := NewDB("localhost:6379", Namespace("test:cache"), Cache(100, 0))
+	sync, err := b.StartCacheSync()
+	if err != nil {
+		t.Fatal("error starting cache sync ", err)
+	}
+	defer sync.Stop()
+
+	uid, _ := a.CreateUser("cache", "Cache")
+	other, _ := a.CreateUser("other", "Other")
+	for _, db := range []*DB{a, b} {
+		db.GetUser(uid)
+		if user, _ := db.GetUser(uid); user.Login != "cache" {
+			t.Errorf("cached user == %+v\n", user)
+		}
+	}
+	if stats := sync.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("stats == %+v\n", stats)
+	}
+
+	if _, err := a.Follow(uid, other); err != nil {
+		t.Fatal("error following ", err)
+	}
+	if user, _ := a.GetUser(uid); user.Following != 1 {
+		t.Errorf("a: following == %d\n", user.Following)
+	}
+	// b learns about the write through pub/sub
+	deadline := time.Now().Add(time.Second)
+	for {
+		user, _ := b.GetUser(uid)
+		if user.Following == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("b still has the stale user")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// statuses are cached by both GetStatus and GetStatuses
+	sid, _ := a.PostStatus(uid, "cached")
+	if statuses, _, _ := a.GetStatuses([]int{sid}); len(statuses) != 1 {
+		t.Fatalf("statuses == %+v\n", statuses)
+	}
+	before, _ := a.CacheStats()
+	if status, _ := a.GetStatus(sid); status.Message != "cached" {
+		t.Errorf("status == %+v\n", status)
+	}
+	if after, _ := a.CacheStats(); after.Hits != before.Hits+1 {
+		t.Errorf("status was not cached %+v\n", after)
+	}
+	if user, _ := a.GetUser(uid); user.Posts != 1 {
+		t.Errorf("posts == %d\n", user.Posts)
+	}
+}
@@ -0,0 +1,687 @@
+package myredisDB
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * redis cluster support
+ *
+ * with Cluster every command is sent to the master owning the hash slot
+ * of its key. per user and per status keys keep their id in a hash tag,
+ * eg. "user:{7}", "timeline:{7}", "followers:{7}", so all the keys of
+ * one user share a slot. a MULTI is split into one transaction per slot:
+ * changes to one user stay atomic, changes spanning users do not. writes
+ * that must agree across users, like the two halves of a follow edge,
+ * are therefore made by one script per user, in an order that lets the
+ * call be repeated to finish what failed halfway.
+ */
+
+const (
+	clusterSlots = 16384
+	// redirects followed before a command fails
+	clusterRedirects = 5
+	// wait before retrying a command on a slot that is being migrated
+	clusterRetryWait = 50 * time.Millisecond
+)
+
+// Cluster makes the DB talk to a redis cluster, nodes are the addresses
+// used to discover the slot layout. Options.Addr is used without nodes.
+func Cluster(nodes ...string) Option {
+	return func(db *DB) {
+		db.cluster = newCluster(nodes)
+	}
+}
+
+/*********************************************
+************ Slot map ***********************/
+
+// cluster keeps the slot layout and a connection pool per master
+type cluster struct {
+	seeds []string
+	// opens a pool to one node, set by NewDBWithOptions
+	newPool func(addr string) *redis.Pool
+
+	mu    sync.RWMutex
+	slots [clusterSlots]string
+	pools map[string]*redis.Pool
+}
+
+func newCluster(seeds []string) *cluster {
+	return &cluster{seeds: seeds, pools: make(map[string]*redis.Pool)}
+}
+
+func (cl *cluster) pool(addr string) *redis.Pool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	p, ok := cl.pools[addr]
+	if !ok {
+		p = cl.newPool(addr)
+		cl.pools[addr] = p
+	}
+	return p
+}
+
+// conn returns a connection that routes every command to its slot
+func (cl *cluster) conn() redis.Conn {
+	return &clusterConn{cl: cl, conns: make(map[string]redis.Conn)}
+}
+
+// refresh reloads the slot layout with CLUSTER SLOTS
+func (cl *cluster) refresh() error {
+	cl.mu.RLock()
+	nodes := append(cl.mastersLocked(), cl.seeds...)
+	cl.mu.RUnlock()
+
+	err := errors.New("myredisDB: no cluster nodes")
+	for _, addr := range nodes {
+		var slots [clusterSlots]string
+		if slots, err = cl.slotsFrom(addr); err == nil {
+			cl.mu.Lock()
+			cl.slots = slots
+			cl.mu.Unlock()
+			return nil
+		}
+	}
+	return err
+}
+
+func (cl *cluster) slotsFrom(addr string) ([clusterSlots]string, error) {
+	var slots [clusterSlots]string
+	c := cl.pool(addr).Get()
+	defer c.Close()
+
+	ranges, err := redis.Values(c.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return slots, err
+	}
+	for _, rng := range ranges {
+		// [start, end, [host, port, id], replicas...]
+		r, err := redis.Values(rng, nil)
+		if err != nil {
+			return slots, err
+		}
+		var start, end int
+		var master []interface{}
+		if _, err := redis.Scan(r, &start, &end, &master); err != nil {
+			return slots, err
+		}
+		var host string
+		var port int
+		if _, err := redis.Scan(master, &host, &port); err != nil {
+			return slots, err
+		}
+		// an empty host means the node we asked
+		if host == "" {
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		node := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end && slot < clusterSlots; slot++ {
+			slots[slot] = node
+		}
+	}
+	return slots, nil
+}
+
+// addr returns the master serving slot
+func (cl *cluster) addr(slot int) (string, error) {
+	cl.mu.RLock()
+	addr := cl.slots[slot]
+	cl.mu.RUnlock()
+	if addr != "" {
+		return addr, nil
+	}
+
+	if err := cl.refresh(); err != nil {
+		return "", err
+	}
+	cl.mu.RLock()
+	addr = cl.slots[slot]
+	cl.mu.RUnlock()
+	if addr == "" {
+		return "", fmt.Errorf("myredisDB: no cluster node serves slot %d", slot)
+	}
+	return addr, nil
+}
+
+// moved records that slot is now served by addr. other slots have
+// usually moved along with it, so the whole layout is reloaded.
+func (cl *cluster) moved(slot int, addr string) {
+	cl.refresh()
+	cl.mu.Lock()
+	cl.slots[slot] = addr
+	cl.mu.Unlock()
+}
+
+// masters returns the address of every master that serves a slot
+func (cl *cluster) masters() ([]string, error) {
+	cl.mu.RLock()
+	masters := cl.mastersLocked()
+	cl.mu.RUnlock()
+	if len(masters) > 0 {
+		return masters, nil
+	}
+
+	if err := cl.refresh(); err != nil {
+		return nil, err
+	}
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.mastersLocked(), nil
+}
+
+func (cl *cluster) mastersLocked() []string {
+	var masters []string
+	seen := make(map[string]bool)
+	for _, addr := range cl.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			masters = append(masters, addr)
+		}
+	}
+	return masters
+}
+
+/*********************************************
+************ Routing connection *************/
+
+type command struct {
+	name string
+	args []interface{}
+}
+
+type reply struct {
+	v   interface{}
+	err error
+}
+
+// clusterConn is a redis.Conn that sends each command to the node owning
+// its key. Send/Flush/Receive keep their order but are not pipelined.
+type clusterConn struct {
+	cl *cluster
+	// one connection per node, checked out on first use
+	conns map[string]redis.Conn
+
+	multi   bool
+	queued  []command
+	pending []command
+	replies []reply
+	closed  bool
+}
+
+var errClusterConnClosed = errors.New("myredisDB: cluster connection closed")
+
+func (cc *clusterConn) Close() error {
+	cc.closed = true
+	var err error
+	for _, c := range cc.conns {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	cc.conns = nil
+	return err
+}
+
+func (cc *clusterConn) Err() error {
+	if cc.closed {
+		return errClusterConnClosed
+	}
+	return nil
+}
+
+func (cc *clusterConn) Send(cmd string, args ...interface{}) error {
+	if cc.closed {
+		return errClusterConnClosed
+	}
+	cc.pending = append(cc.pending, command{cmd, args})
+	return nil
+}
+
+func (cc *clusterConn) Flush() error {
+	if cc.closed {
+		return errClusterConnClosed
+	}
+	pending := cc.pending
+	cc.pending = nil
+	for _, cmd := range pending {
+		v, err := cc.do(cmd)
+		cc.replies = append(cc.replies, reply{v, err})
+	}
+	return nil
+}
+
+func (cc *clusterConn) Receive() (interface{}, error) {
+	if len(cc.replies) == 0 {
+		if err := cc.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	if len(cc.replies) == 0 {
+		return nil, errors.New("myredisDB: no pending replies")
+	}
+	r := cc.replies[0]
+	cc.replies = cc.replies[1:]
+	return r.v, r.err
+}
+
+// Do runs the pending commands and then cmd. like redigo it returns the
+// reply of cmd and the first error of all of them, and Do("") returns
+// every pending reply.
+func (cc *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := cc.Flush(); err != nil {
+		return nil, err
+	}
+	replies := cc.replies
+	cc.replies = nil
+
+	if cmd == "" {
+		all := make([]interface{}, len(replies))
+		for i, r := range replies {
+			all[i] = r.v
+			if e, ok := r.err.(redis.Error); ok {
+				all[i] = e
+			} else if r.err != nil {
+				return nil, r.err
+			}
+		}
+		return all, nil
+	}
+
+	v, err := cc.do(command{cmd, args})
+	for _, r := range replies {
+		if r.err != nil {
+			return v, r.err
+		}
+	}
+	return v, err
+}
+
+// do runs one command, queueing it while a MULTI is open
+func (cc *clusterConn) do(cmd command) (interface{}, error) {
+	if cc.closed {
+		return nil, errClusterConnClosed
+	}
+
+	switch strings.ToUpper(cmd.name) {
+	case "MULTI":
+		if cc.multi {
+			return nil, redis.Error("ERR MULTI calls can not be nested")
+		}
+		cc.multi = true
+		return "OK", nil
+	case "EXEC":
+		if !cc.multi {
+			return nil, redis.Error("ERR EXEC without MULTI")
+		}
+		queued := cc.queued
+		cc.multi, cc.queued = false, nil
+		return cc.exec(queued)
+	case "DISCARD":
+		cc.multi, cc.queued = false, nil
+		return "OK", nil
+	case "WATCH", "UNWATCH":
+		return nil, redis.Error("ERR " + cmd.name + " is not supported in cluster mode")
+	}
+
+	if cc.multi {
+		cc.queued = append(cc.queued, cmd)
+		return "QUEUED", nil
+	}
+	return cc.run(cmd)
+}
+
+// run sends a command outside of a transaction
+func (cc *clusterConn) run(cmd command) (interface{}, error) {
+	switch name := strings.ToUpper(cmd.name); name {
+	case "SCRIPT":
+		// scripts have to be known by every master
+		masters, err := cc.cl.masters()
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		for _, addr := range masters {
+			if v, err = cc.node(addr).Do(cmd.name, cmd.args...); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	case "DEL", "UNLINK", "EXISTS", "TOUCH":
+		if len(cmd.args) > 1 {
+			return cc.splitCount(cmd)
+		}
+	}
+
+	slot := 0
+	if key, ok := commandKey(cmd); ok {
+		slot = keySlot(key)
+	}
+	return cc.routed(slot, cmd)
+}
+
+// routed sends cmd to the node serving slot and follows redirects
+func (cc *clusterConn) routed(slot int, cmd command) (interface{}, error) {
+	addr, err := cc.cl.addr(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	asking := false
+	for i := 0; i < clusterRedirects; i++ {
+		c := cc.node(addr)
+		if asking {
+			c.Send("ASKING")
+		}
+		v, err := c.Do(cmd.name, cmd.args...)
+
+		target, ask, ok := redirect(err)
+		switch {
+		case ok && ask:
+			// the key is being migrated and lives on target for now
+			addr, asking = target, true
+		case ok:
+			cc.cl.moved(slot, target)
+			addr, asking = target, false
+		case tryAgain(err):
+			time.Sleep(clusterRetryWait)
+		default:
+			return v, err
+		}
+	}
+	return nil, fmt.Errorf("myredisDB: too many redirects for %s", cmd.name)
+}
+
+// exec runs the commands of a MULTI as one transaction per slot and
+// returns their replies in the order they were queued
+func (cc *clusterConn) exec(queued []command) (interface{}, error) {
+	var order []int
+	bySlot := make(map[int][]int)
+	for i, cmd := range queued {
+		slot := -1
+		if key, ok := commandKey(cmd); ok {
+			slot = keySlot(key)
+		}
+		if _, ok := bySlot[slot]; !ok {
+			order = append(order, slot)
+		}
+		bySlot[slot] = append(bySlot[slot], i)
+	}
+
+	replies := make([]interface{}, len(queued))
+	for _, slot := range order {
+		var cmds []command
+		for _, i := range bySlot[slot] {
+			cmds = append(cmds, queued[i])
+		}
+		// commands without a key can run on any node
+		target := slot
+		if target == -1 {
+			target = 0
+		}
+		r, err := cc.transaction(target, cmds)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range bySlot[slot] {
+			replies[i] = r[j]
+		}
+	}
+	return replies, nil
+}
+
+// transaction runs cmds in a MULTI on the node serving slot
+func (cc *clusterConn) transaction(slot int, cmds []command) ([]interface{}, error) {
+	addr, err := cc.cl.addr(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < clusterRedirects; i++ {
+		c := cc.node(addr)
+		c.Send("MULTI")
+		for _, cmd := range cmds {
+			c.Send(cmd.name, cmd.args...)
+		}
+		r, err := c.Do("EXEC")
+
+		target, ask, ok := redirect(err)
+		switch {
+		case ok && !ask:
+			cc.cl.moved(slot, target)
+			addr = target
+		case ok, tryAgain(err):
+			// the slot is being migrated, wait until it is done
+			time.Sleep(clusterRetryWait)
+		case err != nil:
+			return nil, err
+		default:
+			return redis.Values(r, nil)
+		}
+	}
+	return nil, fmt.Errorf("myredisDB: too many redirects for transaction on slot %d", slot)
+}
+
+// splitCount runs a multi key command that returns a count once per slot
+func (cc *clusterConn) splitCount(cmd command) (interface{}, error) {
+	var order []int
+	bySlot := make(map[int][]interface{})
+	for _, key := range cmd.args {
+		slot := keySlot(argString(key))
+		if _, ok := bySlot[slot]; !ok {
+			order = append(order, slot)
+		}
+		bySlot[slot] = append(bySlot[slot], key)
+	}
+
+	var total int64
+	for _, slot := range order {
+		n, err := redis.Int64(cc.routed(slot, command{cmd.name, bySlot[slot]}))
+		if err != nil {
+			return nil, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// node returns this connection's connection to addr
+func (cc *clusterConn) node(addr string) redis.Conn {
+	c, ok := cc.conns[addr]
+	if !ok || c.Err() != nil {
+		if ok {
+			c.Close()
+		}
+		c = cc.cl.pool(addr).Get()
+		cc.conns[addr] = c
+	}
+	return c
+}
+
+/*********************************************
+************ Keys and slots *****************/
+
+// commandKey returns the key that decides where cmd is sent
+func commandKey(cmd command) (string, bool) {
+	args := cmd.args
+	switch strings.ToUpper(cmd.name) {
+	case "PING", "ECHO", "INFO", "TIME", "CLUSTER", "SCRIPT", "PUBLISH",
+		"SCAN", "KEYS", "DBSIZE", "ASKING", "AUTH", "SELECT":
+		return "", false
+	case "EVAL", "EVALSHA":
+		if len(args) > 2 && argString(args[1]) != "0" {
+			return argString(args[2]), true
+		}
+		return "", false
+	case "XREAD", "XREADGROUP":
+		for i := 0; i+1 < len(args); i++ {
+			if strings.EqualFold(argString(args[i]), "STREAMS") {
+				return argString(args[i+1]), true
+			}
+		}
+		return "", false
+	case "XGROUP", "XINFO", "OBJECT":
+		if len(args) > 1 {
+			return argString(args[1]), true
+		}
+		return "", false
+	}
+	if len(args) > 0 {
+		return argString(args[0]), true
+	}
+	return "", false
+}
+
+func argString(arg interface{}) string {
+	switch a := arg.(type) {
+	case string:
+		return a
+	case []byte:
+		return string(a)
+	default:
+		return fmt.Sprint(a)
+	}
+}
+
+// keySlot returns the cluster slot of key, honoring {hash tags}
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 is the CCITT (XMODEM) checksum redis cluster uses for slots
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// redirect parses a MOVED or ASK error into the address to retry on
+func redirect(err error) (addr string, ask bool, ok bool) {
+	e, isRedis := err.(redis.Error)
+	if !isRedis {
+		return "", false, false
+	}
+	// "MOVED 3999 127.0.0.1:6381" or "ASK 3999 127.0.0.1:6381"
+	f := strings.Fields(string(e))
+	if len(f) != 3 || (f[0] != "MOVED" && f[0] != "ASK") {
+		return "", false, false
+	}
+	return f[2], f[0] == "ASK", true
+}
+
+func tryAgain(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && (strings.HasPrefix(string(e), "TRYAGAIN") ||
+		strings.HasPrefix(string(e), "CLUSTERDOWN"))
+}
+
+/*********************************************
+************ Cluster publishing *************/
+
+// postStatusSlots is postStatusScript for a cluster and returns the id
+// of the status. the id counter, the status, the author and every
+// follower are in different slots, so it is not atomic: the id is taken,
+// the status is written with the author's keys in one transaction, and
+// then joins its thread and reaches the followers one step after the
+// other. a failure in between burns the id, or leaves a status that not
+// every follower sees and is returned with the error. Fsck finishes a
+// reply that did not join its thread.
+func (db *DB) postStatusSlots(c redis.Conn, uid int, t thread, message, entities string, posted int64) (int, error) {
+	sid, err := redis.Int(c.Do("INCR", db.key("status:id")))
+	if err != nil {
+		return -1, err
+	}
+	t.sid = sid
+	login, err := redis.String(c.Do("HGET", db.idKey("user:", uid), "login"))
+	if err != nil && err != redis.ErrNil {
+		return -1, err
+	}
+
+	timeline := db.idKey("timeline:", uid)
+	c.Send("MULTI")
+	c.Send("HMSET", db.idKey("status:", sid), "message", message,
+		"posted", posted, "id", sid, "uid", uid, "login", login)
+	if entities != "" {
+		c.Send("HSET", db.idKey("status:", sid), "entities", entities)
+	}
+	if t.parent != 0 {
+		c.Send("HMSET", db.idKey("status:", sid), "in_reply_to", t.parent,
+			"root", t.root)
+	}
+	c.Send("HINCRBY", db.idKey("user:", uid), "posts", 1)
+	c.Send("ZADD", timeline, posted, sid)
+	if db.maxTimeline > 0 {
+		c.Send("ZREMRANGEBYRANK", timeline, 0, -(db.maxTimeline + 1))
+	}
+	c.Send("ZADD", db.idKey("posts:", uid), posted, sid)
+	c.Send("ZCARD", db.idKey("followers:", uid))
+	r, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return -1, err
+	}
+	followers, err := redis.Int(r[len(r)-1], nil)
+	if err != nil {
+		return sid, err
+	}
+	if t.parent != 0 {
+		if err := db.addToThread(c, t, posted); err != nil {
+			return sid, err
+		}
+	}
+
+	switch {
+	case db.fanoutThreshold > 0 && followers > db.fanoutThreshold:
+		_, err = c.Do("SADD", db.key("fanout:pull"), uid)
+	case db.asyncFanout:
+		_, err = c.Do("XADD", db.key("fanout:jobs"), "*", "uid", uid,
+			"sid", sid, "posted", posted)
+	default:
+		err = db.syndicateStatus(c, uid, sid, posted, false)
+	}
+	return sid, err
+}
+
+// eachNode calls fn with a connection to every node holding data: the
+// redis server, or every master of a cluster
+func (db *DB) eachNode(fn func(c redis.Conn) error) error {
+	if db.cluster == nil {
+		c := db.Get()
+		defer c.Close()
+		return fn(c)
+	}
+
+	masters, err := db.cluster.masters()
+	if err != nil {
+		return err
+	}
+	for _, addr := range masters {
+		c := db.cluster.pool(addr).Get()
+		err := fn(c)
+		c.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"os"
+	"strings"
+	"testing"
+)
+
+// the cluster tests need REDIS_CLUSTER to list the nodes of a running
+// cluster, eg. one started with testdata/cluster.sh
+func newClusterTestDB(t *testing.T, ns string) *DB {
+	nodes := os.Getenv("REDIS_CLUSTER")
+	if nodes == "" {
+		t.Skip("REDIS_CLUSTER is not set")
+	}
+	db := NewDB("", Cluster(strings.Split(nodes, ",")...), Namespace("test:"+ns))
+	if _, err := db.DropNamespace(); err != nil {
+		t.Fatal("unable to clear test namespace: ", err)
+	}
+	return db
+}
+
+// tests the slot of keys against the values redis reports
+func TestKeySlot(t *testing.T) {
+	slots := map[string]int{
+		"123456789":            12739,
+		"foo":                  12182,
+		"somekey":              11058,
+		"{user1000}.following": keySlot("user1000"),
+		"foo{}{bar}":           keySlot("foo{}{bar}"),
+		"foo{{bar}}zap":        keySlot("{bar"),
+		"foo{bar}{zap}":        keySlot("bar"),
+	}
+	for key, slot := range slots {
+		if s := keySlot(key); s != slot {
+			t.Errorf("keySlot(%q) == %v, expected %v\n", key, s, slot)
+		}
+	}
+
+	db := NewDB("", Cluster(), Namespace("ns"))
+	if db.idKey("user:", 7) != "ns:user:{7}" {
+		t.Errorf("idKey == %v\n", db.idKey("user:", 7))
+	}
+	for _, prefix := range []string{"timeline:", "followers:", "following:", "posts:"} {
+		if keySlot(db.idKey(prefix, 7)) != keySlot(db.idKey("user:", 7)) {
+			t.Errorf("%v7 is not in the slot of user:7\n", prefix)
+		}
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	addr, ask, ok := redirect(redis.Error("MOVED 3999 127.0.0.1:6381"))
+	if !ok || ask || addr != "127.0.0.1:6381" {
+		t.Errorf("MOVED parsed as %v %v %v\n", addr, ask, ok)
+	}
+	addr, ask, ok = redirect(redis.Error("ASK 3999 127.0.0.1:6382"))
+	if !ok || !ask || addr != "127.0.0.1:6382" {
+		t.Errorf("ASK parsed as %v %v %v\n", addr, ask, ok)
+	}
+	if _, _, ok := redirect(redis.Error("ERR unknown command")); ok {
+		t.Error("ERR parsed as a redirect")
+	}
+}
+
+// tests users, follows and posts spread over the cluster
+func TestCluster(t *testing.T) {
+	db := newClusterTestDB(t, "cluster")
+	defer db.DropNamespace()
+
+	var uids []int
+	for _, login := range []string{"a", "b", "c", "d"} {
+		uid, err := db.CreateUser(login, login)
+		if err != nil || uid == -1 {
+			t.Fatal("error creating user ", err)
+		}
+		uids = append(uids, uid)
+	}
+	// everyone follows the first user
+	for _, uid := range uids[1:] {
+		if res, err := db.Follow(uid, uids[0]); !res || err != nil {
+			t.Error("error following ", err)
+		}
+	}
+	if user, _ := db.GetUser(uids[0]); user.Followers != 3 {
+		t.Errorf("user.Followers == %v\n", user.Followers)
+	}
+
+	sid, err := db.PostStatus(uids[0], "this is a post")
+	if sid == -1 || err != nil {
+		t.Fatal("error posting status ", err)
+	}
+	for _, uid := range uids {
+		timeline, err := db.GetUserTimeline(uid, 1, 30)
+		if err != nil || len(timeline) != 1 || timeline[0] != sid {
+			t.Errorf("timeline:%v == %v err: %v\n", uid, timeline, err)
+		}
+	}
+	if status, _ := db.GetStatus(sid); status.Login != "a" {
+		t.Errorf("unexpected status %+v\n", status)
+	}
+
+	if res, err := db.Unfollow(uids[1], uids[0]); !res || err != nil {
+		t.Error("error unfollowing ", err)
+	}
+	if user, _ := db.GetUser(uids[1]); user.Following != 0 {
+		t.Errorf("user.Following == %v\n", user.Following)
+	}
+
+	if n, err := db.DropNamespace(); err != nil || n == 0 {
+		t.Errorf("DropNamespace removed %v keys, err: %v\n", n, err)
+	}
+}
@@ -1,44 +1,127 @@
 package myredisDB
 
 import (
+	"crypto/tls"
+	"errors"
 	"github.com/garyburd/redigo/redis"
+	"log"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// how long a deleted status is kept as a tombstone, long enough for the
+// reads that started before the delete
+const tombstoneTTL = 24 * time.Hour
+
+// times a status is published again when other writes changed the next
+// status id or the followers in between
+const publishAttempts = 10
+
+// ErrContended is returned when other writes kept changing the data a
+// status is published against
+var ErrContended = errors.New("myredisDB: too many concurrent writes, try again")
+
 /*******************************************
 ************** Fields *********************/
 
 type DB struct {
 	// pool of redis connections
 	pool *redis.Pool
+	// connection settings, tls is built from them
+	options Options
+	tls     *tls.Config
+	// prepended to every key, empty for the application data
+	namespace string
+	// authors with more followers than this are pulled on read, 0 disables
+	fanoutThreshold int
+	// queue the fan-out for the stream workers instead of pushing
+	asyncFanout bool
+	// timelines are trimmed to this many entries, 0 disables
+	maxTimeline int
+	// slot layout and node pools, nil unless talking to a redis cluster
+	cluster *cluster
+	// users and statuses read recently, nil without Cache
+	cache *cache
+	// statuses can be edited this long after posting, 0 is forever
+	editWindow time.Duration
+	// periods hashtags are counted in, see TrendWindows
+	trendWindows []TrendWindow
+}
+
+// Option configures a DB in NewDB
+type Option func(*DB)
+
+// Namespace prefixes every key the DB touches with "<ns>:", so several
+// isolated datasets (tests, tenants) can share one redis server.
+// namespaces should not nest, dropping "a" also drops "a:b".
+func Namespace(ns string) Option {
+	return func(db *DB) {
+		if ns != "" {
+			db.namespace = ns + ":"
+		}
+	}
 }
 
 /********************************************
 ************* Constructor ******************/
 
-func NewDB(server string) *DB {
-	db := new(DB)
-	// default port for redis server
-	db.pool = newPool("localhost:6379")
+// connects to the redis server at server with the default options,
+// localhost:6379 when server is empty. returns nil if the options are
+// not usable.
+func NewDB(server string, opts ...Option) *DB {
+	o := DefaultOptions()
+	if server != "" {
+		o.Addr = server
+	}
+	db, err := NewDBWithOptions(o, opts...)
+	if err != nil {
+		return nil
+	}
 	return db
 }
 
+// connects with the given connection settings
+func NewDBWithOptions(o Options, opts ...Option) (*DB, error) {
+	config, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{options: o, tls: config, trendWindows: DefaultTrendWindows()}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if err := checkTrendWindows(db.trendWindows); err != nil {
+		return nil, err
+	}
+
+	if db.cluster == nil {
+		db.pool = db.newPool(o.Addr)
+		return db, nil
+	}
+	// a cluster only has database 0
+	if o.Database != 0 {
+		return nil, errors.New("myredisDB: a redis cluster can not select a database")
+	}
+	if len(db.cluster.seeds) == 0 {
+		db.cluster.seeds = []string{o.Addr}
+	}
+	db.cluster.newPool = db.newPool
+	return db, nil
+}
+
 /*********************************************
 ************ Connection Code ****************/
 
 // init redis pool
-func newPool(server string) *redis.Pool {
+func (db *DB) newPool(server string) *redis.Pool {
+	o := db.options
 	return &redis.Pool{
-		MaxIdle:     10,
-		IdleTimeout: 240 * time.Second,
-		MaxActive:   1000, // limit to 1000 active users
+		MaxIdle:     o.MaxIdle,
+		IdleTimeout: o.IdleTimeout,
+		MaxActive:   o.MaxActive,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server)
-			if err != nil {
-				return nil, err
-			}
-			return c, err
+			return o.dial(server, db.tls)
 		},
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			_, err := c.Do("PING")
@@ -48,9 +131,87 @@ func newPool(server string) *redis.Pool {
 }
 
 func (db *DB) Get() redis.Conn {
+	if db.cluster != nil {
+		return db.cluster.conn()
+	}
 	return db.pool.Get()
 }
 
+/********************************************
+***************  Key code ******************/
+
+// key returns the namespaced name of a global key such as "users:"
+func (db *DB) key(name string) string {
+	return db.namespace + name
+}
+
+// idKey returns the namespaced key of a per user or per status structure,
+// eg. idKey("timeline:", 7) == "<ns>:timeline:7". on a cluster the id is
+// a hash tag, "<ns>:timeline:{7}", so the keys of one user share a slot.
+func (db *DB) idKey(prefix string, id int) string {
+	if db.cluster != nil {
+		return db.namespace + prefix + "{" + strconv.Itoa(id) + "}"
+	}
+	return db.namespace + prefix + strconv.Itoa(id)
+}
+
+// DropNamespace deletes every key in the DB's namespace and returns how
+// many were removed. it refuses to run without a namespace, since that
+// would remove all of the application data.
+func (db *DB) DropNamespace() (int, error) {
+	if db.namespace == "" {
+		return 0, errors.New("myredisDB: refusing to drop the default namespace")
+	}
+	pattern := globEscape(db.namespace) + "*"
+	deleted := 0
+	err := db.eachNode(func(c redis.Conn) error {
+		cursor := 0
+		for {
+			r, err := redis.Values(c.Do("SCAN", cursor, "MATCH", pattern,
+				"COUNT", 1000))
+			if err != nil {
+				return err
+			}
+			var keys []string
+			if _, err := redis.Scan(r, &cursor, &keys); err != nil {
+				return err
+			}
+			// one DEL per key, the keys of a cluster node span many slots
+			for _, key := range keys {
+				c.Send("DEL", key)
+			}
+			if len(keys) > 0 {
+				r, err = redis.Values(c.Do(""))
+				if err != nil {
+					return err
+				}
+				for _, n := range r {
+					if n, err := redis.Int(n, nil); err == nil {
+						deleted += n
+					}
+				}
+			}
+			if cursor == 0 {
+				return nil
+			}
+		}
+	})
+	return deleted, err
+}
+
+// escapes the glob characters understood by SCAN MATCH
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 /********************************************
 ***************  User code *****************/
 
@@ -59,12 +220,12 @@ func (db *DB) CreateUser(login, name string) (int, error) {
 	c := db.Get()
 	defer c.Close()
 	// check if username is taken
-	if exists, err := redis.Int(c.Do("HEXISTS", "users:", login)); err != nil || exists == 1 {
+	if exists, err := redis.Int(c.Do("HEXISTS", db.key("users:"), login)); err != nil || exists == 1 {
 		return -1, err
 	}
 
 	// increment global user count
-	id, err := redis.Int(c.Do("INCR", "user:id"))
+	id, err := redis.Int(c.Do("INCR", db.key("user:id")))
 	if err != nil {
 		return -1, err
 	}
@@ -72,46 +233,41 @@ func (db *DB) CreateUser(login, name string) (int, error) {
 	// we want to do a transaction so we use MULTI cmd1 cmd2 ... EXEC
 	c.Do("MULTI")
 	// register the username to the uid
-	c.Do("HSET", "users:", login, id)
+	c.Do("HSET", db.key("users:"), login, id)
 	// set fields for user structure
-	c.Do("HMSET", "user:"+strconv.Itoa(id), "login", login,
+	c.Do("HMSET", db.idKey("user:", id), "login", login,
 		"id", id, "name", name, "followers", "0", "following", "0",
 		"posts", "0", "signup", time.Now().Unix())
+	// the first user starts a store, its data is in the latest layout
+	if id == 1 {
+		c.Do("SET", db.key("schema:version"), LatestSchema, "NX")
+	}
 	if _, err := c.Do("EXEC"); err != nil {
 		return -1, err
 	}
+	db.sendIndexUser(c, id, login, name)
+	if _, err := c.Do(""); err != nil {
+		return -1, err
+	}
 
 	return id, nil
 }
 
-func (db *DB) DeleteUser(uid int) (bool, error) {
-	c := db.Get()
-	defer c.Close()
-	// get the users login value so we can remove it from global store
-	login, err := redis.String(c.Do("HGET", "user:"+strconv.Itoa(uid), "login"))
-	if err != nil {
-		return false, err
-	}
-	// user exists
-	if login != "" {
-		c.Do("MULTI")
-		// remove username from global store
-		c.Do("HDEL", "users:", login)
-		// delete the key to the hash structure
-		c.Do("DEL", "user:"+strconv.Itoa(uid))
-		if _, err := c.Do("EXEC"); err != nil {
-			return false, err
-		}
-	}
-	return true, nil
-}
-
 func (db *DB) GetUser(uid int) (*User, error) {
 	var user User
+	var gen uint64
+	if db.cache != nil {
+		v, g, ok := db.cache.get(userCacheKey(uid))
+		if ok {
+			user = v.(User)
+			return &user, nil
+		}
+		gen = g
+	}
 	c := db.Get()
 	defer c.Close()
 
-	r, err := redis.Values(c.Do("HGETALL", "user:"+strconv.Itoa(uid)))
+	r, err := redis.Values(c.Do("HGETALL", db.idKey("user:", uid)))
 	if err != nil {
 		return nil, err
 	}
@@ -119,6 +275,10 @@ func (db *DB) GetUser(uid int) (*User, error) {
 	if err := redis.ScanStruct(r, &user); err != nil {
 		return nil, err
 	}
+	// a missing user is not cached, the id may be handed out later
+	if db.cache != nil && len(r) > 0 {
+		db.cache.put(userCacheKey(uid), user, gen)
+	}
 
 	return &user, nil
 }
@@ -126,123 +286,298 @@ func (db *DB) GetUser(uid int) (*User, error) {
 /********************************************
 *************** Status code ****************/
 
-// creates a status hash structure and returns it's status id.
-func createStatus(message string, uid int, c redis.Conn) (int, error) {
-	var login string
-	var sid int
-	defer c.Close()
-
-	c.Do("MULTI")
-	// get login name for user with id
-	c.Do("HGET", "user:"+strconv.Itoa(uid), "login")
-	// get the incremented global status count
-	c.Do("INCR", "status:id")
-	// reply contains both the login for the uid and the global status count
-	reply, err := redis.Values(c.Do("EXEC"))
-
-	if err != nil {
-		return -1, err
-	}
-	// scan reply into the local variables
-	if _, err := redis.Scan(reply, &login, &sid); err != nil {
-		return -1, err
-	}
-	// set all the appropriate values in the hash store
-	if _, err := c.Do("HMSET", "status:"+strconv.Itoa(sid), "message", message,
-		"posted", time.Now().Unix(), "id", sid, "uid", uid, "login", login); err != nil {
-		return -1, err
-	}
-	// increment the user's post count
-	if _, err := c.Do("HINCRBY", "user:"+strconv.Itoa(uid), "posts", 1); err != nil {
-		return -1, err
-	}
-
-	return sid, nil
-}
-
 // simple function to fetch a status hash
 func (db *DB) GetStatus(sid int) (Status, error) {
 	var status Status
+	var gen uint64
+	if db.cache != nil {
+		v, g, ok := db.cache.get(statusCacheKey(sid))
+		if ok {
+			return v.(Status), nil
+		}
+		gen = g
+	}
 	c := db.Get()
 	defer c.Close()
 
-	r, err := redis.Values(c.Do("HGETALL", "status:"+strconv.Itoa(sid)))
+	r, err := redis.Values(c.Do("HGETALL", db.idKey("status:", sid)))
 
 	if err != nil {
 		return status, err
 	}
 
-	if err := redis.ScanStruct(r, &status); err != nil {
+	if err := scanStatus(r, &status); err != nil {
 		return status, err
 	}
+	// a deleted status reads like a missing one
+	if status.Deleted != 0 {
+		return Status{}, nil
+	}
+	if db.cache != nil && len(r) > 0 {
+		db.cache.put(statusCacheKey(sid), status, gen)
+	}
 
 	return status, nil
 }
 
+// fetches many status hashes in one round trip on one connection. the
+// statuses come back in the order of ids, ids without a status hash or
+// with a tombstone are left out and listed in missing. cached statuses
+// are not fetched.
+func (db *DB) GetStatuses(ids []int) ([]Status, []int, error) {
+	found, fetch, gen := db.cachedStatuses(ids)
+	if len(fetch) > 0 {
+		c := db.Get()
+		defer c.Close()
+
+		for _, sid := range fetch {
+			c.Send("HGETALL", db.idKey("status:", sid))
+		}
+		if err := c.Flush(); err != nil {
+			return nil, nil, err
+		}
+		if found == nil {
+			found = make(map[int]Status, len(fetch))
+		}
+		for _, sid := range fetch {
+			r, err := redis.Values(c.Receive())
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(r) == 0 {
+				continue
+			}
+			var status Status
+			if err := scanStatus(r, &status); err != nil {
+				return nil, nil, err
+			}
+			if status.Deleted != 0 {
+				continue
+			}
+			found[sid] = status
+			if db.cache != nil {
+				db.cache.put(statusCacheKey(sid), status, gen)
+			}
+		}
+	}
+
+	statuses := make([]Status, 0, len(ids))
+	var missing []int
+	for _, sid := range ids {
+		if status, ok := found[sid]; ok {
+			statuses = append(statuses, status)
+		} else {
+			missing = append(missing, sid)
+		}
+	}
+	return statuses, missing, nil
+}
+
 /*
 	exported function for posting a user's status
-	will call createStatus(...) and syndicateStatus(...)
+	on one redis server the status id is taken, the status hash written,
+	the post counted and the status added to the timelines of the author
+	and the followers, or queued or marked to be pulled, by one lua
+	script, so a failure never leaves a half published status behind. on
+	a cluster the keys are in different slots and postStatusSlots
+	publishes without that guarantee, an error may come with the id of a
+	status that was written but did not reach every follower. indexing
+	the words and entities, counting the hashtags and notifying the
+	mentioned users follow the published status and only log their errors
 */
 func (db *DB) PostStatus(uid int, message string) (int, error) {
+	return db.postStatus(uid, message, 0, 0)
+}
+
+// postStatus publishes a status, with parent as a reply in the
+// conversation of root
+func (db *DB) postStatus(uid int, message string, parent, root int) (int, error) {
 	c := db.Get()
 	defer c.Close()
-	// create the status hash structure
-	sid, err := createStatus(message, uid, db.Get())
+
+	// the author's post count changes
+	defer db.invalidate(c, userCacheKey(uid))
+	entities, err := db.entities(c, message)
 	if err != nil {
 		return -1, err
 	}
-	// check to see if the status is actually created before sharing to timelines
-	if sid == -1 {
-		return -1, nil
+	posted := time.Now().Unix()
+	t := thread{parent: parent, root: root}
+	if db.cluster != nil {
+		t.sid, err = db.postStatusSlots(c, uid, t, message, entities.encode(), posted)
+	} else {
+		t.sid, err = db.publishStatus(c, uid, t, message, entities.encode(), posted)
 	}
-	// the time of the post is the score for the key in the sorted set
-	time, err := redis.Int(c.Do("HGET", "status:"+strconv.Itoa(sid), "posted"))
-
 	if err != nil {
-		return -1, err
-	}
-	// add the post to the user's timeline
-	if _, err := c.Do("ZADD", "timeline:"+strconv.Itoa(uid), time, sid); err != nil {
-		return -1, err
+		return t.sid, err
 	}
-	// push the status to the follower's timelines
-	succ, err := syndicateStatus(strconv.Itoa(uid), strconv.Itoa(sid), strconv.Itoa(time),
-		db.Get())
+	sid := t.sid
 
-	if succ != true || err != nil {
-		return -1, err
+	// the status is out, what follows can not take it back
+	if err := db.indexEntities(c, uid, sid, posted, entities); err != nil {
+		log.Printf("indexing the entities of status %d: %v\n", sid, err)
+	}
+	if err := db.indexWords(c, sid, posted, message); err != nil {
+		log.Printf("indexing the words of status %d: %v\n", sid, err)
+	}
+	if err := db.countTrends(c, entities.tags(), posted); err != nil {
+		log.Printf("counting the hashtags of status %d: %v\n", sid, err)
+	}
+	for _, mentioned := range entities.mentioned(uid) {
+		if err := db.notify(c, mentioned, NotifyMention, sid, uid); err != nil {
+			log.Printf("notifying %d of status %d: %v\n", mentioned, sid, err)
+		}
 	}
 	// return the status id of published status
 	return sid, nil
 }
 
-// adds a status to a user's follower's timelines
-func syndicateStatus(uid, sid, time string, c redis.Conn) (bool, error) {
+// publishStatus runs postStatusScript until the next status id and the
+// followers it read stay the same for the script, and returns the id
+func (db *DB) publishStatus(c redis.Conn, uid int, t thread, message, entities string, posted int64) (int, error) {
+	for attempt := 0; attempt < publishAttempts; attempt++ {
+		c.Send("GET", db.key("status:id"))
+		if !db.asyncFanout {
+			// one follower past the threshold tells the status is pulled
+			stop := -1
+			if db.fanoutThreshold > 0 {
+				stop = db.fanoutThreshold
+			}
+			c.Send("ZRANGE", db.idKey("followers:", uid), 0, stop)
+		}
+		r, err := redis.Values(c.Do(""))
+		if err != nil {
+			return -1, err
+		}
+		last, err := redis.Int(r[0], nil)
+		if err != nil && err != redis.ErrNil {
+			return -1, err
+		}
+		var followers []int
+		if len(r) > 1 {
+			if followers, err = redis.Ints(r[1], nil); err != nil {
+				return -1, err
+			}
+			if db.fanoutThreshold > 0 && len(followers) > db.fanoutThreshold {
+				followers = nil
+			}
+		}
+
+		t.sid = last + 1
+		keys := []string{db.idKey("status:", t.sid), db.idKey("user:", uid),
+			db.idKey("timeline:", uid), db.idKey("followers:", uid),
+			db.idKey("posts:", uid), db.key("fanout:pull"),
+			db.key("fanout:jobs"), db.key("status:id")}
+		if t.parent != 0 {
+			keys = append(keys, db.idKey("status:", t.parent),
+				db.idKey("replies:", t.parent), db.idKey("conversation:", t.root))
+		}
+		for _, follower := range followers {
+			keys = append(keys, db.idKey("timeline:", follower))
+		}
+		published, err := redis.Bool(postStatusScript.run(c, keys,
+			redis.Args{}.Add(uid, t.sid, message, posted, db.fanoutThreshold,
+				db.asyncFanout, db.maxTimeline, entities, t.parent, t.root).
+				AddFlat(followers)...))
+		if err != nil {
+			return -1, err
+		}
+		if published {
+			return t.sid, nil
+		}
+	}
+	return -1, ErrContended
+}
+
+/*
+	deletes a status of uid. the status hash is replaced by a tombstone
+	first, so readers skip it while it is being removed from the
+	timelines of the author and the followers. calling it again for a
+	tombstone finishes an interrupted retraction
+*/
+func (db *DB) DeleteStatus(uid, sid int) (bool, error) {
+	c := db.Get()
 	defer c.Close()
-	// get all the followers user ids sorted by score
-	// if this is exceptionally large we may want to do the syndication in stages
-	r, err := redis.Values(c.Do("ZRANGEBYSCORE", "followers:"+uid, "-inf",
-		"+inf"))
 
+	// the tombstone has no message to unindex the words with
+	message, err := redis.String(c.Do("HGET", db.idKey("status:", sid), "message"))
+	if err != nil && err != redis.ErrNil {
+		return false, err
+	}
+	res, err := redis.Int(deleteStatusScript.run(c,
+		[]string{db.idKey("status:", sid), db.idKey("revisions:", sid)},
+		uid, sid, time.Now().Unix(),
+		int64(tombstoneTTL/time.Second)))
 	if err != nil {
 		return false, err
 	}
-
-	var followerSlice []string
-	if err := redis.ScanSlice(r, &followerSlice); err != nil {
-		return false, nil
+	switch res {
+	case -1:
+		return false, ErrNotFound
+	case -2:
+		return false, ErrNotOwner
+	case 1:
+		// only the call that made the tombstone counts the post down
+		c.Send("HINCRBY", db.idKey("user:", uid), "posts", -1)
 	}
-	// push the status in a single transaction
-	c.Do("MULTI")
-	for i := range followerSlice {
-		c.Do("ZADD", "timeline:"+followerSlice[i], time, sid)
+	c.Send("ZREM", db.idKey("posts:", uid), sid)
+	c.Send("ZREM", db.idKey("timeline:", uid), sid)
+	if _, err := c.Do(""); err != nil {
+		return false, err
 	}
-	if _, err := c.Do("EXEC"); err != nil {
+	db.invalidate(c, statusCacheKey(sid), userCacheKey(uid))
+	threads, err := db.threads(c, []int{sid})
+	if err != nil {
+		return false, err
+	}
+	if err := db.unthread(c, threads); err != nil {
+		return false, err
+	}
+	if err := db.unreshareStatus(c, sid, uid); err != nil {
+		return false, err
+	}
+	if err := db.unlikeStatus(c, sid); err != nil {
+		return false, err
+	}
+	if err := db.unindexEntities(c, []int{sid}); err != nil {
+		return false, err
+	}
+	if db.sendUnindexWords(c, sid, message) > 0 {
+		if _, err := c.Do(""); err != nil {
+			return false, err
+		}
+	}
+
+	if err := db.retractStatus(c, uid, sid); err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
+// retractStatus removes a status from the timelines of the author's
+// followers, in batches
+func (db *DB) retractStatus(c redis.Conn, uid, sid int) error {
+	followers := db.idKey("followers:", uid)
+	for start := 0; ; start += syndicateBatch {
+		batch, err := redis.Ints(c.Do("ZRANGE", followers, start,
+			start+syndicateBatch-1))
+		if err != nil {
+			return err
+		}
+		for _, follower := range batch {
+			c.Send("ZREM", db.idKey("timeline:", follower), sid)
+		}
+		if len(batch) > 0 {
+			if _, err := c.Do(""); err != nil {
+				return err
+			}
+		}
+		if len(batch) < syndicateBatch {
+			return nil
+		}
+	}
+}
+
 /*******************************************
 ************ Timeline code ****************/
 
@@ -250,16 +585,28 @@ func (db *DB) GetUserTimeline(uid, page, count int) ([]int, error) {
 	timeline := make([]int, page)
 	c := db.Get()
 	defer c.Close()
+
+	pulled, err := db.pulledFollowees(c, uid)
+	if err != nil {
+		return nil, err
+	}
+	// the page reaches past the newest entries kept in the timeline
+	if db.maxTimeline > 0 && page*count > db.maxTimeline {
+		return db.archivedTimeline(c, uid, pulled, page, count)
+	}
+	if len(pulled) > 0 {
+		return db.mergedTimeline(c, uid, pulled, page, count)
+	}
 	// we use the page and count values to grab unique chunks of the timeline
-	r, err := redis.Values(c.Do("ZREVRANGE", "timeline:"+strconv.Itoa(uid),
-		strconv.Itoa((page-1)*count), strconv.Itoa(page*(count-1))))
+	r, err := redis.Values(c.Do("ZREVRANGE", db.idKey("timeline:", uid),
+		strconv.Itoa((page-1)*count), strconv.Itoa(page*count-1)))
 
 	if err != nil {
 		return nil, err
 	}
 
 	if err := redis.ScanSlice(r, &timeline); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	return timeline, nil
@@ -273,24 +620,33 @@ func (db *DB) Follow(uid, otherid int) (bool, error) {
 	c := db.Get()
 	defer c.Close()
 
-	fkey1 := "following:" + strconv.Itoa(uid)
-	fkey2 := "followers:" + strconv.Itoa(otherid)
+	fkey1 := db.idKey("following:", uid)
+	fkey2 := db.idKey("followers:", otherid)
 
 	// check to see if user A is following user B already
 	r, err := c.Do("ZSCORE", fkey1, strconv.Itoa(otherid))
 	if r != nil {
 		return true, err
 	}
-	// add the user ids to the appropriate sets
-	// increment the appropriate following and follower hashes
-	c.Do("MULTI")
-	c.Do("ZADD", fkey1, time.Now().Unix(), strconv.Itoa(otherid))
-	c.Do("ZADD", fkey2, time.Now().Unix(), strconv.Itoa(uid))
-	c.Do("HINCRBY", "user:"+strconv.Itoa(uid), "following", "1")
-	c.Do("HINCRBY", "user:"+strconv.Itoa(otherid), "followers", 1)
-	if _, err := c.Do("EXEC"); err != nil {
+	// the halves are in the slots of two users, so each is added and
+	// counted by its own script. following:<uid> is written last, a
+	// follow that stopped halfway is finished by calling it again
+	now := time.Now().Unix()
+	if _, err := linkScript.run(c, []string{fkey2, db.idKey("user:", otherid)},
+		uid, now, "followers"); err != nil {
+		return false, err
+	}
+	added, err := redis.Int(linkScript.run(c, []string{fkey1, db.idKey("user:", uid)},
+		otherid, now, "following"))
+	if err != nil {
 		return false, err
 	}
+	db.invalidate(c, userCacheKey(uid), userCacheKey(otherid))
+	if added == 1 {
+		if err := db.notify(c, otherid, NotifyFollow, 0, uid); err != nil {
+			return true, err
+		}
+	}
 
 	return true, nil
 }
@@ -300,8 +656,8 @@ func (db *DB) Unfollow(uid, otherid int) (bool, error) {
 	c := db.Get()
 	defer c.Close()
 
-	fkey1 := "following:" + strconv.Itoa(uid)
-	fkey2 := "followers:" + strconv.Itoa(otherid)
+	fkey1 := db.idKey("following:", uid)
+	fkey2 := db.idKey("followers:", otherid)
 
 	// checking following status
 	r, err := c.Do("ZSCORE", fkey1, strconv.Itoa(otherid))
@@ -309,13 +665,16 @@ func (db *DB) Unfollow(uid, otherid int) (bool, error) {
 		return true, err
 	}
 
-	c.Do("MULTI")
-	c.Do("ZREM", fkey1, strconv.Itoa(otherid))
-	c.Do("ZREM", fkey2, strconv.Itoa(uid))
-	c.Do("HINCRBY", "user:"+strconv.Itoa(uid), "following", "-1")
-	c.Do("HINCRBY", "user:"+strconv.Itoa(otherid), "followers", "-1")
-	if _, err := c.Do("EXEC"); err != nil {
+	// like Follow, following:<uid> goes last so calling it again
+	// finishes an unfollow that stopped halfway
+	if _, err := unlinkScript.run(c, []string{fkey2, db.idKey("user:", otherid)},
+		uid, "followers"); err != nil {
+		return false, err
+	}
+	if _, err := unlinkScript.run(c, []string{fkey1, db.idKey("user:", uid)},
+		otherid, "following"); err != nil {
 		return false, err
 	}
+	db.invalidate(c, userCacheKey(uid), userCacheKey(otherid))
 	return true, nil
 }
@@ -2,19 +2,31 @@ package myredisDB
 
 import (
 	"github.com/garyburd/redigo/redis"
-	"strconv"
 	"testing"
+	"time"
 )
 
+// every test gets its own namespace so it never touches application data
+func newTestDB(t *testing.T, ns string) *DB {
+	db := NewDB("localhost:6379", Namespace("test:"+ns))
+	if db == nil {
+		t.Fatal("db is nil")
+	}
+	// clear anything left behind by an interrupted run
+	if _, err := db.DropNamespace(); err != nil {
+		t.Fatal("unable to clear test namespace: ", err)
+	}
+	return db
+}
+
 /*
  * Tests creating and deleting a user
  */
 func TestUser(t *testing.T) {
-	db := NewDB("localhost:6379")
+	db := newTestDB(t, "user")
+	defer db.DropNamespace()
 	c := db.Get()
 	defer c.Close()
-	// save the original global user count
-	oldGlobalID, err := redis.String(c.Do("GET", "user:id"))
 	// create a test user using the API
 	uid, err := db.CreateUser("TestUser", "testy")
 
@@ -27,14 +39,14 @@ func TestUser(t *testing.T) {
 	}
 
 	// check to see if newly created username is registered
-	exists, err := redis.Int(c.Do("HEXISTS", "users:", "TestUser"))
+	exists, err := redis.Int(c.Do("HEXISTS", db.key("users:"), "TestUser"))
 	// redis returns 1 if the hash exists
 	if err != nil || exists != 1 {
 		t.Error("TestUser is not successfully created.\n")
 	}
 
 	// check if the user hash structure is created
-	res, err := redis.Values(c.Do("HGETALL", "user:"+strconv.Itoa(uid)))
+	res, err := redis.Values(c.Do("HGETALL", db.idKey("user:", uid)))
 	// scan the values into a struct so we can inspect
 	var createdUser User
 	err = redis.ScanStruct(res, &createdUser)
@@ -72,39 +84,33 @@ func TestUser(t *testing.T) {
 		t.Error("expected true when delete user got: ", r)
 	}
 	// check that username is no longer registered
-	exists, err = redis.Int(c.Do("HEXISTS", "users:", "TestUser"))
+	exists, err = redis.Int(c.Do("HEXISTS", db.key("users:"), "TestUser"))
 
 	if err != nil || exists != 0 {
 		t.Error("TestUser was not successfully deleted.\n")
 	}
 	// check if the hash structure is deleted
-	getAll, err := redis.Values(c.Do("HGETALL", "user:"+strconv.Itoa(uid)))
+	getAll, err := redis.Values(c.Do("HGETALL", db.idKey("user:", uid)))
 
 	if len(getAll) != 0 {
 		t.Errorf("Error deleting user\tgetAll == %v\n", getAll)
 	}
-	// reset the global user count
-	c.Do("SET", "user:id", oldGlobalID)
-
 }
 
 // tests follow and unfollow methods
 func TestFollow(t *testing.T) {
-	db := NewDB("localhost:6379")
-	if db == nil {
-		t.Error("db is nil")
-	}
+	db := newTestDB(t, "follow")
+	defer db.DropNamespace()
 	c := db.Get()
 	defer c.Close()
-	// use two uids that are invalid, so as to not mess with application data
 	if res, err := db.Follow(-1, -2); res == false || err != nil {
 		t.Error("error user -1 following user -2")
 	}
 	// double check it actually worked
-	if res, err := redis.String(c.Do("ZSCORE", "followers:-2", "-1")); res == "" || err != nil {
+	if res, err := redis.String(c.Do("ZSCORE", db.idKey("followers:", -2), "-1")); res == "" || err != nil {
 		t.Error("followers not updated properly")
 	}
-	if res, err := redis.String(c.Do("ZSCORE", "following:-1", "-2")); res == "" || err != nil {
+	if res, err := redis.String(c.Do("ZSCORE", db.idKey("following:", -1), "-2")); res == "" || err != nil {
 		t.Error("following not updated properly")
 	}
 
@@ -114,30 +120,45 @@ func TestFollow(t *testing.T) {
 	}
 
 	// check to see if worked
-	if res, err := c.Do("ZSCORE", "followers:-2", "-1"); err != nil || res != nil {
+	if res, err := c.Do("ZSCORE", db.idKey("followers:", -2), "-1"); err != nil || res != nil {
 		t.Error("error checking to see if unfollowed")
 	}
 
-	if res, err := c.Do("ZSCORE", "following:-1", "-2"); err != nil || res != nil {
+	if res, err := c.Do("ZSCORE", db.idKey("following:", -1), "-2"); err != nil || res != nil {
 		t.Error("error checking to see if unfollowing")
 	}
 
-	c.Do("DEL", "following:-1")
-	c.Do("DEL", "followers:-2")
+	// a follow that stopped after the followers half is finished by
+	// following again, without counting the edge twice
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	linkScript.run(c, []string{db.idKey("followers:", b), db.idKey("user:", b)},
+		a, time.Now().Unix(), "followers")
+	if res, err := db.Follow(a, b); !res || err != nil {
+		t.Fatal("error finishing follow ", err)
+	}
+	ua, _ := db.GetUser(a)
+	ub, _ := db.GetUser(b)
+	if ua.Following != 1 || ub.Followers != 1 {
+		t.Errorf("after finishing follow a == %+v, b == %+v\n", ua, ub)
+	}
+	// and the same for an unfollow
+	unlinkScript.run(c, []string{db.idKey("followers:", b), db.idKey("user:", b)},
+		a, "followers")
+	db.Unfollow(a, b)
+	ua, _ = db.GetUser(a)
+	ub, _ = db.GetUser(b)
+	if ua.Following != 0 || ub.Followers != 0 {
+		t.Errorf("after finishing unfollow a == %+v, b == %+v\n", ua, ub)
+	}
 }
 
 // tests to see if posts appear on the users's timeline and follower's timeline
 func TestPost(t *testing.T) {
-	db := NewDB("localhost:6379")
-	if db == nil {
-		t.Error("db is nil")
-	}
+	db := newTestDB(t, "post")
+	defer db.DropNamespace()
 	c := db.Get()
 	defer c.Close()
-	// get the oldsid so we can reset value in database
-	// we don't want test code to interfere with the application data
-	oldSID, _ := redis.String(c.Do("GET", "status:id"))
-
 	// user -1 follows user -2. User -2 makes a post.
 
 	if res, err := db.Follow(-1, -2); res == false || err != nil {
@@ -149,11 +170,11 @@ func TestPost(t *testing.T) {
 		t.Error("error user: -2 posting status ", err)
 	}
 	// check to see if post showed up on both timelines
-	if res, err := redis.String(c.Do("ZSCORE", "timeline:-2", sid)); err != nil || res == "" {
+	if res, err := redis.String(c.Do("ZSCORE", db.idKey("timeline:", -2), sid)); err != nil || res == "" {
 		t.Error("error checking user: -2 timeline ", err)
 	}
 
-	if res, err := redis.String(c.Do("ZSCORE", "timeline:-1", sid)); err != nil || res == "" {
+	if res, err := redis.String(c.Do("ZSCORE", db.idKey("timeline:", -1), sid)); err != nil || res == "" {
 		t.Error("error checking user: -1 timeline ", err)
 	}
 	// unfollow the users
@@ -161,9 +182,336 @@ func TestPost(t *testing.T) {
 		t.Error("unable to unfollow ", err)
 	}
 
-	// remove the timelines
-	c.Do("DEL", "timeline:-1")
-	c.Do("DEL", "timeline:-2")
+	// a malformed entry is an error, not a crash
+	c.Do("ZADD", db.idKey("timeline:", -2), 1, "not a status")
+	if _, err := db.GetUserTimeline(-2, 1, 30); err == nil {
+		t.Error("read a malformed timeline entry")
+	}
+}
+
+// tests that statuses are fetched in the order asked for and missing
+// ones are reported
+func TestGetStatuses(t *testing.T) {
+	db := newTestDB(t, "statuses")
+	defer db.DropNamespace()
+
+	var ids []int
+	for _, msg := range []string{"one", "two", "three"} {
+		sid, err := db.PostStatus(-1, msg)
+		if err != nil {
+			t.Fatal("error posting status ", err)
+		}
+		ids = append(ids, sid)
+	}
+
+	// newest first, with an id that was never posted in the middle
+	req := []int{ids[2], -5, ids[1], ids[0]}
+	statuses, missing, err := db.GetStatuses(req)
+	if err != nil {
+		t.Fatal("error getting statuses ", err)
+	}
+	if len(missing) != 1 || missing[0] != -5 {
+		t.Errorf("missing == %v\n", missing)
+	}
+	want := []string{"three", "two", "one"}
+	if len(statuses) != len(want) {
+		t.Fatalf("statuses == %+v\n", statuses)
+	}
+	for j, status := range statuses {
+		if status.Message != want[j] || status.Uid != -1 {
+			t.Errorf("statuses[%d] == %+v\n", j, status)
+		}
+	}
+
+	if statuses, missing, err := db.GetStatuses(nil); err != nil ||
+		len(statuses) != 0 || len(missing) != 0 {
+		t.Errorf("empty fetch == %v, %v, %v\n", statuses, missing, err)
+	}
+}
+
+// tests that dropping a namespace leaves other namespaces alone
+func TestDropNamespace(t *testing.T) {
+	db := newTestDB(t, "drop")
+	other := newTestDB(t, "dropother")
+	defer other.DropNamespace()
+
+	if _, err := db.CreateUser("TestUser", "testy"); err != nil {
+		t.Error("error creating user ", err)
+	}
+	uid, err := other.CreateUser("TestUser", "testy")
+	if err != nil || uid == -1 {
+		t.Error("namespaces are not isolated, uid: ", uid, err)
+	}
+
+	if n, err := db.DropNamespace(); err != nil || n == 0 {
+		t.Errorf("DropNamespace removed %v keys, err: %v\n", n, err)
+	}
+
+	c := db.Get()
+	defer c.Close()
+	if n, _ := redis.Int(c.Do("EXISTS", db.key("users:"))); n != 0 {
+		t.Error("users: still exists after DropNamespace")
+	}
+	if n, _ := redis.Int(c.Do("EXISTS", other.key("users:"))); n != 1 {
+		t.Error("DropNamespace removed keys from another namespace")
+	}
+
+	if _, err := NewDB("localhost:6379").DropNamespace(); err == nil {
+		t.Error("dropping the default namespace must fail")
+	}
+}
+
+// tests that a post is published as a whole and survives a script flush
+func TestPostScript(t *testing.T) {
+	db := newTestDB(t, "script")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	uid, _ := db.CreateUser("TestUser", "testy")
+	db.Follow(-1, uid)
+
+	// forget the cached script, PostStatus has to load it again
+	if _, err := c.Do("SCRIPT", "FLUSH"); err != nil {
+		t.Error("error flushing scripts ", err)
+	}
+	sid, err := db.PostStatus(uid, "this is a post")
+	if sid == -1 || err != nil {
+		t.Fatal("error posting status ", err)
+	}
+
+	status, err := db.GetStatus(sid)
+	if err != nil || status.Id != sid || status.Uid != uid ||
+		status.Login != "TestUser" || status.Message != "this is a post" {
+		t.Errorf("unexpected status %+v err: %v\n", status, err)
+	}
+	if user, _ := db.GetUser(uid); user.Posts != 1 {
+		t.Errorf("user.Posts == %v\n", user.Posts)
+	}
+	for _, id := range []int{uid, -1} {
+		score, err := redis.Int64(c.Do("ZSCORE", db.idKey("timeline:", id), sid))
+		if err != nil || score != status.Posted {
+			t.Errorf("timeline:%v score == %v err: %v\n", id, score, err)
+		}
+	}
+	if db.cluster != nil {
+		return
+	}
+
+	// a stale status id or follower list writes nothing
+	keys := []string{db.idKey("status:", sid+1), db.idKey("user:", uid),
+		db.idKey("timeline:", uid), db.idKey("followers:", uid),
+		db.idKey("posts:", uid), db.key("fanout:pull"),
+		db.key("fanout:jobs"), db.key("status:id")}
+	posted := time.Now().Unix()
+	ok, err := redis.Bool(postStatusScript.run(c,
+		append(keys, db.idKey("timeline:", -1)),
+		uid, sid, "old id", posted, 0, 0, 0, "", 0, 0, -1))
+	if ok || err != nil {
+		t.Errorf("published with an old id: %v err: %v\n", ok, err)
+	}
+	ok, err = redis.Bool(postStatusScript.run(c, keys,
+		uid, sid+1, "no followers", posted, 0, 0, 0, "", 0, 0))
+	if ok || err != nil {
+		t.Errorf("published without the followers: %v err: %v\n", ok, err)
+	}
+	if user, _ := db.GetUser(uid); user.Posts != 1 {
+		t.Errorf("user.Posts after stale posts == %v\n", user.Posts)
+	}
+	if last, _ := redis.Int(c.Do("GET", db.key("status:id"))); last != sid {
+		t.Errorf("status:id after stale posts == %v\n", last)
+	}
+}
+
+// tests that statuses of authors above the threshold are merged on read
+func TestHybridFanout(t *testing.T) {
+	db := newTestDB(t, "hybrid")
+	defer db.DropNamespace()
+	FanoutThreshold(1)(db)
+	c := db.Get()
+	defer c.Close()
+
+	// -3 has two followers and is pulled, -4 has one and is pushed
+	db.Follow(-1, -3)
+	db.Follow(-2, -3)
+	db.Follow(-1, -4)
+
+	posted := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		pulled, _ := db.PostStatus(-3, "pulled")
+		pushed, _ := db.PostStatus(-4, "pushed")
+		posted[pulled], posted[pushed] = true, true
+
+		if r, _ := c.Do("ZSCORE", db.idKey("timeline:", -1), pulled); r != nil {
+			t.Errorf("status %v of a pulled author was pushed\n", pulled)
+		}
+	}
+
+	var timeline []int
+	for page := 1; page <= 4; page++ {
+		res, err := db.GetUserTimeline(-1, page, 2)
+		if err != nil {
+			t.Fatal("error getting timeline ", err)
+		}
+		timeline = append(timeline, res...)
+	}
+	if len(timeline) != len(posted) {
+		t.Fatalf("merged timeline == %v\n", timeline)
+	}
+
+	var last int64
+	for i, sid := range timeline {
+		status, _ := db.GetStatus(sid)
+		if !posted[sid] || (i > 0 && status.Posted > last) {
+			t.Errorf("merged timeline out of order %v\n", timeline)
+		}
+		delete(posted, sid)
+		last = status.Posted
+	}
+}
+
+// tests that queued fan-out jobs are pushed by the workers
+func TestAsyncFanout(t *testing.T) {
+	db := newTestDB(t, "async")
+	defer db.DropNamespace()
+	AsyncFanout()(db)
+	c := db.Get()
+	defer c.Close()
+
+	db.Follow(-1, -2)
+	first, _ := db.PostStatus(-2, "first post")
+	second, _ := db.PostStatus(-2, "second post")
+
+	if r, _ := c.Do("ZSCORE", db.idKey("timeline:", -1), first); r != nil {
+		t.Error("status was pushed before the workers ran")
+	}
+	if r, _ := c.Do("ZSCORE", db.idKey("timeline:", -2), first); r == nil {
+		t.Error("status is missing from the author's timeline")
+	}
+	if lag, err := db.FanoutLag(); err != nil || lag.Backlog != 2 || lag.Pending != 0 {
+		t.Errorf("lag == %+v err: %v\n", lag, err)
+	}
+
+	// a worker that died after reading the first job never acknowledges it
+	if _, err := c.Do("XREADGROUP", "GROUP", fanoutGroup, "dead", "COUNT", 1,
+		"STREAMS", db.key("fanout:jobs"), ">"); err != nil {
+		t.Fatal("error reading job ", err)
+	}
+	if lag, _ := db.FanoutLag(); lag.Pending != 1 {
+		t.Errorf("lag == %+v\n", lag)
+	}
+
+	f, err := db.StartFanout(2, 0)
+	if err != nil {
+		t.Fatal("error starting workers ", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if lag, _ := db.FanoutLag(); lag.Backlog == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.Stop()
 
-	c.Do("SET", "status:id", oldSID)
+	for _, sid := range []int{first, second} {
+		if r, _ := c.Do("ZSCORE", db.idKey("timeline:", -1), sid); r == nil {
+			t.Errorf("status %v was not pushed by the workers\n", sid)
+		}
+	}
+	if lag, err := db.FanoutLag(); err != nil || lag.Backlog != 0 || lag.Pending != 0 {
+		t.Errorf("lag == %+v err: %v\n", lag, err)
+	}
+}
+
+// tests that entries XAUTOCLAIM returns without fields, deleted while
+// pending, are told apart so they can be acknowledged
+func TestScanFanoutJobs(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{[]byte("1-0"), []interface{}{[]byte("uid"), []byte("2"),
+			[]byte("sid"), []byte("7"), []byte("posted"), []byte("100")}},
+		[]interface{}{[]byte("2-0"), nil},
+	}
+	jobs, gone, err := scanFanoutJobs(reply)
+	if err != nil || len(jobs) != 1 || jobs[0].sid != 7 {
+		t.Errorf("jobs == %+v, %v\n", jobs, err)
+	}
+	if len(gone) != 1 || gone[0] != "2-0" {
+		t.Errorf("gone == %v\n", gone)
+	}
+}
+
+// tests that pages past the timeline cap are rebuilt from the archive
+func TestMaxTimeline(t *testing.T) {
+	db := newTestDB(t, "capped")
+	defer db.DropNamespace()
+	MaxTimeline(3)(db)
+	c := db.Get()
+	defer c.Close()
+
+	db.Follow(-1, -2)
+	db.Follow(-1, -3)
+	var sids []int
+	for i := 0; i < 4; i++ {
+		sid, _ := db.PostStatus(-2, "post")
+		other, _ := db.PostStatus(-3, "post")
+		sids = append(sids, sid, other)
+	}
+
+	if n, _ := redis.Int(c.Do("ZCARD", db.idKey("timeline:", -1))); n != 3 {
+		t.Errorf("timeline holds %v entries, not 3\n", n)
+	}
+
+	var timeline []int
+	for page := 1; page <= 5; page++ {
+		res, err := db.GetUserTimeline(-1, page, 2)
+		if err != nil {
+			t.Fatal("error getting timeline ", err)
+		}
+		timeline = append(timeline, res...)
+	}
+	if len(timeline) != len(sids) {
+		t.Fatalf("timeline == %v, posted %v\n", timeline, sids)
+	}
+	// every page is in the order a single uncapped zset would have
+	for i := 1; i < len(timeline); i++ {
+		a, _ := db.GetStatus(timeline[i-1])
+		b, _ := db.GetStatus(timeline[i])
+		prev := timelineEntry{a.Id, a.Posted}
+		if !prev.before(timelineEntry{b.Id, b.Posted}) {
+			t.Errorf("timeline out of order %v\n", timeline)
+		}
+	}
+}
+
+// tests that the connection settings are honored
+func TestOptions(t *testing.T) {
+	// nothing listens on port 1
+	c := NewDB("localhost:1").Get()
+	if _, err := c.Do("PING"); err == nil {
+		t.Error("NewDB did not use the server argument")
+	}
+	c.Close()
+
+	o := DefaultOptions()
+	o.Database = 1
+	db, err := NewDBWithOptions(o, Namespace("test:options"))
+	if err != nil {
+		t.Fatal("error opening database 1 ", err)
+	}
+	defer db.DropNamespace()
+	if uid, err := db.CreateUser("TestUser", "testy"); uid == -1 || err != nil {
+		t.Error("error creating user ", err)
+	}
+	// the user only exists in database 1
+	other := newTestDB(t, "options")
+	if user, _ := other.GetUser(1); user.Login != "" {
+		t.Errorf("user found in database 0 %+v\n", user)
+	}
+
+	o = DefaultOptions()
+	o.TLS, o.TLSCAFile = true, "testdata/missing.pem"
+	if _, err := NewDBWithOptions(o); err == nil {
+		t.Error("missing CA file was accepted")
+	}
 }
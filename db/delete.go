@@ -0,0 +1,211 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"log"
+)
+
+/*
+ * account deletion
+ *
+ * DeleteUser first frees the login, takes the user out of the user search
+ * and adds the user to users:deleting,
+ * then works through the data in steps that can all be run again:
+ *
+ *   1. every status in posts:N is removed from its thread, the mentions
+ *      and tags, its reshares and likes are taken back and it is removed
+ *      from the timelines of the followers and the search index, its hash
+ *      is deleted, then it leaves posts:N
+ *   2. every reshare in reshares:N and like in likes:N is taken back
+ *   3. every follower and followee loses its half of the edge and has
+ *      its counter decremented, then leaves followers:N / following:N
+ *   4. the remaining per user keys are deleted, the notification keys
+ *      notifications:N, notices:N, notifiers:N and notified:N among
+ *      them, and the user leaves users:deleting
+ *
+ * each step takes the first members of a zset and removes them when they
+ * are done, so an interrupted deletion continues where it stopped when
+ * DeleteUser or ResumeDeletes is called again.
+ */
+
+// DeleteUser deletes the user with its statuses and follow edges
+func (db *DB) DeleteUser(uid int) (bool, error) {
+	c := db.Get()
+	defer c.Close()
+
+	deleting, err := redis.Bool(c.Do("SISMEMBER", db.key("users:deleting"), uid))
+	if err != nil {
+		return false, err
+	}
+	if !deleting {
+		// get the users login value so we can remove it from global store
+		r, err := redis.Values(c.Do("HMGET", db.idKey("user:", uid), "login", "name"))
+		if err != nil {
+			return false, err
+		}
+		if r[0] == nil {
+			return false, redis.ErrNil
+		}
+		var login, name string
+		if _, err := redis.Scan(r, &login, &name); err != nil {
+			return false, err
+		}
+		c.Send("SADD", db.key("users:deleting"), uid)
+		// the login can be taken again right away
+		c.Send("HDEL", db.key("users:"), login)
+		// and the user is no longer found by a search
+		db.sendUnindexUser(c, uid, login, name)
+		if _, err := c.Do(""); err != nil {
+			return false, err
+		}
+	}
+
+	if err := db.deleteStatuses(c, uid); err != nil {
+		return false, err
+	}
+	// the followers are needed to take the reshares back
+	if err := db.unreshareUser(c, uid); err != nil {
+		return false, err
+	}
+	if err := db.unlikeUser(c, uid); err != nil {
+		return false, err
+	}
+	if err := db.unlinkUser(c, uid); err != nil {
+		return false, err
+	}
+
+	c.Send("DEL", db.idKey("timeline:", uid))
+	c.Send("DEL", db.idKey("posts:", uid))
+	c.Send("DEL", db.idKey("followers:", uid))
+	c.Send("DEL", db.idKey("following:", uid))
+	c.Send("DEL", db.idKey("reshares:", uid))
+	c.Send("DEL", db.idKey("via:", uid))
+	c.Send("DEL", db.idKey("likes:", uid))
+	c.Send("DEL", db.idKey("mentions:", uid))
+	c.Send("DEL", db.idKey("notifications:", uid))
+	c.Send("DEL", db.idKey("notices:", uid))
+	c.Send("DEL", db.idKey("notified:", uid))
+	c.Send("DEL", db.idKey("notifiers:", uid))
+	c.Send("DEL", db.idKey("user:", uid))
+	c.Send("SREM", db.key("fanout:pull"), uid)
+	c.Send("SREM", db.key("users:deleting"), uid)
+	if _, err := c.Do(""); err != nil {
+		return false, err
+	}
+	db.invalidate(c, userCacheKey(uid))
+	return true, nil
+}
+
+// ResumeDeletes finishes the deletions that were interrupted
+func (db *DB) ResumeDeletes() (int, error) {
+	c := db.Get()
+	uids, err := redis.Ints(c.Do("SMEMBERS", db.key("users:deleting")))
+	c.Close()
+	if err != nil {
+		return 0, err
+	}
+	for n, uid := range uids {
+		log.Printf("resuming the deletion of user %d\n", uid)
+		if _, err := db.DeleteUser(uid); err != nil {
+			return n, err
+		}
+	}
+	return len(uids), nil
+}
+
+// deleteStatuses removes the user's statuses, from the timelines of the
+// followers first
+func (db *DB) deleteStatuses(c redis.Conn, uid int) error {
+	posts := db.idKey("posts:", uid)
+	for {
+		sids, err := redis.Ints(c.Do("ZRANGE", posts, 0, syndicateBatch-1))
+		if err != nil {
+			return err
+		}
+		if len(sids) == 0 {
+			return nil
+		}
+
+		// replies leave their threads while the statuses still say where
+		threads, err := db.threads(c, sids)
+		if err != nil {
+			return err
+		}
+		if err := db.unthread(c, threads); err != nil {
+			return err
+		}
+		if err := db.unindexEntities(c, sids); err != nil {
+			return err
+		}
+		for _, sid := range sids {
+			c.Send("HGET", db.idKey("status:", sid), "message")
+		}
+		messages, err := redis.Values(c.Do(""))
+		if err != nil {
+			return err
+		}
+		for _, sid := range sids {
+			if err := db.unreshareStatus(c, sid, uid); err != nil {
+				return err
+			}
+			if err := db.unlikeStatus(c, sid); err != nil {
+				return err
+			}
+		}
+		members := redis.Args{}.AddFlat(sids)
+		err = zsetMembers(c, db.idKey("followers:", uid), func(follower int, score int64) error {
+			return c.Send("ZREM", redis.Args{}.Add(db.idKey("timeline:", follower)).Add(members...)...)
+		})
+		if err != nil {
+			return err
+		}
+		var cached []string
+		for j, sid := range sids {
+			// nil for a tombstone
+			message, _ := redis.String(messages[j], nil)
+			db.sendUnindexWords(c, sid, message)
+			c.Send("DEL", db.idKey("status:", sid), db.idKey("revisions:", sid))
+			cached = append(cached, statusCacheKey(sid))
+		}
+		c.Send("ZREM", redis.Args{}.Add(posts).Add(members...)...)
+		if _, err := c.Do(""); err != nil {
+			return err
+		}
+		db.invalidate(c, cached...)
+	}
+}
+
+// unlinkUser removes both halves of every follow edge of the user
+func (db *DB) unlinkUser(c redis.Conn, uid int) error {
+	// followers lose a followee, followees lose a follower
+	sides := []struct{ own, other, counter string }{
+		{"followers:", "following:", "following"},
+		{"following:", "followers:", "followers"},
+	}
+	for _, side := range sides {
+		own := db.idKey(side.own, uid)
+		for {
+			others, err := redis.Ints(c.Do("ZRANGE", own, 0, syndicateBatch-1))
+			if err != nil {
+				return err
+			}
+			if len(others) == 0 {
+				break
+			}
+
+			var cached []string
+			for _, other := range others {
+				keys := []string{db.idKey(side.other, other), db.idKey("user:", other)}
+				if _, err := unlinkScript.run(c, keys, uid, side.counter); err != nil {
+					return err
+				}
+				cached = append(cached, userCacheKey(other))
+			}
+			if _, err := c.Do("ZREM", redis.Args{}.Add(own).AddFlat(others)...); err != nil {
+				return err
+			}
+			db.invalidate(c, cached...)
+		}
+	}
+	return nil
+}
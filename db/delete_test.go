@@ -0,0 +1,135 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+// tests that deleting a user removes its statuses and both halves of its
+// follow edges, and that an interrupted deletion is finished
+func TestDeleteUserCascade(t *testing.T) {
+	db := newTestDB(t, "delete")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+	db.Migrate(MigrateOptions{})
+
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	d, _ := db.CreateUser("d", "D")
+	db.Follow(a, b)
+	db.Follow(b, a)
+	db.Follow(d, b)
+	gone, _ := db.PostStatus(b, "gone with b")
+	kept, _ := db.PostStatus(a, "kept")
+
+	if res, err := db.DeleteUser(b); !res || err != nil {
+		t.Fatal("error deleting b ", err)
+	}
+
+	for _, name := range []string{"user:", "timeline:", "posts:",
+		"followers:", "following:"} {
+		if n, _ := redis.Int(c.Do("EXISTS", db.idKey(name, b))); n != 0 {
+			t.Errorf("%s%d was left behind\n", name, b)
+		}
+	}
+	if n, _ := redis.Int(c.Do("EXISTS", db.idKey("status:", gone))); n != 0 {
+		t.Error("status of b was left behind")
+	}
+	for _, uid := range []int{a, d} {
+		tl, _ := db.GetUserTimeline(uid, 1, 30)
+		for _, sid := range tl {
+			if sid == gone {
+				t.Errorf("timeline:%d still has status %d\n", uid, gone)
+			}
+		}
+	}
+	if tl, _ := db.GetUserTimeline(a, 1, 30); len(tl) != 1 || tl[0] != kept {
+		t.Errorf("timeline:%d == %v\n", a, tl)
+	}
+	if user, _ := db.GetUser(a); user.Followers != 0 || user.Following != 0 {
+		t.Errorf("a == %+v\n", user)
+	}
+	if user, _ := db.GetUser(d); user.Following != 0 {
+		t.Errorf("d == %+v\n", user)
+	}
+	if _, err := db.DeleteUser(b); err != ErrNotFound {
+		t.Errorf("second delete err == %v\n", err)
+	}
+	if s, err := db.Fsck(FsckOptions{}); err != nil || s.Total() != 0 {
+		t.Errorf("fsck after delete == %+v\n", s)
+	}
+
+	// a deletion that stopped after unlinking one follower
+	db.Follow(a, d)
+	c.Do("SADD", db.key("users:deleting"), d)
+	c.Do("HDEL", db.key("users:"), "d")
+	unlinkScript.run(c, []string{db.idKey("following:", a),
+		db.idKey("user:", a)}, d, "following")
+	if n, err := db.ResumeDeletes(); n != 1 || err != nil {
+		t.Fatalf("resumed %d, %v\n", n, err)
+	}
+	if user, _ := db.GetUser(a); user.Following != 0 {
+		t.Errorf("following counted twice, a == %+v\n", user)
+	}
+	if n, _ := redis.Int(c.Do("EXISTS", db.idKey("user:", d))); n != 0 {
+		t.Error("resumed deletion left user d")
+	}
+}
+
+// tests that a deleted status leaves every timeline and is skipped while
+// it is a tombstone
+func TestDeleteStatus(t *testing.T) {
+	db := newTestDB(t, "delstatus")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	db.Follow(b, a)
+	kept, _ := db.PostStatus(a, "kept")
+	sid, _ := db.PostStatus(a, "deleted")
+
+	if _, err := db.DeleteStatus(b, sid); err != ErrNotOwner {
+		t.Errorf("delete by b err == %v\n", err)
+	}
+	if _, err := db.DeleteStatus(a, -5); err != ErrNotFound {
+		t.Errorf("delete of a missing status err == %v\n", err)
+	}
+	if res, err := db.DeleteStatus(a, sid); !res || err != nil {
+		t.Fatal("error deleting status ", err)
+	}
+
+	for _, uid := range []int{a, b} {
+		if tl, _ := db.GetUserTimeline(uid, 1, 30); len(tl) != 1 || tl[0] != kept {
+			t.Errorf("timeline:%d == %v\n", uid, tl)
+		}
+	}
+	if user, _ := db.GetUser(a); user.Posts != 1 {
+		t.Errorf("posts == %d\n", user.Posts)
+	}
+	// the tombstone expires and is skipped by readers
+	if ttl, _ := redis.Int(c.Do("TTL", db.idKey("status:", sid))); ttl <= 0 {
+		t.Errorf("tombstone ttl == %d\n", ttl)
+	}
+	if status, _ := db.GetStatus(sid); status.Id != 0 {
+		t.Errorf("status == %+v\n", status)
+	}
+	statuses, missing, _ := db.GetStatuses([]int{sid, kept})
+	if len(statuses) != 1 || len(missing) != 1 || missing[0] != sid {
+		t.Errorf("statuses == %+v, missing == %v\n", statuses, missing)
+	}
+
+	// deleting again finishes the retraction but counts nothing
+	c.Do("ZADD", db.idKey("timeline:", b), 1, sid)
+	if res, err := db.DeleteStatus(a, sid); !res || err != nil {
+		t.Error("error deleting again ", err)
+	}
+	if n, _ := redis.Int(c.Do("ZCARD", db.idKey("timeline:", b))); n != 1 {
+		t.Errorf("timeline:%d has %d entries\n", b, n)
+	}
+	if user, _ := db.GetUser(a); user.Posts != 1 {
+		t.Errorf("posts after second delete == %d\n", user.Posts)
+	}
+}
@@ -0,0 +1,141 @@
+package myredisDB
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * status edits
+ *
+ * an edit replaces the message of a status but keeps its posted time, so
+ * the status stays where it is in every timeline. the message it replaces
+ * is pushed onto revisions:<sid> as "<unix time>:<message>", the time
+ * being when that message was written. the list lives in the slot of the
+ * status and is deleted with it.
+ */
+
+// ErrEditWindow is returned by EditStatus once the edit window has passed
+var ErrEditWindow = errors.New("myredisDB: the status can no longer be edited")
+
+// EditWindow lets a status be edited for d after it was posted. 0, the
+// default, never closes the window.
+func EditWindow(d time.Duration) Option {
+	return func(db *DB) {
+		db.editWindow = d
+	}
+}
+
+// Revision is one message a status had
+type Revision struct {
+	Message string `json:"msg"`
+	// when the message was posted or written by an edit
+	At int64 `json:"at"`
+}
+
+// EditStatus replaces the message of a status written by uid
+func (db *DB) EditStatus(uid, sid int, message string) (bool, error) {
+	c := db.Get()
+	defer c.Close()
+
+	entities, err := db.entities(c, message)
+	if err != nil {
+		return false, err
+	}
+	// the mentions, tags and words of the old message are replaced after
+	// the edit
+	var posted int64
+	var old, oldMessage string
+	r, err := redis.Values(c.Do("HMGET", db.idKey("status:", sid), "posted",
+		"entities", "message"))
+	if err != nil {
+		return false, err
+	}
+	if _, err := redis.Scan(r, &posted, &old, &oldMessage); err != nil {
+		return false, err
+	}
+
+	res, err := redis.Int(editStatusScript.run(c,
+		[]string{db.idKey("status:", sid), db.idKey("revisions:", sid)},
+		uid, message, time.Now().Unix(),
+		int64(db.editWindow/time.Second), entities.encode()))
+	if err != nil {
+		return false, err
+	}
+	switch res {
+	case -1:
+		return false, ErrNotFound
+	case -2:
+		return false, ErrNotOwner
+	case -3:
+		return false, ErrEditWindow
+	}
+	db.invalidate(c, statusCacheKey(sid))
+
+	db.sendUnindex(c, uid, sid, decodeEntities(old))
+	db.sendUnindexWords(c, sid, oldMessage)
+	if err := db.indexEntities(c, uid, sid, posted, entities); err != nil {
+		return false, err
+	}
+	if err := db.indexWords(c, sid, posted, message); err != nil {
+		return false, err
+	}
+	// flushes the ZREMs when there is nothing to index
+	if _, err := c.Do(""); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// StatusHistory returns every message of a status, oldest first, ending
+// with the current one
+func (db *DB) StatusHistory(sid int) ([]Revision, error) {
+	c := db.Get()
+	defer c.Close()
+
+	c.Send("HMGET", db.idKey("status:", sid), "message", "posted", "edited",
+		"deleted")
+	c.Send("LRANGE", db.idKey("revisions:", sid), 0, -1)
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	var message string
+	var posted, edited, deleted int64
+	status, _ := redis.Values(r[0], nil)
+	if _, err := redis.Scan(status, &message, &posted, &edited, &deleted); err != nil {
+		return nil, err
+	}
+	if posted == 0 || deleted != 0 {
+		return nil, ErrNotFound
+	}
+	old, err := redis.Strings(r[1], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]Revision, 0, len(old)+1)
+	for _, entry := range old {
+		history = append(history, parseRevision(entry))
+	}
+	if edited == 0 {
+		edited = posted
+	}
+	return append(history, Revision{Message: message, At: edited}), nil
+}
+
+// parseRevision reads an entry of revisions:<sid>
+func parseRevision(entry string) Revision {
+	var rev Revision
+	at := strings.IndexByte(entry, ':')
+	if at < 0 {
+		rev.Message = entry
+		return rev
+	}
+	rev.At, _ = strconv.ParseInt(entry[:at], 10, 64)
+	rev.Message = entry[at+1:]
+	return rev
+}
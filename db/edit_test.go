@@ -0,0 +1,94 @@
+package myredisDB
+
+import (
+	"bytes"
+	"github.com/garyburd/redigo/redis"
+	"testing"
+	"time"
+)
+
+// tests that an edit keeps the timeline order and records the old message
+func TestEditStatus(t *testing.T) {
+	db := newTestDB(t, "edit")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	db.Follow(b, a)
+	first, _ := db.PostStatus(a, "frist")
+	second, _ := db.PostStatus(a, "second")
+	before, _ := db.GetStatus(first)
+
+	if _, err := db.EditStatus(b, first, "mine"); err != ErrNotOwner {
+		t.Errorf("edit by b err == %v\n", err)
+	}
+	if _, err := db.EditStatus(a, -5, "none"); err != ErrNotFound {
+		t.Errorf("edit of a missing status err == %v\n", err)
+	}
+	if res, err := db.EditStatus(a, first, "first"); !res || err != nil {
+		t.Fatal("error editing status ", err)
+	}
+	db.EditStatus(a, first, "first!")
+
+	status, _ := db.GetStatus(first)
+	if status.Message != "first!" || status.Posted != before.Posted ||
+		status.Edited == 0 || status.Revisions != 2 {
+		t.Errorf("status == %+v\n", status)
+	}
+	if tl, _ := db.GetUserTimeline(b, 1, 30); len(tl) != 2 || tl[0] != second {
+		t.Errorf("timeline == %v\n", tl)
+	}
+	history, err := db.StatusHistory(first)
+	if err != nil {
+		t.Fatal("error reading history ", err)
+	}
+	if len(history) != 3 || history[0].Message != "frist" ||
+		history[0].At != before.Posted || history[2].Message != "first!" {
+		t.Errorf("history == %+v\n", history)
+	}
+
+	// the revisions survive an export
+	dst := newTestDB(t, "edit-import")
+	defer dst.DropNamespace()
+	var archive bytes.Buffer
+	db.Export(&archive)
+	if _, err := dst.Import(&archive, true); err != nil {
+		t.Fatal("error importing ", err)
+	}
+	if h, _ := dst.StatusHistory(first); len(h) != 3 || h[1].Message != "first" {
+		t.Errorf("imported history == %+v\n", h)
+	}
+
+	// and are deleted with the status
+	db.DeleteStatus(a, first)
+	if _, err := db.StatusHistory(first); err != ErrNotFound {
+		t.Errorf("history of a deleted status err == %v\n", err)
+	}
+	if n, _ := redis.Int(c.Do("EXISTS", db.idKey("revisions:", first))); n != 0 {
+		t.Error("revisions kept after delete")
+	}
+	if _, err := db.EditStatus(a, first, "again"); err != ErrNotFound {
+		t.Errorf("edit of a deleted status err == %v\n", err)
+	}
+}
+
+// tests that a status can not be edited after the window
+func TestEditWindow(t *testing.T) {
+	db := newTestDB(t, "edit")
+	defer db.DropNamespace()
+	EditWindow(time.Minute)(db)
+	c := db.Get()
+	defer c.Close()
+
+	sid, _ := db.PostStatus(-1, "typo")
+	if _, err := db.EditStatus(-1, sid, "fixed"); err != nil {
+		t.Error("error editing status ", err)
+	}
+	c.Do("HSET", db.idKey("status:", sid), "posted",
+		time.Now().Add(-2*time.Minute).Unix())
+	if _, err := db.EditStatus(-1, sid, "late"); err != ErrEditWindow {
+		t.Errorf("late edit err == %v\n", err)
+	}
+}
@@ -0,0 +1,276 @@
+package myredisDB
+
+import (
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+ * entities
+ *
+ * PostStatus and EditStatus parse "@login" and "#tag" tokens out of the
+ * message. mentions are resolved through the users: hash, the ones that
+ * resolve and every hashtag are stored as JSON in the entities field of
+ * the status hash. the status is added, scored by posted time, to
+ *
+ *   mentions:<uid>  of every user mentioned but the author
+ *   tag:<tag>       of every hashtag, the tag in lower case
+ *
+ * offsets count characters, not bytes: Start is the "@" or "#" and End
+ * is one past the last character of the token.
+ */
+
+// Entities are the parts of a message that refer to something else
+type Entities struct {
+	Mentions []Mention `json:"mentions,omitempty"`
+	Hashtags []Hashtag `json:"hashtags,omitempty"`
+}
+
+// Mention is an "@login" of a user that exists
+type Mention struct {
+	Uid   int    `json:"uid"`
+	Login string `json:"login"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// Hashtag is a "#tag", Tag is normalized by NormalizeTag
+type Hashtag struct {
+	Tag   string `json:"tag"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// empty tells if there is nothing to store
+func (e *Entities) empty() bool {
+	return e == nil || len(e.Mentions) == 0 && len(e.Hashtags) == 0
+}
+
+// encode returns the value of the entities field, "" for none
+func (e *Entities) encode() string {
+	if e.empty() {
+		return ""
+	}
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+
+// mentioned returns the uids to index the status under, without the
+// author and without repeats
+func (e *Entities) mentioned(author int) []int {
+	if e == nil {
+		return nil
+	}
+	seen := map[int]bool{author: true}
+	var uids []int
+	for _, m := range e.Mentions {
+		if !seen[m.Uid] {
+			seen[m.Uid] = true
+			uids = append(uids, m.Uid)
+		}
+	}
+	return uids
+}
+
+// tags returns the hashtags without repeats
+func (e *Entities) tags() []string {
+	if e == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var tags []string
+	for _, h := range e.Hashtags {
+		if !seen[h.Tag] {
+			seen[h.Tag] = true
+			tags = append(tags, h.Tag)
+		}
+	}
+	return tags
+}
+
+// token is a "@login" or "#tag" in a message
+type token struct {
+	text       string
+	start, end int
+}
+
+// parseTokens finds the tokens starting with mark. a mark only starts a
+// token at the beginning or after a character that can not be part of
+// one, so mail addresses and "a#b" are skipped.
+func parseTokens(message string, mark rune) []token {
+	var tokens []token
+	runes := []rune(message)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != mark || (i > 0 && loginRune(runes[i-1])) {
+			continue
+		}
+		end := i + 1
+		for end < len(runes) && loginRune(runes[end]) {
+			end++
+		}
+		if end > i+1 {
+			tokens = append(tokens, token{string(runes[i+1 : end]), i, end})
+		}
+		i = end - 1
+	}
+	return tokens
+}
+
+// parseMentions finds the "@login" tokens of a message
+func parseMentions(message string) []Mention {
+	var mentions []Mention
+	for _, t := range parseTokens(message, '@') {
+		mentions = append(mentions, Mention{Login: t.text, Start: t.start, End: t.end})
+	}
+	return mentions
+}
+
+// parseHashtags finds the "#tag" tokens of a message, a tag of digits
+// only, like "#1", is not one
+func parseHashtags(message string) []Hashtag {
+	var tags []Hashtag
+	for _, t := range parseTokens(message, '#') {
+		if strings.IndexFunc(t.text, func(r rune) bool { return !unicode.IsDigit(r) }) < 0 {
+			continue
+		}
+		tags = append(tags, Hashtag{Tag: NormalizeTag(t.text), Start: t.start, End: t.end})
+	}
+	return tags
+}
+
+// NormalizeTag is how a hashtag is indexed: lower case, without the "#"
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(tag, "#"))
+}
+
+// loginRune tells if r can be part of a mentioned login or a hashtag
+func loginRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// entities parses a message and resolves its mentions, nil when there
+// is nothing to store
+func (db *DB) entities(c redis.Conn, message string) (*Entities, error) {
+	e := &Entities{Hashtags: parseHashtags(message)}
+	mentions := parseMentions(message)
+	if len(mentions) == 0 {
+		if e.empty() {
+			return nil, nil
+		}
+		return e, nil
+	}
+	args := redis.Args{}.Add(db.key("users:"))
+	for _, m := range mentions {
+		args = args.Add(m.Login)
+	}
+	uids, err := redis.Values(c.Do("HMGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	for j, m := range mentions {
+		if uid, err := redis.Int(uids[j], nil); err == nil {
+			m.Uid = uid
+			e.Mentions = append(e.Mentions, m)
+		}
+	}
+	if e.empty() {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// decodeEntities reads the entities field of a status hash
+func decodeEntities(s string) *Entities {
+	if s == "" {
+		return nil
+	}
+	e := &Entities{}
+	if err := json.Unmarshal([]byte(s), e); err != nil {
+		return nil
+	}
+	return e
+}
+
+// scanStatus reads a status hash, with its entities
+func scanStatus(r []interface{}, status *Status) error {
+	if err := redis.ScanStruct(r, status); err != nil {
+		return err
+	}
+	status.Entities = decodeEntities(status.RawEntities)
+	return nil
+}
+
+// indexEntities adds a status to the mentions of the users it mentions
+// and to its tags
+func (db *DB) indexEntities(c redis.Conn, uid, sid int, posted int64, e *Entities) error {
+	uids, tags := e.mentioned(uid), e.tags()
+	if len(uids) == 0 && len(tags) == 0 {
+		return nil
+	}
+	for _, mentioned := range uids {
+		c.Send("ZADD", db.idKey("mentions:", mentioned), posted, sid)
+	}
+	for _, tag := range tags {
+		c.Send("ZADD", db.key("tag:"+tag), posted, sid)
+	}
+	_, err := c.Do("")
+	return err
+}
+
+// sendUnindex queues the removal of a status from the keys its entities
+// put it in, it returns how many commands were queued
+func (db *DB) sendUnindex(c redis.Conn, uid, sid int, e *Entities) int {
+	n := 0
+	for _, mentioned := range e.mentioned(uid) {
+		c.Send("ZREM", db.idKey("mentions:", mentioned), strconv.Itoa(sid))
+		n++
+	}
+	for _, tag := range e.tags() {
+		c.Send("ZREM", db.key("tag:"+tag), strconv.Itoa(sid))
+		n++
+	}
+	return n
+}
+
+// unindexEntities takes statuses out of the mentions and tags of their
+// entities, which are read from the status or its tombstone
+func (db *DB) unindexEntities(c redis.Conn, sids []int) error {
+	for _, sid := range sids {
+		c.Send("HMGET", db.idKey("status:", sid), "uid", "entities")
+	}
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for j, sid := range sids {
+		var uid int
+		var raw string
+		fields, _ := redis.Values(r[j], nil)
+		if _, err := redis.Scan(fields, &uid, &raw); err != nil {
+			return err
+		}
+		pending += db.sendUnindex(c, uid, sid, decodeEntities(raw))
+	}
+	if pending == 0 {
+		return nil
+	}
+	_, err = c.Do("")
+	return err
+}
+
+// GetMentions returns a page of the statuses that mention uid, the
+// newest first
+func (db *DB) GetMentions(uid, page, count int) ([]int, error) {
+	return db.newestFirst(db.idKey("mentions:", uid), page, count)
+}
+
+// GetTagTimeline returns a page of the statuses with a hashtag, the
+// newest first
+func (db *DB) GetTagTimeline(tag string, page, count int) ([]int, error) {
+	return db.newestFirst(db.key("tag:"+NormalizeTag(tag)), page, count)
+}
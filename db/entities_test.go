@@ -0,0 +1,109 @@
+package myredisDB
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		message string
+		want    []Mention
+	}{
+		{"no mentions", nil},
+		{"@a at the start", []Mention{{Login: "a", Start: 0, End: 2}}},
+		{"hi @bob_2, and @çé!", []Mention{{Login: "bob_2", Start: 3, End: 9},
+			{Login: "çé", Start: 15, End: 18}}},
+		{"mail me@example.com or @ alone", nil},
+	}
+	for _, test := range tests {
+		if got := parseMentions(test.message); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseMentions(%q) == %+v, want %+v\n", test.message, got, test.want)
+		}
+	}
+}
+
+func TestParseHashtags(t *testing.T) {
+	tests := []struct {
+		message string
+		want    []Hashtag
+	}{
+		{"no tags", nil},
+		{"#Go and #go_lang!", []Hashtag{{Tag: "go", Start: 0, End: 3},
+			{Tag: "go_lang", Start: 8, End: 16}}},
+		{"issue #12, a#b and # alone", nil},
+		{"#ÉTÉ2024", []Hashtag{{Tag: "été2024", Start: 0, End: 8}}},
+	}
+	for _, test := range tests {
+		if got := parseHashtags(test.message); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseHashtags(%q) == %+v, want %+v\n", test.message, got, test.want)
+		}
+	}
+}
+
+// tests that mentions are resolved, indexed and follow edits and deletes
+func TestMentions(t *testing.T) {
+	db := newTestDB(t, "mentions")
+	defer db.DropNamespace()
+
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	sid, _ := db.PostStatus(a, "hey @b and @nobody, says @a")
+	other, _ := db.PostStatus(a, "@b again")
+
+	status, _ := db.GetStatus(sid)
+	if status.Entities == nil || len(status.Entities.Mentions) != 2 ||
+		status.Entities.Mentions[0] != (Mention{Uid: b, Login: "b", Start: 4, End: 6}) {
+		t.Errorf("entities == %+v\n", status.Entities)
+	}
+	if m, _ := db.GetMentions(b, 1, 30); len(m) != 2 || m[0] != other {
+		t.Errorf("mentions of b == %v\n", m)
+	}
+	if m, _ := db.GetMentions(a, 1, 30); len(m) != 0 {
+		t.Errorf("mentions of the author == %v\n", m)
+	}
+
+	db.EditStatus(a, other, "no one")
+	if status, _ := db.GetStatus(other); status.Entities != nil {
+		t.Errorf("entities after edit == %+v\n", status.Entities)
+	}
+	if m, _ := db.GetMentions(b, 1, 30); len(m) != 1 || m[0] != sid {
+		t.Errorf("mentions after edit == %v\n", m)
+	}
+	db.DeleteStatus(a, sid)
+	if m, _ := db.GetMentions(b, 1, 30); len(m) != 0 {
+		t.Errorf("mentions after delete == %v\n", m)
+	}
+}
+
+// tests that tag timelines are case insensitive and follow edits and
+// deletes
+func TestTagTimeline(t *testing.T) {
+	db := newTestDB(t, "tags")
+	defer db.DropNamespace()
+
+	a, _ := db.CreateUser("a", "A")
+	sid, _ := db.PostStatus(a, "#Redis is #fast, #redis")
+	other, _ := db.PostStatus(a, "more #redis")
+
+	status, _ := db.GetStatus(sid)
+	if status.Entities == nil || len(status.Entities.Hashtags) != 3 ||
+		status.Entities.Hashtags[0] != (Hashtag{Tag: "redis", Start: 0, End: 6}) {
+		t.Errorf("entities == %+v\n", status.Entities)
+	}
+	if tl, _ := db.GetTagTimeline("#REDIS", 1, 30); len(tl) != 2 || tl[0] != other {
+		t.Errorf("tag timeline == %v\n", tl)
+	}
+
+	db.EditStatus(a, other, "now #slow")
+	if tl, _ := db.GetTagTimeline("redis", 1, 30); len(tl) != 1 || tl[0] != sid {
+		t.Errorf("tag timeline after edit == %v\n", tl)
+	}
+	if tl, _ := db.GetTagTimeline("slow", 1, 30); len(tl) != 1 || tl[0] != other {
+		t.Errorf("new tag after edit == %v\n", tl)
+	}
+	db.DeleteStatus(a, sid)
+	if tl, _ := db.GetTagTimeline("fast", 1, 30); len(tl) != 0 {
+		t.Errorf("tag timeline after delete == %v\n", tl)
+	}
+}
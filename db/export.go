@@ -0,0 +1,578 @@
+package myredisDB
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * export and import
+ *
+ * Export writes the data of a namespace as JSON Lines: a header, one
+ * record per user hash, status hash, old status message, zset member,
+ * tagged status, reshared timeline entry and pulled author, the id
+ * counters, and a trailer with a checksum per record type. a checksum
+ * is the count and the xor of the sha256 of every line of that type, so
+ * it does not depend on the order SCAN returns the keys in. Import
+ * writes the records into an empty namespace and checks them against
+ * the trailer, with verify it exports the result again and compares.
+ *
+ * the fan-out queue is not exported, drain it before exporting. neither
+ * are the trend buckets, they only count the last day, or the
+ * notifications: notifications:, notices:, notifiers: and notified:
+ * start empty after an import.
+ */
+
+// ExportFormat is the version of the archive layout
+const ExportFormat = 1
+
+const (
+	// zset members read per ZRANGE and records written per pipeline
+	exportBatch = 1000
+)
+
+// zsets exported member by member, the record type is the key prefix
+var exportZsets = []string{"following", "followers", "timeline", "posts",
+	"replies", "conversation", "resharers", "reshares", "likers", "likes",
+	"mentions"}
+
+// ExportChecksum sums the records of one type
+type ExportChecksum struct {
+	Count int    `json:"count"`
+	Sum   string `json:"sum"`
+}
+
+// ExportSummary is what the trailer of an archive records
+type ExportSummary struct {
+	Format    int                       `json:"format"`
+	Schema    int                       `json:"schema"`
+	Checksums map[string]ExportChecksum `json:"checksums"`
+}
+
+// exportRecord is one line of an archive
+type exportRecord struct {
+	Type string `json:"type"`
+	// user or status id, or the owner of a zset
+	ID int `json:"id,omitempty"`
+	// the owner of a zset that is named, not numbered
+	Name   string            `json:"name,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Member int               `json:"member,omitempty"`
+	Score  int64             `json:"score,omitempty"`
+
+	// header
+	Format  int   `json:"format,omitempty"`
+	Schema  int   `json:"schema,omitempty"`
+	Created int64 `json:"created,omitempty"`
+	// counters
+	UserID   int `json:"user_id,omitempty"`
+	StatusID int `json:"status_id,omitempty"`
+	// trailer
+	Checksums map[string]ExportChecksum `json:"checksums,omitempty"`
+}
+
+/*********************************************
+************ Checksums **********************/
+
+type checksum struct {
+	count int
+	sum   [sha256.Size]byte
+}
+
+type checksums map[string]*checksum
+
+func (cs checksums) add(typ string, line []byte) {
+	c, ok := cs[typ]
+	if !ok {
+		c = new(checksum)
+		cs[typ] = c
+	}
+	c.count++
+	h := sha256.Sum256(line)
+	for j := range h {
+		c.sum[j] ^= h[j]
+	}
+}
+
+func (cs checksums) summary() map[string]ExportChecksum {
+	m := make(map[string]ExportChecksum, len(cs))
+	for typ, c := range cs {
+		m[typ] = ExportChecksum{c.count, hex.EncodeToString(c.sum[:])}
+	}
+	return m
+}
+
+// compare returns an error naming the first type that differs
+func compareChecksums(want, got map[string]ExportChecksum) error {
+	for typ, w := range want {
+		if g := got[typ]; g != w {
+			return fmt.Errorf("myredisDB: %s records differ, want %d %s got %d %s",
+				typ, w.Count, w.Sum, g.Count, g.Sum)
+		}
+	}
+	for typ, g := range got {
+		if _, ok := want[typ]; !ok {
+			return fmt.Errorf("myredisDB: %d unexpected %s records", g.Count, typ)
+		}
+	}
+	return nil
+}
+
+/*********************************************
+************ Export *************************/
+
+// exporter writes records and sums them
+type exporter struct {
+	w    io.Writer
+	sums checksums
+}
+
+func (e *exporter) write(r exportRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if e.sums != nil {
+		e.sums.add(r.Type, line)
+	}
+	if e.w == nil {
+		return nil
+	}
+	_, err = e.w.Write(append(line, '\n'))
+	return err
+}
+
+// Export writes every user, status, revision, follow edge, timeline
+// entry, post and pulled author to w. it should run while nothing is
+// written.
+func (db *DB) Export(w io.Writer) (ExportSummary, error) {
+	bw := bufio.NewWriter(w)
+	summary, err := db.export(bw)
+	if err != nil {
+		return summary, err
+	}
+	return summary, bw.Flush()
+}
+
+// export streams the records to w, or only sums them with a nil w
+func (db *DB) export(w io.Writer) (ExportSummary, error) {
+	summary := ExportSummary{Format: ExportFormat}
+	schema, err := db.SchemaVersion()
+	if err != nil {
+		return summary, err
+	}
+	summary.Schema = schema
+
+	e := &exporter{w: w, sums: make(checksums)}
+	// the header is not summed, it differs between exports
+	sums := e.sums
+	e.sums = nil
+	if err := e.write(exportRecord{Type: "header", Format: ExportFormat,
+		Schema: schema, Created: time.Now().Unix()}); err != nil {
+		return summary, err
+	}
+	e.sums = sums
+
+	c := db.Get()
+	defer c.Close()
+
+	counters := exportRecord{Type: "counters"}
+	for key, v := range map[string]*int{"user:id": &counters.UserID,
+		"status:id": &counters.StatusID} {
+		if *v, err = redis.Int(c.Do("GET", db.key(key))); err != nil && err != redis.ErrNil {
+			return summary, err
+		}
+	}
+	if err := e.write(counters); err != nil {
+		return summary, err
+	}
+
+	for _, typ := range []string{"user", "status"} {
+		err := db.scanKeys(typ+":*", func(keys []string) error {
+			return db.exportHashes(c, e, typ, keys)
+		})
+		if err != nil {
+			return summary, err
+		}
+	}
+	err = db.scanKeys("revisions:*", func(keys []string) error {
+		return db.exportRevisions(c, e, keys)
+	})
+	if err != nil {
+		return summary, err
+	}
+	err = db.scanKeys("via:*", func(keys []string) error {
+		return db.exportVia(c, e, keys)
+	})
+	if err != nil {
+		return summary, err
+	}
+	err = db.scanKeys("tag:*", func(keys []string) error {
+		for _, key := range keys {
+			if err := db.exportTag(c, e, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return summary, err
+	}
+	for _, typ := range exportZsets {
+		err := db.scanKeys(typ+":*", func(keys []string) error {
+			for _, key := range keys {
+				if err := db.exportZset(c, e, typ, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	pulled, err := redis.Ints(c.Do("SMEMBERS", db.key("fanout:pull")))
+	if err != nil {
+		return summary, err
+	}
+	for _, uid := range pulled {
+		if err := e.write(exportRecord{Type: "pull", ID: uid}); err != nil {
+			return summary, err
+		}
+	}
+
+	summary.Checksums = e.sums.summary()
+	e.sums = nil
+	err = e.write(exportRecord{Type: "trailer", Format: ExportFormat,
+		Schema: schema, Checksums: summary.Checksums})
+	return summary, err
+}
+
+// exportHashes writes a record with the fields of every hash in keys
+func (db *DB) exportHashes(c redis.Conn, e *exporter, typ string, keys []string) error {
+	var ids []int
+	for _, key := range keys {
+		// skips the "user:id" and "status:id" counters
+		if id, ok := db.keyID(typ+":", key); ok {
+			ids = append(ids, id)
+			c.Send("HGETALL", key)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return err
+	}
+	for j, id := range ids {
+		fields, err := redis.StringMap(r[j], nil)
+		if err != nil {
+			return err
+		}
+		// deleted since the SCAN, or a tombstone
+		if _, deleted := fields["deleted"]; len(fields) == 0 || deleted {
+			continue
+		}
+		if err := e.write(exportRecord{Type: typ, ID: id, Fields: fields}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportRevisions writes a record per old message of every list in keys,
+// Member is the position in the list
+func (db *DB) exportRevisions(c redis.Conn, e *exporter, keys []string) error {
+	var sids []int
+	for _, key := range keys {
+		if sid, ok := db.keyID("revisions:", key); ok {
+			sids = append(sids, sid)
+			c.Send("LRANGE", key, 0, -1)
+		}
+	}
+	if len(sids) == 0 {
+		return nil
+	}
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return err
+	}
+	for j, sid := range sids {
+		entries, err := redis.Strings(r[j], nil)
+		if err != nil {
+			return err
+		}
+		for k, entry := range entries {
+			rev := parseRevision(entry)
+			err := e.write(exportRecord{Type: "revision", ID: sid, Member: k,
+				Score: rev.At, Fields: map[string]string{"message": rev.Message}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportVia writes a record per reshared timeline entry of every hash in
+// keys, Member is the status and Score the resharer
+func (db *DB) exportVia(c redis.Conn, e *exporter, keys []string) error {
+	var uids []int
+	for _, key := range keys {
+		if uid, ok := db.keyID("via:", key); ok {
+			uids = append(uids, uid)
+			c.Send("HGETALL", key)
+		}
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return err
+	}
+	for j, uid := range uids {
+		via, err := redis.IntMap(r[j], nil)
+		if err != nil {
+			return err
+		}
+		for sid, resharer := range via {
+			member, err := strconv.Atoi(sid)
+			if err != nil {
+				return err
+			}
+			err = e.write(exportRecord{Type: "via", ID: uid, Member: member,
+				Score: int64(resharer)})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportZset writes a record per member of the zset key
+func (db *DB) exportZset(c redis.Conn, e *exporter, typ, key string) error {
+	id, ok := db.keyID(typ+":", key)
+	if !ok {
+		return nil
+	}
+	return zsetMembers(c, key, func(member int, score int64) error {
+		return e.write(exportRecord{Type: typ, ID: id, Member: member,
+			Score: score})
+	})
+}
+
+// exportTag writes a record per status of the tag: zset key
+func (db *DB) exportTag(c redis.Conn, e *exporter, key string) error {
+	tag := strings.TrimPrefix(key, db.key("tag:"))
+	return zsetMembers(c, key, func(member int, score int64) error {
+		return e.write(exportRecord{Type: "tag", Name: tag, Member: member,
+			Score: score})
+	})
+}
+
+// zsetMembers calls fn with every member of the zset key, in batches
+func zsetMembers(c redis.Conn, key string, fn func(member int, score int64) error) error {
+	for start := 0; ; start += exportBatch {
+		r, err := redis.Values(c.Do("ZRANGE", key, start,
+			start+exportBatch-1, "WITHSCORES"))
+		if err != nil {
+			return err
+		}
+		for j := 0; j+1 < len(r); j += 2 {
+			var member int
+			var score int64
+			if _, err := redis.Scan(r[j:j+2], &member, &score); err != nil {
+				return err
+			}
+			if err := fn(member, score); err != nil {
+				return err
+			}
+		}
+		if len(r) < 2*exportBatch {
+			return nil
+		}
+	}
+}
+
+// scanKeys calls fn with batches of the keys matching match on every node
+func (db *DB) scanKeys(match string, fn func(keys []string) error) error {
+	pattern := globEscape(db.namespace) + match
+	return db.eachNode(func(node redis.Conn) error {
+		cursor := 0
+		for {
+			r, err := redis.Values(node.Do("SCAN", cursor, "MATCH", pattern,
+				"COUNT", exportBatch))
+			if err != nil {
+				return err
+			}
+			var keys []string
+			if _, err := redis.Scan(r, &cursor, &keys); err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				if err := fn(keys); err != nil {
+					return err
+				}
+			}
+			if cursor == 0 {
+				return nil
+			}
+		}
+	})
+}
+
+/*********************************************
+************ Import *************************/
+
+var ErrNamespaceNotEmpty = errors.New("myredisDB: import needs an empty namespace")
+
+// Import writes an archive made by Export into the namespace, which has
+// to be empty. the records are checked against the trailer's checksums,
+// with verify the imported data is exported again and compared too. a
+// failed import leaves a partial copy behind, drop the namespace.
+func (db *DB) Import(r io.Reader, verify bool) (ExportSummary, error) {
+	var summary ExportSummary
+	empty := true
+	err := db.scanKeys("*", func(keys []string) error {
+		empty = false
+		return nil
+	})
+	if err != nil {
+		return summary, err
+	}
+	if !empty {
+		return summary, ErrNamespaceNotEmpty
+	}
+
+	c := db.Get()
+	defer c.Close()
+
+	sums := make(checksums)
+	scanner := bufio.NewScanner(r)
+	// status messages and user names are not limited in length
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	pending := 0
+	trailer := false
+	for line := 1; scanner.Scan(); line++ {
+		if trailer {
+			return summary, fmt.Errorf("myredisDB: line %d: records after the trailer", line)
+		}
+		var rec exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return summary, fmt.Errorf("myredisDB: line %d: %v", line, err)
+		}
+
+		switch rec.Type {
+		case "header":
+			if line != 1 {
+				return summary, fmt.Errorf("myredisDB: line %d: header is not first", line)
+			}
+			if rec.Format != ExportFormat {
+				return summary, fmt.Errorf("myredisDB: archive format %d, want %d",
+					rec.Format, ExportFormat)
+			}
+			summary.Format, summary.Schema = rec.Format, rec.Schema
+			continue
+		case "trailer":
+			trailer = true
+			summary.Checksums = rec.Checksums
+			continue
+		}
+		if line == 1 {
+			return summary, errors.New("myredisDB: the archive has no header")
+		}
+
+		sums.add(rec.Type, scanner.Bytes())
+		if err := db.importRecord(c, rec); err != nil {
+			return summary, fmt.Errorf("myredisDB: line %d: %v", line, err)
+		}
+		if pending++; pending == exportBatch {
+			if _, err := c.Do(""); err != nil {
+				return summary, err
+			}
+			pending = 0
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return summary, err
+	}
+	if _, err := c.Do(""); err != nil {
+		return summary, err
+	}
+	if !trailer {
+		return summary, errors.New("myredisDB: the archive has no trailer, it is truncated")
+	}
+	if err := compareChecksums(summary.Checksums, sums.summary()); err != nil {
+		return summary, err
+	}
+	if summary.Schema > 0 {
+		if _, err := c.Do("SET", db.key("schema:version"), summary.Schema); err != nil {
+			return summary, err
+		}
+	}
+
+	if verify {
+		got, err := db.export(nil)
+		if err != nil {
+			return summary, err
+		}
+		if err := compareChecksums(summary.Checksums, got.Checksums); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+// importRecord queues the writes of one record on c
+func (db *DB) importRecord(c redis.Conn, rec exportRecord) error {
+	if len(rec.Fields) == 0 && (rec.Type == "user" || rec.Type == "status") {
+		return fmt.Errorf("%s %d has no fields", rec.Type, rec.ID)
+	}
+	switch rec.Type {
+	case "counters":
+		c.Send("SET", db.key("user:id"), rec.UserID)
+		c.Send("SET", db.key("status:id"), rec.StatusID)
+	case "user":
+		c.Send("HMSET", redis.Args{}.Add(db.idKey("user:", rec.ID)).AddFlat(rec.Fields)...)
+		// the login index is rebuilt from the users
+		if login, ok := rec.Fields["login"]; ok {
+			c.Send("HSET", db.key("users:"), login, rec.ID)
+			db.sendIndexUser(c, rec.ID, login, rec.Fields["name"])
+		}
+	case "status":
+		c.Send("HMSET", redis.Args{}.Add(db.idKey("status:", rec.ID)).AddFlat(rec.Fields)...)
+		// and so is the search index
+		posted, _ := strconv.ParseInt(rec.Fields["posted"], 10, 64)
+		db.sendIndexWords(c, rec.ID, posted, rec.Fields["message"])
+	case "revision":
+		// the records of a list are written in order
+		c.Send("RPUSH", db.idKey("revisions:", rec.ID),
+			fmt.Sprintf("%d:%s", rec.Score, rec.Fields["message"]))
+	case "via":
+		c.Send("HSET", db.idKey("via:", rec.ID), rec.Member, rec.Score)
+	case "following", "followers", "timeline", "posts", "replies",
+		"conversation", "resharers", "reshares", "likers", "likes", "mentions":
+		c.Send("ZADD", db.idKey(rec.Type+":", rec.ID), rec.Score,
+			strconv.Itoa(rec.Member))
+	case "tag":
+		c.Send("ZADD", db.key("tag:"+rec.Name), rec.Score, strconv.Itoa(rec.Member))
+	case "pull":
+		c.Send("SADD", db.key("fanout:pull"), rec.ID)
+	default:
+		return fmt.Errorf("unknown record type %q", rec.Type)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package myredisDB
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"testing"
+)
+
+// tests that an archive rebuilds the same data in another namespace
+func TestExportImport(t *testing.T) {
+	src := newTestDB(t, "export")
+	defer src.DropNamespace()
+	dst := newTestDB(t, "import")
+	defer dst.DropNamespace()
+
+	a, _ := src.CreateUser("a", "A")
+	b, _ := src.CreateUser("b", "B")
+	src.Follow(a, b)
+	tagged, _ := src.PostStatus(b, "exported #Tagged")
+	sid, _ := src.PostStatus(a, "with a \"quote\"\nand a newline")
+	src.Migrate(MigrateOptions{})
+
+	var archive bytes.Buffer
+	summary, err := src.Export(&archive)
+	if err != nil {
+		t.Fatal("error exporting ", err)
+	}
+	if summary.Checksums["user"].Count != 2 || summary.Checksums["status"].Count != 2 ||
+		summary.Checksums["following"].Count != 1 || summary.Checksums["timeline"].Count != 3 ||
+		summary.Checksums["tag"].Count != 1 {
+		t.Errorf("summary == %+v\n", summary)
+	}
+
+	imported, err := dst.Import(bytes.NewReader(archive.Bytes()), true)
+	if err != nil {
+		t.Fatal("error importing ", err)
+	}
+	if imported.Schema != LatestSchema {
+		t.Errorf("schema == %d\n", imported.Schema)
+	}
+
+	// the counters carry on where the source was
+	if uid, _ := dst.CreateUser("c", "C"); uid != b+1 {
+		t.Errorf("next uid == %d\n", uid)
+	}
+	if id, _ := dst.CreateUser("a", "A"); id != -1 {
+		t.Error("login index was not imported")
+	}
+	if user, _ := dst.GetUser(b); user.Followers != 1 || user.Posts != 1 {
+		t.Errorf("user == %+v\n", user)
+	}
+	if status, _ := dst.GetStatus(sid); status.Message != "with a \"quote\"\nand a newline" {
+		t.Errorf("status == %+v\n", status)
+	}
+	if tl, _ := dst.GetUserTimeline(a, 1, 30); len(tl) != 2 || tl[0] != sid {
+		t.Errorf("timeline == %v\n", tl)
+	}
+	if tl, _ := dst.GetTagTimeline("tagged", 1, 30); len(tl) != 1 || tl[0] != tagged {
+		t.Errorf("tag timeline == %v\n", tl)
+	}
+
+	// the namespace is no longer empty
+	if _, err := dst.Import(bytes.NewReader(archive.Bytes()), false); err != ErrNamespaceNotEmpty {
+		t.Errorf("err == %v\n", err)
+	}
+}
+
+// tests that changed and truncated archives are refused
+func TestImportChecksums(t *testing.T) {
+	src := newTestDB(t, "export")
+	defer src.DropNamespace()
+	dst := newTestDB(t, "import")
+	defer dst.DropNamespace()
+
+	src.PostStatus(-1, "original")
+	var archive bytes.Buffer
+	if _, err := src.Export(&archive); err != nil {
+		t.Fatal("error exporting ", err)
+	}
+
+	changed := strings.Replace(archive.String(), "original", "changed", 1)
+	if _, err := dst.Import(strings.NewReader(changed), false); err == nil ||
+		!strings.Contains(err.Error(), "status records differ") {
+		t.Errorf("err == %v\n", err)
+	}
+
+	dst.DropNamespace()
+	lines := strings.SplitAfter(archive.String(), "\n")
+	truncated := strings.Join(lines[:len(lines)-2], "")
+	if _, err := dst.Import(strings.NewReader(truncated), false); err == nil {
+		t.Error("imported a truncated archive")
+	}
+
+	// verify notices data that differs from the archive
+	dst.DropNamespace()
+	c := dst.Get()
+	defer c.Close()
+	if _, err := dst.Import(strings.NewReader(archive.String()), true); err != nil {
+		t.Fatal("error importing ", err)
+	}
+	c.Do("ZADD", dst.idKey("timeline:", -1), 1, 12345)
+	if got, _ := dst.export(nil); compareChecksums(got.Checksums,
+		mustSummary(t, archive.String()).Checksums) == nil {
+		t.Error("extra timeline entry was not noticed")
+	}
+	if n, _ := redis.Int(c.Do("EXISTS", dst.key("users:"))); n != 0 {
+		t.Error("login index written without users")
+	}
+}
+
+// mustSummary reads the trailer of an archive
+func mustSummary(t *testing.T, archive string) ExportSummary {
+	lines := strings.Split(strings.TrimSpace(archive), "\n")
+	var summary ExportSummary
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &summary); err != nil {
+		t.Fatal("error reading trailer ", err)
+	}
+	return summary
+}
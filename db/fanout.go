@@ -0,0 +1,138 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strconv"
+)
+
+/*
+ * hybrid fan-out
+ *
+ * statuses are normally pushed into every follower's timeline when they
+ * are posted. for authors with more followers than the threshold that is
+ * too expensive, so their statuses only go to posts:<uid> and the author
+ * is added to the fanout:pull set. GetUserTimeline merges the posts of
+ * the pulled authors a reader follows into the reader's timeline.
+ */
+
+// FanoutThreshold stops pushing the statuses of authors with more than n
+// followers, they are merged into timelines when read instead. 0 pushes
+// to every follower, which is the default.
+func FanoutThreshold(n int) Option {
+	return func(db *DB) {
+		db.fanoutThreshold = n
+	}
+}
+
+// timelineEntry is a status id with its timeline score
+type timelineEntry struct {
+	sid    int
+	posted int64
+}
+
+// pulledFollowees returns the pulled authors that uid follows
+func (db *DB) pulledFollowees(c redis.Conn, uid int) ([]int, error) {
+	authors, err := redis.Ints(c.Do("SMEMBERS", db.key("fanout:pull")))
+	if err != nil || len(authors) == 0 {
+		return nil, err
+	}
+
+	following := db.idKey("following:", uid)
+	for _, author := range authors {
+		c.Send("ZSCORE", following, author)
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+
+	var pulled []int
+	for _, author := range authors {
+		r, err := c.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			pulled = append(pulled, author)
+		}
+	}
+	return pulled, nil
+}
+
+// mergedTimeline builds a timeline page from uid's timeline and the posts
+// of the pulled authors uid follows
+func (db *DB) mergedTimeline(c redis.Conn, uid int, pulled []int, page, count int) ([]int, error) {
+	start, stop := (page-1)*count, page*count-1
+	// no source can put more than stop+1 entries in front of the end of
+	// the page, so the head of each one is all that is needed
+	keys := []string{db.idKey("timeline:", uid)}
+	for _, author := range pulled {
+		keys = append(keys, db.idKey("posts:", author))
+	}
+	lists, err := db.timelineHeads(c, keys, stop)
+	if err != nil {
+		return nil, err
+	}
+	return pageOf(mergeEntries(lists...), start, stop), nil
+}
+
+// timelineHeads reads the newest stop+1 entries of every key in one round trip
+func (db *DB) timelineHeads(c redis.Conn, keys []string, stop int) ([][]timelineEntry, error) {
+	for _, key := range keys {
+		c.Send("ZREVRANGE", key, 0, stop, "WITHSCORES")
+	}
+	return receiveEntries(c, len(keys))
+}
+
+// scanEntries reads a WITHSCORES reply
+func scanEntries(r []interface{}) ([]timelineEntry, error) {
+	entries := make([]timelineEntry, 0, len(r)/2)
+	for len(r) > 0 {
+		var e timelineEntry
+		var err error
+		if r, err = redis.Scan(r, &e.sid, &e.posted); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// mergeEntries merges timelines into one without duplicates, ordered the
+// way ZREVRANGE orders a single zset
+func mergeEntries(lists ...[]timelineEntry) []timelineEntry {
+	seen := make(map[int]bool)
+	var merged []timelineEntry
+	for _, list := range lists {
+		for _, e := range list {
+			if !seen[e.sid] {
+				seen[e.sid] = true
+				merged = append(merged, e)
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].before(merged[j])
+	})
+	return merged
+}
+
+// before tells if e is listed ahead of o in a timeline. like ZREVRANGE,
+// newer entries go first and ties are in reverse lexical order of the id
+func (e timelineEntry) before(o timelineEntry) bool {
+	if e.posted != o.posted {
+		return e.posted > o.posted
+	}
+	return strconv.Itoa(e.sid) > strconv.Itoa(o.sid)
+}
+
+// pageOf returns the status ids between start and stop inclusive
+func pageOf(entries []timelineEntry, start, stop int) []int {
+	ids := []int{}
+	for i := start; i <= stop && i < len(entries); i++ {
+		if i >= 0 {
+			ids = append(ids, entries[i].sid)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,544 @@
+package myredisDB
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+)
+
+/*
+ * consistency checks
+ *
+ * the follower, following and post counters of a user hash are kept
+ * apart from the zsets they count, and on a cluster the two halves of a
+ * follow edge are written in different transactions. Fsck finds where
+ * they drifted apart:
+ *
+ *   edge       a following: member without the followers: member, or the
+ *              other way around. repaired by adding the missing half
+ *   counter    followers, following or posts differ from the ZCARD of
+ *              followers:N, following:N or posts:N. repaired by setting
+ *              the count. the posts counters are skipped for data older
+ *              than schema version 1, which has no posts:N
+ *   timeline   a timeline:, posts:, replies:, conversation:, reshares:,
+ *              likes:, mentions: or tag: entry of a status that does
+ *              not exist or is a tombstone. repaired by removing the
+ *              entry
+ *   thread     a reply missing from the conversation: of its root, or
+ *              from the replies: of its parent while that is live, left
+ *              behind when a reply on a cluster stopped after writing
+ *              the status. repaired by adding it to its thread
+ *   via        a via: entry of a status that is no longer in the
+ *              timeline, left behind when a timeline is trimmed.
+ *              repaired by removing the entry
+ *   login      a users: entry whose user hash is missing or has another
+ *              login, or a user missing from users:. repaired by
+ *              removing or adding the entry
+ *
+ * the notification keys, notifications:, notices:, notifiers: and
+ * notified:, are not checked, no other key tells what they should hold.
+ * edges and posts are checked before the counters, so repairing once is
+ * enough.
+ * writes while Fsck runs can show up as problems, check again before
+ * repairing on a busy server.
+ */
+
+// FsckProblem is one inconsistency Fsck found
+type FsckProblem struct {
+	Check  string
+	Key    string
+	Detail string
+	// the problem was fixed
+	Repaired bool
+}
+
+func (p FsckProblem) String() string {
+	s := fmt.Sprintf("%s %s: %s", p.Check, p.Key, p.Detail)
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// FsckOptions select what Fsck does
+type FsckOptions struct {
+	// fix the problems found
+	Repair bool
+	// called with every problem, as it is found
+	Problem func(FsckProblem)
+}
+
+// FsckSummary counts the problems by check
+type FsckSummary struct {
+	Problems map[string]int
+	Repaired int
+	// what was not checked, and why
+	Skipped []string
+}
+
+// Total is the number of problems found
+func (s FsckSummary) Total() int {
+	n := 0
+	for _, count := range s.Problems {
+		n += count
+	}
+	return n
+}
+
+// fsck collects the problems of one run
+type fsck struct {
+	db      *DB
+	c       redis.Conn
+	o       FsckOptions
+	summary FsckSummary
+	// cached users and statuses that have to be dropped
+	changed []string
+	// posts:N exists, so the posts counters can be checked
+	posts bool
+}
+
+func (f *fsck) problem(p FsckProblem) {
+	f.summary.Problems[p.Check]++
+	if p.Repaired {
+		f.summary.Repaired++
+	}
+	if f.o.Problem != nil {
+		f.o.Problem(p)
+	}
+}
+
+// Fsck checks the denormalized data and, with o.Repair, fixes it
+func (db *DB) Fsck(o FsckOptions) (FsckSummary, error) {
+	v, err := db.SchemaVersion()
+	if err != nil {
+		return FsckSummary{}, err
+	}
+	c := db.Get()
+	defer c.Close()
+
+	// the posts counters are checked against posts:N, which schema
+	// version 1 indexes. a store that was never migrated may still hold
+	// statuses from before it
+	f := &fsck{db: db, c: c, o: o, posts: v >= 1,
+		summary: FsckSummary{Problems: make(map[string]int)}}
+	if !f.posts {
+		f.summary.Skipped = append(f.summary.Skipped, fmt.Sprintf(
+			"posts counters, the data is in schema version %d, migrate to check them", v))
+	}
+	checks := []func() error{
+		func() error { return f.edges("following", "followers") },
+		func() error { return f.edges("followers", "following") },
+		func() error { return f.entries("timeline") },
+		func() error { return f.entries("posts") },
+		func() error { return f.entries("replies") },
+		func() error { return f.entries("conversation") },
+		func() error { return f.entries("reshares") },
+		func() error { return f.entries("likes") },
+		func() error { return f.entries("mentions") },
+		func() error { return f.entries("tag") },
+		f.threads,
+		f.via,
+		f.counters,
+		f.logins,
+	}
+	for _, check := range checks {
+		if err := check(); err != nil {
+			return f.summary, err
+		}
+	}
+	if len(f.changed) > 0 {
+		db.invalidate(c, f.changed...)
+	}
+	return f.summary, nil
+}
+
+// edges checks that every member of the from: zsets is mirrored in the
+// to: zset of the member
+func (f *fsck) edges(from, to string) error {
+	db := f.db
+	return db.scanKeys(from+":*", func(keys []string) error {
+		for _, key := range keys {
+			uid, ok := db.keyID(from+":", key)
+			if !ok {
+				continue
+			}
+			type edge struct {
+				other int
+				score int64
+			}
+			var edges []edge
+			err := zsetMembers(f.c, key, func(other int, score int64) error {
+				edges = append(edges, edge{other, score})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(edges) == 0 {
+				continue
+			}
+
+			for _, e := range edges {
+				f.c.Send("ZSCORE", db.idKey(to+":", e.other), uid)
+			}
+			r, err := redis.Values(f.c.Do(""))
+			if err != nil {
+				return err
+			}
+			for j, e := range edges {
+				if r[j] != nil {
+					continue
+				}
+				f.problem(FsckProblem{Check: "edge", Key: key,
+					Detail:   fmt.Sprintf("%d is not in %s:%d", uid, to, e.other),
+					Repaired: f.o.Repair})
+				if f.o.Repair {
+					f.c.Send("ZADD", db.idKey(to+":", e.other), e.score, uid)
+				}
+			}
+			if f.o.Repair {
+				if _, err := f.c.Do(""); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// counters compares the counters of every user hash with its zsets
+func (f *fsck) counters() error {
+	db := f.db
+	fields := []string{"followers", "following"}
+	if f.posts {
+		fields = append(fields, "posts")
+	}
+	return db.scanKeys("user:*", func(keys []string) error {
+		var uids []int
+		for _, key := range keys {
+			uid, ok := db.keyID("user:", key)
+			if !ok {
+				continue
+			}
+			uids = append(uids, uid)
+			f.c.Send("HMGET", redis.Args{}.Add(key).AddFlat(fields)...)
+			for _, field := range fields {
+				f.c.Send("ZCARD", db.idKey(field+":", uid))
+			}
+		}
+		if len(uids) == 0 {
+			return nil
+		}
+		r, err := redis.Values(f.c.Do(""))
+		if err != nil {
+			return err
+		}
+
+		step := len(fields) + 1
+		for j, uid := range uids {
+			stored, _ := redis.Values(r[j*step], nil)
+			for k, field := range fields {
+				want, _ := redis.Int(r[j*step+k+1], nil)
+				got, err := redis.Int(stored[k], nil)
+				if err == nil && got == want {
+					continue
+				}
+				key := db.idKey("user:", uid)
+				f.problem(FsckProblem{Check: "counter", Key: key,
+					Detail: fmt.Sprintf("%s is %v, %s:%d has %d", field,
+						counterString(stored[k]), field, uid, want),
+					Repaired: f.o.Repair})
+				if f.o.Repair {
+					f.c.Send("HSET", key, field, want)
+					f.changed = append(f.changed, userCacheKey(uid))
+				}
+			}
+		}
+		if f.o.Repair {
+			_, err = f.c.Do("")
+		}
+		return err
+	})
+}
+
+// counterString shows a counter read with HMGET, which may be missing
+func counterString(v interface{}) string {
+	if v == nil {
+		return "missing"
+	}
+	s, _ := redis.String(v, nil)
+	return strconv.Quote(s)
+}
+
+// entries checks that the statuses of every typ: zset exist and were
+// not deleted
+func (f *fsck) entries(typ string) error {
+	db := f.db
+	return db.scanKeys(typ+":*", func(keys []string) error {
+		for _, key := range keys {
+			// tag: keys are named, not numbered
+			if _, ok := db.keyID(typ+":", key); !ok && typ != "tag" {
+				continue
+			}
+			var sids []int
+			err := zsetMembers(f.c, key, func(sid int, score int64) error {
+				sids = append(sids, sid)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(sids) == 0 {
+				continue
+			}
+
+			for _, sid := range sids {
+				f.c.Send("HMGET", db.idKey("status:", sid), "id", "deleted")
+			}
+			r, err := redis.Values(f.c.Do(""))
+			if err != nil {
+				return err
+			}
+			// removed once the whole zset was read
+			var missing []interface{}
+			for j, sid := range sids {
+				fields, _ := redis.Values(r[j], nil)
+				detail := fmt.Sprintf("status %d does not exist", sid)
+				switch {
+				case len(fields) != 2 || fields[0] == nil:
+				case fields[1] != nil:
+					detail = fmt.Sprintf("status %d was deleted", sid)
+				default:
+					continue
+				}
+				f.problem(FsckProblem{Check: "timeline", Key: key,
+					Detail: detail, Repaired: f.o.Repair})
+				missing = append(missing, sid)
+			}
+			if f.o.Repair && len(missing) > 0 {
+				if _, err := f.c.Do("ZREM", redis.Args{}.Add(key).Add(missing...)...); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// threads checks that every reply that was not deleted is in its thread
+func (f *fsck) threads() error {
+	db := f.db
+	return db.scanKeys("status:*", func(keys []string) error {
+		var sids []int
+		for _, key := range keys {
+			// skips the "status:id" counter
+			if sid, ok := db.keyID("status:", key); ok {
+				sids = append(sids, sid)
+				f.c.Send("HMGET", key, "in_reply_to", "root", "posted", "deleted")
+			}
+		}
+		if len(sids) == 0 {
+			return nil
+		}
+		r, err := redis.Values(f.c.Do(""))
+		if err != nil {
+			return err
+		}
+
+		var replies []thread
+		var posted []int64
+		for j, sid := range sids {
+			fields, _ := redis.Values(r[j], nil)
+			var t thread
+			var p int64
+			var deleted string
+			if _, err := redis.Scan(fields, &t.parent, &t.root, &p, &deleted); err != nil {
+				return err
+			}
+			// a tombstone has left its thread already
+			if t.parent == 0 || deleted != "" {
+				continue
+			}
+			t.sid = sid
+			replies = append(replies, t)
+			posted = append(posted, p)
+		}
+		if len(replies) == 0 {
+			return nil
+		}
+
+		for _, t := range replies {
+			f.c.Send("ZSCORE", db.idKey("conversation:", t.root), t.sid)
+			f.c.Send("ZSCORE", db.idKey("replies:", t.parent), t.sid)
+			f.c.Send("HMGET", db.idKey("status:", t.parent), "id", "deleted")
+		}
+		r, err = redis.Values(f.c.Do(""))
+		if err != nil {
+			return err
+		}
+		for j, t := range replies {
+			parent, _ := redis.Values(r[3*j+2], nil)
+			live := len(parent) == 2 && parent[0] != nil && parent[1] == nil
+			if r[3*j] != nil && (r[3*j+1] != nil || !live) {
+				continue
+			}
+			f.problem(FsckProblem{Check: "thread", Key: db.idKey("status:", t.sid),
+				Detail: fmt.Sprintf("reply to %d is not in conversation:%d or replies:%d",
+					t.parent, t.root, t.parent),
+				Repaired: f.o.Repair})
+			if f.o.Repair {
+				if err := db.addToThread(f.c, t, posted[j]); err != nil {
+					return err
+				}
+				f.changed = append(f.changed, statusCacheKey(t.parent))
+			}
+		}
+		return nil
+	})
+}
+
+// via checks that the reshared entries of every via: hash are in the
+// timeline of the same user
+func (f *fsck) via() error {
+	db := f.db
+	return db.scanKeys("via:*", func(keys []string) error {
+		for _, key := range keys {
+			uid, ok := db.keyID("via:", key)
+			if !ok {
+				continue
+			}
+			sids, err := redis.Strings(f.c.Do("HKEYS", key))
+			if err != nil {
+				return err
+			}
+			if len(sids) == 0 {
+				continue
+			}
+
+			timeline := db.idKey("timeline:", uid)
+			for _, sid := range sids {
+				f.c.Send("ZSCORE", timeline, sid)
+			}
+			r, err := redis.Values(f.c.Do(""))
+			if err != nil {
+				return err
+			}
+			var stale []interface{}
+			for j, sid := range sids {
+				if r[j] != nil {
+					continue
+				}
+				f.problem(FsckProblem{Check: "via", Key: key,
+					Detail:   fmt.Sprintf("status %s is not in timeline:%d", sid, uid),
+					Repaired: f.o.Repair})
+				stale = append(stale, sid)
+			}
+			if f.o.Repair && len(stale) > 0 {
+				if _, err := f.c.Do("HDEL", redis.Args{}.Add(key).Add(stale...)...); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// logins checks the users: index against the user hashes, both ways
+func (f *fsck) logins() error {
+	db := f.db
+	index := db.key("users:")
+	cursor := 0
+	for {
+		r, err := redis.Values(f.c.Do("HSCAN", index, cursor, "COUNT",
+			exportBatch))
+		if err != nil {
+			return err
+		}
+		var pairs []string
+		if _, err := redis.Scan(r, &cursor, &pairs); err != nil {
+			return err
+		}
+
+		for j := 0; j+1 < len(pairs); j += 2 {
+			uid, _ := strconv.Atoi(pairs[j+1])
+			f.c.Send("HGET", db.idKey("user:", uid), "login")
+		}
+		if len(pairs) > 0 {
+			logins, err := redis.Values(f.c.Do(""))
+			if err != nil {
+				return err
+			}
+			for j := 0; j+1 < len(pairs); j += 2 {
+				login, _ := redis.String(logins[j/2], nil)
+				if login == pairs[j] {
+					continue
+				}
+				detail := fmt.Sprintf("%q points to user %s, which does not exist",
+					pairs[j], pairs[j+1])
+				if login != "" {
+					detail = fmt.Sprintf("%q points to user %s, whose login is %q",
+						pairs[j], pairs[j+1], login)
+				}
+				f.problem(FsckProblem{Check: "login", Key: index, Detail: detail,
+					Repaired: f.o.Repair})
+				if f.o.Repair {
+					f.c.Send("HDEL", index, pairs[j])
+				}
+			}
+			if f.o.Repair {
+				if _, err := f.c.Do(""); err != nil {
+					return err
+				}
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+
+	// users that can not be found by their login
+	return db.scanKeys("user:*", func(keys []string) error {
+		var uids []int
+		for _, key := range keys {
+			if uid, ok := db.keyID("user:", key); ok {
+				uids = append(uids, uid)
+				f.c.Send("HGET", key, "login")
+			}
+		}
+		if len(uids) == 0 {
+			return nil
+		}
+		logins, err := redis.Values(f.c.Do(""))
+		if err != nil {
+			return err
+		}
+		var names []string
+		for j := range uids {
+			login, _ := redis.String(logins[j], nil)
+			names = append(names, login)
+			f.c.Send("HGET", index, login)
+		}
+		ids, err := redis.Values(f.c.Do(""))
+		if err != nil {
+			return err
+		}
+		for j, uid := range uids {
+			id, err := redis.Int(ids[j], nil)
+			if err == nil && id == uid {
+				continue
+			}
+			// only a login no one else holds is added
+			repair := f.o.Repair && err == redis.ErrNil && names[j] != ""
+			f.problem(FsckProblem{Check: "login", Key: db.idKey("user:", uid),
+				Detail:   fmt.Sprintf("login %q is not in users:", names[j]),
+				Repaired: repair})
+			if repair {
+				f.c.Send("HSETNX", index, names[j], uid)
+			}
+		}
+		if f.o.Repair {
+			_, err = f.c.Do("")
+		}
+		return err
+	})
+}
@@ -0,0 +1,88 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+// tests that drifted counters, edges, timelines, threads and logins are
+// found and repaired
+func TestFsck(t *testing.T) {
+	db := newTestDB(t, "fsck")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	// data that was never migrated is checked too, but for the posts
+	// counters: statuses from before schema 1 are not in posts:N
+	a, _ := db.CreateUser("a", "A")
+	c.Do("DEL", db.key("schema:version"))
+	c.Do("HSET", db.idKey("user:", a), "posts", 5)
+	if s, err := db.Fsck(FsckOptions{}); err != nil || s.Total() != 0 || len(s.Skipped) != 1 {
+		t.Errorf("unmigrated data == %+v, %v\n", s, err)
+	}
+	c.Do("HSET", db.idKey("user:", a), "posts", 0)
+	db.Migrate(MigrateOptions{})
+
+	b, _ := db.CreateUser("b", "B")
+	db.Follow(a, b)
+	kept, _ := db.PostStatus(b, "kept")
+	if s, err := db.Fsck(FsckOptions{}); err != nil || s.Total() != 0 || len(s.Skipped) != 0 {
+		t.Fatalf("clean data == %+v, %v\n", s, err)
+	}
+
+	// half an edge, a wrong counter, a deleted status and a stale login
+	c.Do("ZREM", db.idKey("followers:", b), a)
+	c.Do("HSET", db.idKey("user:", a), "posts", 5)
+	gone, _ := db.PostStatus(a, "gone")
+	c.Do("DEL", db.idKey("status:", gone))
+	// a tombstone left in the timeline and posts of b
+	dead, _ := db.PostStatus(b, "dead")
+	c.Do("HSET", db.idKey("status:", dead), "deleted", 1)
+	c.Do("HSET", db.key("users:"), "ghost", 999)
+	// a reply that stopped before joining its thread
+	reply, _ := db.PostReply(a, kept, "reply")
+	c.Do("ZREM", db.idKey("conversation:", kept), reply)
+	c.Do("ZREM", db.idKey("replies:", kept), reply)
+	c.Do("HINCRBY", db.idKey("status:", kept), "replies", -1)
+
+	var problems []FsckProblem
+	s, err := db.Fsck(FsckOptions{Problem: func(p FsckProblem) {
+		problems = append(problems, p)
+	}})
+	if err != nil {
+		t.Fatal("error checking ", err)
+	}
+	// the counter check also counts the missing follower of b
+	want := map[string]int{"edge": 1, "counter": 2, "timeline": 4, "thread": 1,
+		"login": 1}
+	for check, n := range want {
+		if s.Problems[check] != n {
+			t.Errorf("%s problems == %d, want %d: %v\n", check,
+				s.Problems[check], n, problems)
+		}
+	}
+	if s.Repaired != 0 {
+		t.Errorf("repaired %d without Repair\n", s.Repaired)
+	}
+
+	if s, err = db.Fsck(FsckOptions{Repair: true}); err != nil || s.Repaired != s.Total() {
+		t.Fatalf("repair == %+v, %v\n", s, err)
+	}
+	if s, err = db.Fsck(FsckOptions{}); err != nil || s.Total() != 0 {
+		t.Errorf("after repair == %+v, %v\n", s, err)
+	}
+	if n, _ := redis.Int(c.Do("ZCARD", db.idKey("followers:", b))); n != 1 {
+		t.Errorf("followers:%d has %d\n", b, n)
+	}
+	// the reply is the only post of a left
+	if user, _ := db.GetUser(a); user.Posts != 1 {
+		t.Errorf("posts == %d\n", user.Posts)
+	}
+	if tl, _ := db.GetUserTimeline(a, 1, 30); len(tl) != 2 {
+		t.Errorf("timeline == %v\n", tl)
+	}
+	if status, _ := db.GetStatus(kept); status.Replies != 1 {
+		t.Errorf("replies after repair == %d\n", status.Replies)
+	}
+}
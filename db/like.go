@@ -0,0 +1,120 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+/*
+ * likes
+ *
+ *   likers:<sid>  zset of the users who liked the status
+ *   likes:<uid>   zset of the statuses the user liked
+ *
+ * both are scored by the time of the like, the likes field of the status
+ * counts likers:<sid>. liking twice changes nothing.
+ */
+
+// Like records that uid likes sid, it returns false when uid liked it
+// already
+func (db *DB) Like(uid, sid int) (bool, error) {
+	c := db.Get()
+	defer c.Close()
+
+	now := time.Now().Unix()
+	res, err := redis.Int(markStatusScript.run(c, []string{db.idKey("status:", sid),
+		db.idKey("likers:", sid)}, uid, now, "likes"))
+	if err != nil {
+		return false, err
+	}
+	if res == -1 {
+		return false, ErrNotFound
+	}
+	db.invalidate(c, statusCacheKey(sid))
+
+	// also added when an earlier call stopped after counting the like
+	if _, err := c.Do("ZADD", db.idKey("likes:", uid), "NX", now, sid); err != nil {
+		return false, err
+	}
+	if res == 1 {
+		if err := db.notifyAuthor(c, sid, NotifyLike, uid); err != nil {
+			return true, err
+		}
+	}
+	return res == 1, nil
+}
+
+// Unlike takes a like back, it returns false when uid did not like sid
+func (db *DB) Unlike(uid, sid int) (bool, error) {
+	c := db.Get()
+	defer c.Close()
+
+	res, err := redis.Int(unlinkScript.run(c, []string{db.idKey("likers:", sid),
+		db.idKey("status:", sid)}, uid, "likes"))
+	if err != nil {
+		return false, err
+	}
+	db.invalidate(c, statusCacheKey(sid))
+	if _, err := c.Do("ZREM", db.idKey("likes:", uid), sid); err != nil {
+		return false, err
+	}
+	return res == 1, nil
+}
+
+// Likers returns a page of the users who liked sid, the latest first
+func (db *DB) Likers(sid, page, count int) ([]int, error) {
+	return db.newestFirst(db.idKey("likers:", sid), page, count)
+}
+
+// Liked returns a page of the statuses uid liked, the latest first
+func (db *DB) Liked(uid, page, count int) ([]int, error) {
+	return db.newestFirst(db.idKey("likes:", uid), page, count)
+}
+
+// newestFirst reads a page of a zset scored by time
+func (db *DB) newestFirst(key string, page, count int) ([]int, error) {
+	c := db.Get()
+	defer c.Close()
+
+	return redis.Ints(c.Do("ZREVRANGE", key, (page-1)*count, page*count-1))
+}
+
+// unlikeStatus drops the likes of a status that is being deleted
+func (db *DB) unlikeStatus(c redis.Conn, sid int) error {
+	likers := db.idKey("likers:", sid)
+	for {
+		uids, err := redis.Ints(c.Do("ZRANGE", likers, 0, syndicateBatch-1))
+		if err != nil {
+			return err
+		}
+		if len(uids) == 0 {
+			return nil
+		}
+		for _, uid := range uids {
+			c.Send("ZREM", db.idKey("likes:", uid), sid)
+		}
+		c.Send("ZREM", redis.Args{}.Add(likers).AddFlat(uids)...)
+		if _, err := c.Do(""); err != nil {
+			return err
+		}
+	}
+}
+
+// unlikeUser takes back every like of a user that is being deleted
+func (db *DB) unlikeUser(c redis.Conn, uid int) error {
+	likes := db.idKey("likes:", uid)
+	for {
+		sids, err := redis.Ints(c.Do("ZRANGE", likes, 0, syndicateBatch-1))
+		if err != nil {
+			return err
+		}
+		if len(sids) == 0 {
+			return nil
+		}
+		for _, sid := range sids {
+			if _, err := db.Unlike(uid, sid); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package myredisDB
+
+import "testing"
+
+// tests that likes are counted once and listed newest first
+func TestLike(t *testing.T) {
+	db := newTestDB(t, "like")
+	defer db.DropNamespace()
+
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	first, _ := db.PostStatus(a, "first")
+	second, _ := db.PostStatus(a, "second")
+
+	if _, err := db.Like(b, -5); err != ErrNotFound {
+		t.Errorf("like of a missing status err == %v\n", err)
+	}
+	if res, err := db.Like(b, first); !res || err != nil {
+		t.Fatal("error liking ", err)
+	}
+	if res, _ := db.Like(b, first); res {
+		t.Error("liked twice")
+	}
+	db.Like(a, first)
+	db.Like(b, second)
+
+	if status, _ := db.GetStatus(first); status.Likes != 2 {
+		t.Errorf("likes == %d\n", status.Likes)
+	}
+	if likers, _ := db.Likers(first, 1, 30); len(likers) != 2 {
+		t.Errorf("likers == %v\n", likers)
+	}
+	if liked, _ := db.Liked(b, 1, 1); len(liked) != 1 {
+		t.Errorf("first page of liked == %v\n", liked)
+	}
+	if liked, _ := db.Liked(b, 1, 30); len(liked) != 2 {
+		t.Errorf("liked == %v\n", liked)
+	}
+
+	if res, err := db.Unlike(b, first); !res || err != nil {
+		t.Error("error unliking ", err)
+	}
+	if res, _ := db.Unlike(b, first); res {
+		t.Error("unliked twice")
+	}
+	if status, _ := db.GetStatus(first); status.Likes != 1 {
+		t.Errorf("likes after unlike == %d\n", status.Likes)
+	}
+
+	// a deleted status leaves the liked lists, a deleted user its likes
+	db.DeleteStatus(a, second)
+	if liked, _ := db.Liked(b, 1, 30); len(liked) != 0 {
+		t.Errorf("liked after delete == %v\n", liked)
+	}
+	db.Like(b, first)
+	db.DeleteUser(b)
+	if status, _ := db.GetStatus(first); status.Likes != 1 {
+		t.Errorf("likes after deleting b == %d\n", status.Likes)
+	}
+}
@@ -0,0 +1,905 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*******************************************
+************** Fields *********************/
+
+// MemoryDB is a Store that keeps the redis data model in process memory.
+// it is meant for tests and for embedding the service without redis.
+type MemoryDB struct {
+	mu sync.Mutex
+
+	// global counters, mirror of "user:id" and "status:id"
+	userID   int
+	statusID int
+
+	// login -> uid, mirror of the "users:" hash
+	logins   map[string]int
+	users    map[int]*User
+	statuses map[int]*Status
+	// sid -> old messages, mirror of the "revisions:" lists
+	revisions map[int][]Revision
+
+	// mirror of the "timeline:", "posts:", "followers:" and "following:"
+	// zsets
+	timelines map[int]sortedSet
+	posts     map[int]sortedSet
+	followers map[int]sortedSet
+	following map[int]sortedSet
+	// mirror of the "replies:" and "conversation:" zsets
+	replies       map[int]sortedSet
+	conversations map[int]sortedSet
+	// mirror of the "resharers:" and "reshares:" zsets and the "via:"
+	// hashes
+	resharers map[int]sortedSet
+	reshares  map[int]sortedSet
+	via       map[int]map[int]int
+	// mirror of the "likers:" and "likes:" zsets
+	likers map[int]sortedSet
+	likes  map[int]sortedSet
+	// mirror of the "mentions:" and "tag:" zsets
+	mentions map[int]sortedSet
+	tags     map[string]sortedSet
+	// window -> bucket start -> tag -> uses, mirror of the "trend:" zsets
+	trends       map[string]map[int64]map[string]int
+	trendWindows []TrendWindow
+	// uid -> group -> notification, mirror of the "notifications:" zsets
+	// and "notices:" hashes, and the "notified:" times
+	notifications map[int]map[string]*Notification
+	notified      map[int]int64
+	// uid -> group -> actors, mirror of the "notifiers:" hashes
+	notifiers map[int]map[string]map[int]bool
+}
+
+/********************************************
+************* Constructor ******************/
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		logins:    make(map[string]int),
+		users:     make(map[int]*User),
+		statuses:  make(map[int]*Status),
+		revisions: make(map[int][]Revision),
+		timelines: make(map[int]sortedSet),
+		posts:     make(map[int]sortedSet),
+		followers: make(map[int]sortedSet),
+		following: make(map[int]sortedSet),
+
+		replies:       make(map[int]sortedSet),
+		conversations: make(map[int]sortedSet),
+		resharers:     make(map[int]sortedSet),
+		reshares:      make(map[int]sortedSet),
+		via:           make(map[int]map[int]int),
+		likers:        make(map[int]sortedSet),
+		likes:         make(map[int]sortedSet),
+		mentions:      make(map[int]sortedSet),
+		tags:          make(map[string]sortedSet),
+		trends:        make(map[string]map[int64]map[string]int),
+		trendWindows:  DefaultTrendWindows(),
+		notifications: make(map[int]map[string]*Notification),
+		notified:      make(map[int]int64),
+		notifiers:     make(map[int]map[string]map[int]bool),
+	}
+}
+
+/********************************************
+************* Sorted sets ******************/
+
+// sortedSet stands in for a redis zset with integer members
+type sortedSet map[int]int64
+
+// zset returns the set stored under id, creating it if needed
+func zset(m map[int]sortedSet, id int) sortedSet {
+	s, ok := m[id]
+	if !ok {
+		s = make(sortedSet)
+		m[id] = s
+	}
+	return s
+}
+
+// revRange behaves like ZREVRANGE: highest score first, ties broken by
+// the reverse lexical order of the member, start and stop inclusive.
+func (s sortedSet) revRange(start, stop int) []int {
+	members := make([]int, 0, len(s))
+	for m := range s {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, b := members[i], members[j]
+		if s[a] != s[b] {
+			return s[a] > s[b]
+		}
+		return strconv.Itoa(a) > strconv.Itoa(b)
+	})
+
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(members) {
+		stop = len(members) - 1
+	}
+	if start > stop {
+		return []int{}
+	}
+	return members[start : stop+1]
+}
+
+/********************************************
+***************  User code *****************/
+
+func (m *MemoryDB) CreateUser(login, name string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// check if username is taken
+	if _, ok := m.logins[login]; ok {
+		return -1, nil
+	}
+
+	m.userID++
+	id := m.userID
+	m.logins[login] = id
+	m.users[id] = &User{Login: login, Id: id, Name: name,
+		Signup: time.Now().Unix()}
+
+	return id, nil
+}
+
+func (m *MemoryDB) DeleteUser(uid int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[uid]
+	if !ok {
+		// same as HGET on a missing hash
+		return false, redis.ErrNil
+	}
+	delete(m.logins, user.Login)
+	delete(m.users, uid)
+
+	// statuses and the entries pushed to the followers
+	for sid := range m.posts[uid] {
+		for follower := range m.followers[uid] {
+			delete(m.timelines[follower], sid)
+		}
+		m.unthread(sid)
+		m.unindexEntities(sid)
+		m.unreshareStatus(sid)
+		m.unlikeStatus(sid)
+		delete(m.statuses, sid)
+		delete(m.revisions, sid)
+	}
+	for sid := range m.reshares[uid] {
+		m.unreshare(uid, sid)
+	}
+	for sid := range m.likes[uid] {
+		m.unlike(uid, sid)
+	}
+	// both halves of every follow edge
+	for follower := range m.followers[uid] {
+		delete(m.following[follower], uid)
+		if u, ok := m.users[follower]; ok {
+			u.Following--
+		}
+	}
+	for followee := range m.following[uid] {
+		delete(m.followers[followee], uid)
+		if u, ok := m.users[followee]; ok {
+			u.Followers--
+		}
+	}
+	delete(m.posts, uid)
+	delete(m.timelines, uid)
+	delete(m.followers, uid)
+	delete(m.following, uid)
+	delete(m.reshares, uid)
+	delete(m.via, uid)
+	delete(m.likes, uid)
+	delete(m.mentions, uid)
+	delete(m.notifications, uid)
+	delete(m.notified, uid)
+	delete(m.notifiers, uid)
+	return true, nil
+}
+
+func (m *MemoryDB) UpdateProfile(uid int, name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[uid]
+	if !ok {
+		return false, ErrNotFound
+	}
+	user.Name = name
+	return true, nil
+}
+
+// matches every user, there is no index to keep
+func (m *MemoryDB) SearchUsers(q string, count int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	query := parseUserQuery(q)
+	if len(query) == 0 || count < 1 {
+		return nil, nil
+	}
+	var hits []userHit
+	for uid, user := range m.users {
+		if ok, exact := query.match(userTerms(user.Login, user.Name)); ok {
+			hits = append(hits, userHit{uid: uid, login: user.Login,
+				followers: user.Followers, exact: exact})
+		}
+	}
+	return rankUsers(hits, count), nil
+}
+
+// returns an empty user if uid does not exist, like HGETALL would
+func (m *MemoryDB) GetUser(uid int) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var user User
+	if u, ok := m.users[uid]; ok {
+		user = *u
+	}
+	return &user, nil
+}
+
+/********************************************
+*************** Status code ****************/
+
+func (m *MemoryDB) GetStatus(sid int) (Status, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var status Status
+	if s, ok := m.statuses[sid]; ok {
+		status = *s
+	}
+	return status, nil
+}
+
+// statuses in the order of ids, ids that do not exist are in missing
+func (m *MemoryDB) GetStatuses(ids []int) ([]Status, []int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(ids))
+	var missing []int
+	for _, sid := range ids {
+		if s, ok := m.statuses[sid]; ok {
+			statuses = append(statuses, *s)
+		} else {
+			missing = append(missing, sid)
+		}
+	}
+	return statuses, missing, nil
+}
+
+// creates the status and pushes it to the author's and followers' timelines
+func (m *MemoryDB) PostStatus(uid int, message string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.postStatus(uid, message), nil
+}
+
+func (m *MemoryDB) postStatus(uid int, message string) int {
+	m.statusID++
+	sid := m.statusID
+	posted := time.Now().Unix()
+
+	status := &Status{Message: message, Posted: posted, Id: sid, Uid: uid,
+		Entities: m.entities(message)}
+	if user, ok := m.users[uid]; ok {
+		status.Login = user.Login
+		user.Posts++
+	}
+	m.statuses[sid] = status
+	m.indexEntities(status)
+	m.countTrends(status.Entities.tags(), posted)
+	for _, mentioned := range status.Entities.mentioned(uid) {
+		m.notify(mentioned, NotifyMention, sid, uid)
+	}
+
+	zset(m.timelines, uid)[sid] = posted
+	zset(m.posts, uid)[sid] = posted
+	for follower := range m.followers[uid] {
+		zset(m.timelines, follower)[sid] = posted
+	}
+	return sid
+}
+
+// posts the status and adds it to the thread of parent
+func (m *MemoryDB) PostReply(uid, parent int, message string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.statuses[parent]
+	if !ok {
+		return -1, ErrNotFound
+	}
+	root := p.Root
+	if root == 0 {
+		root = parent
+	}
+	sid := m.postStatus(uid, message)
+	status := m.statuses[sid]
+	status.InReplyTo, status.Root = parent, root
+	zset(m.replies, parent)[sid] = status.Posted
+	zset(m.conversations, root)[sid] = status.Posted
+	p.Replies++
+	m.notify(p.Uid, NotifyReply, parent, uid)
+	return sid, nil
+}
+
+func (m *MemoryDB) Conversation(sid int) (Conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status, ok := m.statuses[sid]
+	if !ok {
+		return Conversation{}, ErrNotFound
+	}
+	root := status.Root
+	if root == 0 {
+		root = sid
+	}
+	var thread []Status
+	if s, ok := m.statuses[root]; ok {
+		thread = append(thread, *s)
+	}
+	for id := range m.conversations[root] {
+		if s, ok := m.statuses[id]; ok {
+			thread = append(thread, *s)
+		}
+	}
+	return buildConversation(*status, thread), nil
+}
+
+// takes a reply out of its thread, the status must still exist
+func (m *MemoryDB) unthread(sid int) {
+	status := m.statuses[sid]
+	if status == nil || status.InReplyTo == 0 {
+		return
+	}
+	if _, ok := m.replies[status.InReplyTo][sid]; ok {
+		delete(m.replies[status.InReplyTo], sid)
+		if p, ok := m.statuses[status.InReplyTo]; ok {
+			p.Replies--
+		}
+	}
+	delete(m.conversations[status.Root], sid)
+}
+
+// removes the status from every timeline, MemoryDB needs no tombstone
+func (m *MemoryDB) DeleteStatus(uid, sid int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status, ok := m.statuses[sid]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if status.Uid != uid {
+		return false, ErrNotOwner
+	}
+	m.unthread(sid)
+	m.unindexEntities(sid)
+	m.unreshareStatus(sid)
+	m.unlikeStatus(sid)
+	delete(m.statuses, sid)
+	delete(m.revisions, sid)
+	delete(m.posts[uid], sid)
+	delete(m.timelines[uid], sid)
+	for follower := range m.followers[uid] {
+		delete(m.timelines[follower], sid)
+	}
+	if user, ok := m.users[uid]; ok {
+		user.Posts--
+	}
+	return true, nil
+}
+
+// replaces the message, MemoryDB has no edit window
+func (m *MemoryDB) EditStatus(uid, sid int, message string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status, ok := m.statuses[sid]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if status.Uid != uid {
+		return false, ErrNotOwner
+	}
+	written := status.Edited
+	if written == 0 {
+		written = status.Posted
+	}
+	m.revisions[sid] = append(m.revisions[sid],
+		Revision{Message: status.Message, At: written})
+	m.unindexEntities(sid)
+	status.Entities = m.entities(message)
+	m.indexEntities(status)
+	status.Message = message
+	status.Edited = time.Now().Unix()
+	status.Revisions++
+	return true, nil
+}
+
+// every message of the status, oldest first
+func (m *MemoryDB) StatusHistory(sid int) ([]Revision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status, ok := m.statuses[sid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	history := append([]Revision{}, m.revisions[sid]...)
+	at := status.Edited
+	if at == 0 {
+		at = status.Posted
+	}
+	return append(history, Revision{Message: status.Message, At: at}), nil
+}
+
+// pushes the status to the followers of uid that do not have it
+func (m *MemoryDB) Reshare(uid, sid int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status, ok := m.statuses[sid]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if status.Uid == uid {
+		return false, ErrOwnStatus
+	}
+	if _, ok := m.resharers[sid][uid]; ok {
+		return false, nil
+	}
+	now := time.Now().Unix()
+	zset(m.resharers, sid)[uid] = now
+	zset(m.reshares, uid)[sid] = now
+	status.Reshares++
+	for follower := range m.followers[uid] {
+		timeline := zset(m.timelines, follower)
+		if _, ok := timeline[sid]; ok {
+			continue
+		}
+		timeline[sid] = now
+		if m.via[follower] == nil {
+			m.via[follower] = make(map[int]int)
+		}
+		m.via[follower][sid] = uid
+	}
+	m.notify(status.Uid, NotifyReshare, sid, uid)
+	return true, nil
+}
+
+func (m *MemoryDB) Unreshare(uid, sid int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.unreshare(uid, sid), nil
+}
+
+func (m *MemoryDB) ResharedBy(uid int, sids []int) (map[int]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	via := make(map[int]int)
+	for _, sid := range sids {
+		if resharer, ok := m.via[uid][sid]; ok {
+			via[sid] = resharer
+		}
+	}
+	return via, nil
+}
+
+// takes a reshare back from the followers that got the status through it
+func (m *MemoryDB) unreshare(uid, sid int) bool {
+	if _, ok := m.resharers[sid][uid]; !ok {
+		return false
+	}
+	delete(m.resharers[sid], uid)
+	delete(m.reshares[uid], sid)
+	author := 0
+	if status, ok := m.statuses[sid]; ok {
+		status.Reshares--
+		author = status.Uid
+	}
+	for follower := range m.followers[uid] {
+		if m.via[follower][sid] != uid {
+			continue
+		}
+		delete(m.via[follower], sid)
+		if _, ok := m.following[follower][author]; !ok && follower != author {
+			delete(m.timelines[follower], sid)
+		}
+	}
+	return true
+}
+
+// takes back every reshare of a status, the status must still exist
+func (m *MemoryDB) unreshareStatus(sid int) {
+	for resharer := range m.resharers[sid] {
+		m.unreshare(resharer, sid)
+	}
+	delete(m.resharers, sid)
+}
+
+func (m *MemoryDB) Like(uid, sid int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status, ok := m.statuses[sid]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if _, ok := m.likers[sid][uid]; ok {
+		return false, nil
+	}
+	now := time.Now().Unix()
+	zset(m.likers, sid)[uid] = now
+	zset(m.likes, uid)[sid] = now
+	status.Likes++
+	m.notify(status.Uid, NotifyLike, sid, uid)
+	return true, nil
+}
+
+func (m *MemoryDB) Unlike(uid, sid int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.unlike(uid, sid), nil
+}
+
+func (m *MemoryDB) Likers(sid, page, count int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.likers[sid].revRange((page-1)*count, page*count-1), nil
+}
+
+func (m *MemoryDB) Liked(uid, page, count int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.likes[uid].revRange((page-1)*count, page*count-1), nil
+}
+
+func (m *MemoryDB) unlike(uid, sid int) bool {
+	if _, ok := m.likers[sid][uid]; !ok {
+		return false
+	}
+	delete(m.likers[sid], uid)
+	delete(m.likes[uid], sid)
+	if status, ok := m.statuses[sid]; ok {
+		status.Likes--
+	}
+	return true
+}
+
+// drops the likes of a status that is being deleted
+func (m *MemoryDB) unlikeStatus(sid int) {
+	for uid := range m.likers[sid] {
+		delete(m.likes[uid], sid)
+	}
+	delete(m.likers, sid)
+}
+
+func (m *MemoryDB) GetMentions(uid, page, count int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.mentions[uid].revRange((page-1)*count, page*count-1), nil
+}
+
+func (m *MemoryDB) GetTagTimeline(tag string, page, count int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.tags[NormalizeTag(tag)].revRange((page-1)*count, page*count-1), nil
+}
+
+// scans every status, there is no index to keep
+func (m *MemoryDB) Search(q SearchQuery) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := parseQuery(q.Text)
+	if len(t.words) == 0 || q.Page < 1 || q.Count < 1 {
+		return nil, nil
+	}
+	df := make(map[string]int)
+	for _, status := range m.statuses {
+		for _, w := range distinct(words(status.Message)) {
+			df[w]++
+		}
+	}
+	idf := make(map[string]float64)
+	for _, w := range t.words {
+		if df[w] == 0 {
+			return nil, nil
+		}
+		idf[w] = searchIdf(m.statusID, df[w])
+	}
+
+	var hits []searchHit
+	for sid, status := range m.statuses {
+		if (q.Uid != 0 && status.Uid != q.Uid) ||
+			(q.Since > 0 && status.Posted < q.Since) ||
+			(q.Until > 0 && status.Posted > q.Until) {
+			continue
+		}
+		if score, ok := t.match(status.Message, idf); ok {
+			hits = append(hits, searchHit{sid: sid, posted: status.Posted, score: score})
+		}
+	}
+	return pageHits(hits, q), nil
+}
+
+// counts the uses of tags and drops the buckets that left their window,
+// like the redis keys expire
+func (m *MemoryDB) countTrends(tags []string, at int64) {
+	if len(tags) == 0 {
+		return
+	}
+	for _, w := range m.trendWindows {
+		buckets := m.trends[w.Name]
+		if buckets == nil {
+			buckets = make(map[int64]map[string]int)
+			m.trends[w.Name] = buckets
+		}
+		for start := range buckets {
+			if w.expires(start) <= at {
+				delete(buckets, start)
+			}
+		}
+		start := w.bucket(at)
+		if buckets[start] == nil {
+			buckets[start] = make(map[string]int)
+		}
+		for _, tag := range tags {
+			buckets[start][tag]++
+		}
+	}
+}
+
+// SetTrendWindows replaces the windows hashtags are counted and ranked
+// in, like the TrendWindows option of a DB. the counts so far are
+// dropped.
+func (m *MemoryDB) SetTrendWindows(windows ...TrendWindow) error {
+	if err := checkTrendWindows(windows); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.trendWindows = windows
+	m.trends = make(map[string]map[int64]map[string]int)
+	return nil
+}
+
+func (m *MemoryDB) Trending(window string, n int) ([]Trend, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := findTrendWindow(m.trendWindows, window)
+	if !ok {
+		return nil, ErrUnknownWindow
+	}
+	now := time.Now().Unix()
+	starts := w.buckets(now)
+	counts := make([]map[string]int, len(starts))
+	for j, start := range starts {
+		counts[j] = m.trends[w.Name][start]
+	}
+	return rankTrends(w, starts, counts, n, now), nil
+}
+
+// parses a message and resolves its mentions with the logins
+func (m *MemoryDB) entities(message string) *Entities {
+	e := &Entities{Hashtags: parseHashtags(message)}
+	for _, mention := range parseMentions(message) {
+		if uid, ok := m.logins[mention.Login]; ok {
+			mention.Uid = uid
+			e.Mentions = append(e.Mentions, mention)
+		}
+	}
+	if e.empty() {
+		return nil
+	}
+	return e
+}
+
+func (m *MemoryDB) indexEntities(status *Status) {
+	for _, uid := range status.Entities.mentioned(status.Uid) {
+		zset(m.mentions, uid)[status.Id] = status.Posted
+	}
+	for _, tag := range status.Entities.tags() {
+		if m.tags[tag] == nil {
+			m.tags[tag] = make(sortedSet)
+		}
+		m.tags[tag][status.Id] = status.Posted
+	}
+}
+
+func (m *MemoryDB) unindexEntities(sid int) {
+	status := m.statuses[sid]
+	if status == nil {
+		return
+	}
+	for _, uid := range status.Entities.mentioned(status.Uid) {
+		delete(m.mentions[uid], sid)
+	}
+	for _, tag := range status.Entities.tags() {
+		delete(m.tags[tag], sid)
+	}
+}
+
+/*******************************************
+************ Timeline code ****************/
+
+func (m *MemoryDB) GetUserTimeline(uid, page, count int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.timelines[uid].revRange((page-1)*count, page*count-1), nil
+}
+
+/********************************************
+************* Follow code ******************/
+
+// user A follows user B
+func (m *MemoryDB) Follow(uid, otherid int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// already following
+	if _, ok := m.following[uid][otherid]; ok {
+		return true, nil
+	}
+
+	now := time.Now().Unix()
+	zset(m.following, uid)[otherid] = now
+	zset(m.followers, otherid)[uid] = now
+	if user, ok := m.users[uid]; ok {
+		user.Following++
+	}
+	if user, ok := m.users[otherid]; ok {
+		user.Followers++
+	}
+	m.notify(otherid, NotifyFollow, 0, uid)
+	return true, nil
+}
+
+// user A unfollows user B
+func (m *MemoryDB) Unfollow(uid, otherid int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// not following
+	if _, ok := m.following[uid][otherid]; !ok {
+		return true, nil
+	}
+
+	delete(m.following[uid], otherid)
+	delete(m.followers[otherid], uid)
+	if user, ok := m.users[uid]; ok {
+		user.Following--
+	}
+	if user, ok := m.users[otherid]; ok {
+		user.Followers--
+	}
+	return true, nil
+}
+
+/*******************************************
+************ Notification code ************/
+
+// adds an event to its group, like notifyScript
+func (m *MemoryDB) notify(uid int, typ string, object, actor int) {
+	if uid == actor || uid == 0 {
+		return
+	}
+	groups := m.notifications[uid]
+	if groups == nil {
+		groups = make(map[string]*Notification)
+		m.notifications[uid] = groups
+		m.notifiers[uid] = make(map[string]map[int]bool)
+	}
+	group := notifyGroup(typ, object)
+	n, ok := groups[group]
+	if !ok || n.At <= m.notified[uid] {
+		n = &Notification{Type: typ, Object: object}
+		groups[group] = n
+		m.notifiers[uid][group] = make(map[int]bool)
+	}
+	actors := []int{actor}
+	for _, a := range n.Actors {
+		if a != actor && len(actors) < notifyActors {
+			actors = append(actors, a)
+		}
+	}
+	if seen := m.notifiers[uid][group]; !seen[actor] {
+		seen[actor] = true
+		n.Count++
+	}
+	n.Actors = actors
+	n.At = time.Now().Unix()
+
+	if len(groups) > maxNotifications {
+		for _, old := range m.notificationGroups(uid)[maxNotifications:] {
+			delete(groups, old)
+			delete(m.notifiers[uid], old)
+		}
+	}
+}
+
+// the groups of uid, the latest first
+func (m *MemoryDB) notificationGroups(uid int) []string {
+	groups := m.notifications[uid]
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := groups[names[i]], groups[names[j]]
+		if a.At != b.At {
+			return a.At > b.At
+		}
+		return names[i] > names[j]
+	})
+	return names
+}
+
+func (m *MemoryDB) Notifications(uid, page, count int) ([]Notification, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	notifications := []Notification{}
+	names := m.notificationGroups(uid)
+	for j := (page - 1) * count; j >= 0 && j < page*count && j < len(names); j++ {
+		n := *m.notifications[uid][names[j]]
+		n.Unread = n.At > m.notified[uid]
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
+
+func (m *MemoryDB) UnreadNotifications(uid int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unread := 0
+	for _, n := range m.notifications[uid] {
+		if n.At > m.notified[uid] {
+			unread++
+		}
+	}
+	return unread, nil
+}
+
+func (m *MemoryDB) MarkNotificationsRead(uid int, upTo int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if upTo == 0 {
+		upTo = time.Now().Unix()
+	}
+	if upTo > m.notified[uid] {
+		m.notified[uid] = upTo
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+package myredisDB
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+ * Tests creating and deleting a user in memory
+ */
+func TestMemoryUser(t *testing.T) {
+	db := NewMemoryDB()
+
+	uid, err := db.CreateUser("TestUser", "testy")
+	if err != nil || uid == -1 {
+		t.Fatalf("new user not created. uid: %v err: %v\n", uid, err)
+	}
+	// a taken username is refused
+	if dup, _ := db.CreateUser("TestUser", "other"); dup != -1 {
+		t.Errorf("duplicate login created uid: %v\n", dup)
+	}
+
+	user, err := db.GetUser(uid)
+	if err != nil {
+		t.Error("recieved error while getting user: ", err)
+	}
+	if user.Id != uid || user.Login != "TestUser" || user.Name != "testy" {
+		t.Errorf("unexpected user %+v\n", user)
+	}
+
+	if r, err := db.DeleteUser(uid); r != true || err != nil {
+		t.Error("error deleting user: ", err)
+	}
+	if user, _ := db.GetUser(uid); user.Id != 0 {
+		t.Errorf("user still exists after delete %+v\n", user)
+	}
+	// the login is free again
+	if uid, _ := db.CreateUser("TestUser", "testy"); uid == -1 {
+		t.Error("login not released by delete")
+	}
+
+	// statuses and edges go with the user
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	db.Follow(a, b)
+	sid, _ := db.PostStatus(b, "gone")
+	db.DeleteUser(b)
+	if tl, _ := db.GetUserTimeline(a, 1, 30); len(tl) != 0 {
+		t.Errorf("timeline:%v == %v\n", a, tl)
+	}
+	if status, _ := db.GetStatus(sid); status.Id != 0 {
+		t.Errorf("status still exists %+v\n", status)
+	}
+	if user, _ := db.GetUser(a); user.Following != 0 {
+		t.Errorf("a.Following == %v\n", user.Following)
+	}
+}
+
+// tests follow counters and posting to the follower's timeline
+func TestMemoryFollowPost(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+
+	if res, err := db.Follow(a, b); res == false || err != nil {
+		t.Error("error a following b ", err)
+	}
+	// following twice must not count twice
+	db.Follow(a, b)
+
+	if user, _ := db.GetUser(a); user.Following != 1 {
+		t.Errorf("a.Following == %v\n", user.Following)
+	}
+	if user, _ := db.GetUser(b); user.Followers != 1 {
+		t.Errorf("b.Followers == %v\n", user.Followers)
+	}
+
+	sid, err := db.PostStatus(b, "this is a post")
+	if sid == -1 || err != nil {
+		t.Error("error posting status ", err)
+	}
+	status, _ := db.GetStatus(sid)
+	if status.Uid != b || status.Login != "b" || status.Message != "this is a post" {
+		t.Errorf("unexpected status %+v\n", status)
+	}
+	if user, _ := db.GetUser(b); user.Posts != 1 {
+		t.Errorf("b.Posts == %v\n", user.Posts)
+	}
+
+	for _, uid := range []int{a, b} {
+		tl, _ := db.GetUserTimeline(uid, 1, 30)
+		if len(tl) != 1 || tl[0] != sid {
+			t.Errorf("timeline:%v == %v\n", uid, tl)
+		}
+	}
+
+	// after unfollowing new posts are not syndicated
+	if res, err := db.Unfollow(a, b); res == false || err != nil {
+		t.Error("error unfollowing ", err)
+	}
+	db.PostStatus(b, "another post")
+	if tl, _ := db.GetUserTimeline(a, 1, 30); len(tl) != 1 {
+		t.Errorf("timeline:%v == %v\n", a, tl)
+	}
+	if user, _ := db.GetUser(a); user.Following != 0 {
+		t.Errorf("a.Following == %v\n", user.Following)
+	}
+}
+
+// newest posts come first and pages do not overlap
+func TestMemoryGetStatuses(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("a", "A")
+	first, _ := db.PostStatus(a, "first")
+	second, _ := db.PostStatus(a, "second")
+
+	statuses, missing, err := db.GetStatuses([]int{second, 99, first})
+	if err != nil || len(statuses) != 2 {
+		t.Fatalf("statuses == %+v, %v\n", statuses, err)
+	}
+	if statuses[0].Id != second || statuses[1].Id != first {
+		t.Errorf("statuses out of order %+v\n", statuses)
+	}
+	if len(missing) != 1 || missing[0] != 99 {
+		t.Errorf("missing == %v\n", missing)
+	}
+}
+
+func TestMemoryDeleteStatus(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	db.Follow(b, a)
+	sid, _ := db.PostStatus(a, "deleted")
+
+	if _, err := db.DeleteStatus(b, sid); err != ErrNotOwner {
+		t.Errorf("delete by b err == %v\n", err)
+	}
+	if res, err := db.DeleteStatus(a, sid); !res || err != nil {
+		t.Error("error deleting status ", err)
+	}
+	if _, err := db.DeleteStatus(a, sid); err != ErrNotFound {
+		t.Errorf("second delete err == %v\n", err)
+	}
+	if tl, _ := db.GetUserTimeline(b, 1, 30); len(tl) != 0 {
+		t.Errorf("timeline:%v == %v\n", b, tl)
+	}
+	if user, _ := db.GetUser(a); user.Posts != 0 {
+		t.Errorf("a.Posts == %v\n", user.Posts)
+	}
+}
+
+func TestMemoryEditStatus(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("a", "A")
+	sid, _ := db.PostStatus(a, "frist")
+
+	if _, err := db.EditStatus(a+1, sid, "mine"); err != ErrNotOwner {
+		t.Errorf("edit by another user err == %v\n", err)
+	}
+	if res, err := db.EditStatus(a, sid, "first"); !res || err != nil {
+		t.Error("error editing status ", err)
+	}
+	if status, _ := db.GetStatus(sid); status.Message != "first" || status.Revisions != 1 {
+		t.Errorf("status == %+v\n", status)
+	}
+	if history, _ := db.StatusHistory(sid); len(history) != 2 || history[0].Message != "frist" {
+		t.Errorf("history == %+v\n", history)
+	}
+}
+
+func TestMemoryConversation(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("a", "A")
+	root, _ := db.PostStatus(a, "root")
+	reply, _ := db.PostReply(a, root, "reply")
+	nested, _ := db.PostReply(a, reply, "nested")
+
+	conv, err := db.Conversation(reply)
+	if err != nil {
+		t.Fatal("error reading conversation ", err)
+	}
+	if len(conv.Ancestors) != 1 || conv.Ancestors[0].Replies != 1 ||
+		len(conv.Replies) != 1 || conv.Replies[0].Id != nested {
+		t.Errorf("conversation == %+v\n", conv)
+	}
+	db.DeleteStatus(a, reply)
+	if status, _ := db.GetStatus(root); status.Replies != 0 {
+		t.Errorf("replies == %d\n", status.Replies)
+	}
+}
+
+func TestMemoryReshare(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	c, _ := db.CreateUser("c", "C")
+	db.Follow(c, b)
+	sid, _ := db.PostStatus(a, "shared")
+
+	if res, err := db.Reshare(b, sid); !res || err != nil {
+		t.Error("error resharing ", err)
+	}
+	if via, _ := db.ResharedBy(c, []int{sid}); via[sid] != b {
+		t.Errorf("via == %v\n", via)
+	}
+	db.Unreshare(b, sid)
+	if tl, _ := db.GetUserTimeline(c, 1, 30); len(tl) != 0 {
+		t.Errorf("timeline == %v\n", tl)
+	}
+	if status, _ := db.GetStatus(sid); status.Reshares != 0 {
+		t.Errorf("reshares == %d\n", status.Reshares)
+	}
+}
+
+func TestMemoryLike(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("a", "A")
+	sid, _ := db.PostStatus(a, "liked")
+
+	if res, _ := db.Like(a, sid); !res {
+		t.Error("like not recorded")
+	}
+	if res, _ := db.Like(a, sid); res {
+		t.Error("liked twice")
+	}
+	if liked, _ := db.Liked(a, 1, 30); len(liked) != 1 || liked[0] != sid {
+		t.Errorf("liked == %v\n", liked)
+	}
+	db.DeleteStatus(a, sid)
+	if liked, _ := db.Liked(a, 1, 30); len(liked) != 0 {
+		t.Errorf("liked after delete == %v\n", liked)
+	}
+}
+
+func TestMemoryMentions(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	sid, _ := db.PostStatus(a, "hi @b")
+
+	if m, _ := db.GetMentions(b, 1, 30); len(m) != 1 || m[0] != sid {
+		t.Errorf("mentions == %v\n", m)
+	}
+	db.DeleteStatus(a, sid)
+	if m, _ := db.GetMentions(b, 1, 30); len(m) != 0 {
+		t.Errorf("mentions after delete == %v\n", m)
+	}
+}
+
+func TestMemoryTagTimeline(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("a", "A")
+	sid, _ := db.PostStatus(a, "hi #There")
+
+	if tl, _ := db.GetTagTimeline("#there", 1, 30); len(tl) != 1 || tl[0] != sid {
+		t.Errorf("tag timeline == %v\n", tl)
+	}
+	db.DeleteStatus(a, sid)
+	if tl, _ := db.GetTagTimeline("there", 1, 30); len(tl) != 0 {
+		t.Errorf("tag timeline after delete == %v\n", tl)
+	}
+}
+
+func TestMemorySearch(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("a", "A")
+	sid, _ := db.PostStatus(a, "Redis fan out")
+	db.PostStatus(a, "out fan")
+
+	if got, _ := db.Search(SearchQuery{Text: `"fan out"`, Page: 1, Count: 30}); len(got) != 1 || got[0] != sid {
+		t.Errorf("search == %v\n", got)
+	}
+	db.DeleteStatus(a, sid)
+	if got, _ := db.Search(SearchQuery{Text: "redis", Page: 1, Count: 30}); len(got) != 0 {
+		t.Errorf("search after delete == %v\n", got)
+	}
+}
+
+func TestMemorySearchUsers(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("slmyers", "Steven Myers")
+	b, _ := db.CreateUser("sly", "Sly Stone")
+	db.Follow(a, b)
+
+	if got, _ := db.SearchUsers("sl", 10); len(got) != 2 || got[0] != b {
+		t.Errorf("search == %v\n", got)
+	}
+	db.UpdateProfile(a, "Steve Smith")
+	if got, _ := db.SearchUsers("smiht", 10); len(got) != 1 || got[0] != a {
+		t.Errorf("search after update == %v\n", got)
+	}
+}
+
+func TestMemoryTrending(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("a", "A")
+	db.PostStatus(a, "#go #redis")
+	db.PostStatus(a, "#redis")
+
+	trends, _ := db.Trending("24h", 10)
+	if len(trends) != 2 || trends[0].Tag != "redis" || trends[0].Count != 2 {
+		t.Errorf("trending == %+v\n", trends)
+	}
+	if _, err := db.Trending("1w", 10); err != ErrUnknownWindow {
+		t.Errorf("unknown window err == %v\n", err)
+	}
+
+	// the windows can be replaced, like with TrendWindows
+	week := TrendWindow{Name: "1w", Length: 7 * 24 * time.Hour, Bucket: 24 * time.Hour}
+	if err := db.SetTrendWindows(week); err != nil {
+		t.Fatal("error setting windows ", err)
+	}
+	db.PostStatus(a, "#go")
+	if trends, err := db.Trending("1w", 10); err != nil || len(trends) != 1 {
+		t.Errorf("weekly trending == %+v, %v\n", trends, err)
+	}
+	if _, err := db.Trending("1h", 10); err != ErrUnknownWindow {
+		t.Errorf("replaced window err == %v\n", err)
+	}
+	if err := db.SetTrendWindows(TrendWindow{Name: "0", Bucket: 0}); err == nil {
+		t.Error("a window without buckets was accepted")
+	}
+}
+
+func TestMemoryNotifications(t *testing.T) {
+	db := NewMemoryDB()
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	c, _ := db.CreateUser("c", "C")
+	sid, _ := db.PostStatus(a, "hello")
+	db.Follow(b, a)
+	db.Follow(c, a)
+	db.Like(b, sid)
+	db.Like(a, sid)
+
+	ns, _ := db.Notifications(a, 1, 30)
+	if len(ns) != 2 {
+		t.Fatalf("notifications == %+v\n", ns)
+	}
+	if follow := findNotification(ns, NotifyFollow, 0); follow == nil || follow.Count != 2 {
+		t.Errorf("follow == %+v\n", follow)
+	}
+	if unread, _ := db.UnreadNotifications(a); unread != 2 {
+		t.Errorf("unread == %d\n", unread)
+	}
+	// an actor who dropped out of the kept actors is not counted again
+	for actor := 10; actor < 10+notifyActors+2; actor++ {
+		db.notify(a, NotifyLike, 99, actor)
+	}
+	db.notify(a, NotifyLike, 99, 10)
+	ns, _ = db.Notifications(a, 1, 30)
+	if like := findNotification(ns, NotifyLike, 99); like == nil ||
+		like.Count != notifyActors+2 || like.Actors[0] != 10 {
+		t.Errorf("like == %+v\n", like)
+	}
+	db.MarkNotificationsRead(a, 0)
+	if unread, _ := db.UnreadNotifications(a); unread != 0 {
+		t.Errorf("unread after read == %d\n", unread)
+	}
+}
+
+func TestMemoryTimelinePages(t *testing.T) {
+	db := NewMemoryDB()
+	uid, _ := db.CreateUser("a", "A")
+
+	var sids []int
+	for i := 0; i < 7; i++ {
+		sid, _ := db.PostStatus(uid, "post")
+		sids = append(sids, sid)
+	}
+
+	var seen []int
+	for page := 1; page <= 3; page++ {
+		tl, _ := db.GetUserTimeline(uid, page, 3)
+		seen = append(seen, tl...)
+	}
+	if len(seen) != len(sids) {
+		t.Fatalf("paged timeline == %v\n", seen)
+	}
+	// all posts share a second, so ties are broken like redis would
+	for i := 1; i < len(seen); i++ {
+		if seen[i-1] == seen[i] {
+			t.Errorf("duplicate entry in timeline %v\n", seen)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package myredisDB
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+)
+
+/*
+ * key schema migrations
+ *
+ * schema:version holds the version of the key layout the data is in.
+ * every migration brings it up by one: it SCANs the keys it cares about
+ * in batches and rewrites them. after each batch the node and cursor are
+ * saved in the schema:progress hash, so an interrupted migration resumes
+ * where it stopped. SCAN may return a key twice, so every step has to be
+ * safe to apply again. schema:lock keeps two servers from migrating at
+ * the same time. a new store is in the latest layout: the first user
+ * sets schema:version, and a store without users or statuses counts as
+ * current before that.
+ */
+
+const (
+	// keys handed to a migration at once
+	migrateBatch = 1000
+	// seconds the lock is held without progress
+	migrateLockTTL = 60
+)
+
+var ErrMigrationRunning = errors.New("myredisDB: another migration is running")
+
+// Migration is one step of the key schema
+type Migration struct {
+	Version int
+	Name    string
+	// glob of the keys passed to apply, without the namespace
+	match string
+	// apply rewrites keys and returns how many it changed, with dryRun
+	// it only counts the keys that would change
+	apply func(db *DB, c redis.Conn, keys []string, dryRun bool) (int, error)
+}
+
+// migrations in the order they are applied, Version is the index + 1
+var migrations = []Migration{
+	{Version: 1, Name: "index authored statuses in posts:N",
+		match: "status:*", apply: indexPosts},
+	{Version: 2, Name: "add missing user counters",
+		match: "user:*", apply: userCounters},
+}
+
+// LatestSchema is the version a fully migrated DB is in
+var LatestSchema = len(migrations)
+
+// MigrateOptions select what Migrate does
+type MigrateOptions struct {
+	// version to migrate to, 0 is LatestSchema
+	To int
+	// count the keys that would change without writing anything
+	DryRun bool
+	// keys rewritten per step, 0 uses the default
+	Batch int
+	// called after every batch with the totals of the running step
+	Progress func(MigrationResult)
+}
+
+// MigrationResult tells what one step did
+type MigrationResult struct {
+	Version int
+	Name    string
+	Scanned int
+	Changed int
+}
+
+// Migrations lists every step of the key schema
+func Migrations() []Migration {
+	return append([]Migration(nil), migrations...)
+}
+
+// SchemaVersion returns the version of the stored data, 0 before the
+// first migration. a store without users or statuses is current, the
+// first user sets the version
+func (db *DB) SchemaVersion() (int, error) {
+	c := db.Get()
+	defer c.Close()
+
+	v, err := redis.Int(c.Do("GET", db.key("schema:version")))
+	if err != redis.ErrNil {
+		return v, err
+	}
+	// separate commands, the counters may be in different slots
+	c.Send("EXISTS", db.key("user:id"))
+	c.Send("EXISTS", db.key("status:id"))
+	r, err := redis.Ints(c.Do(""))
+	if err != nil {
+		return 0, err
+	}
+	if r[0] == 0 && r[1] == 0 {
+		return LatestSchema, nil
+	}
+	return 0, nil
+}
+
+// Migrate applies the migrations after the stored version up to o.To
+func (db *DB) Migrate(o MigrateOptions) ([]MigrationResult, error) {
+	if o.To == 0 {
+		o.To = LatestSchema
+	}
+	if o.To > LatestSchema {
+		return nil, fmt.Errorf("myredisDB: no schema version %d, the latest is %d",
+			o.To, LatestSchema)
+	}
+	if o.Batch <= 0 {
+		o.Batch = migrateBatch
+	}
+
+	c := db.Get()
+	defer c.Close()
+
+	// a dry run does not write, it does not need the lock
+	if !o.DryRun {
+		_, err := redis.String(c.Do("SET", db.key("schema:lock"), "1",
+			"NX", "EX", migrateLockTTL))
+		if err == redis.ErrNil {
+			return nil, ErrMigrationRunning
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer c.Do("DEL", db.key("schema:lock"))
+	}
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if o.To < version {
+		return nil, fmt.Errorf("myredisDB: can not migrate down from %d to %d",
+			version, o.To)
+	}
+
+	var results []MigrationResult
+	for _, m := range migrations[version:o.To] {
+		res, err := db.migrate(c, m, o)
+		results = append(results, res)
+		if err != nil {
+			return results, fmt.Errorf("myredisDB: migration %d: %v",
+				m.Version, err)
+		}
+		if o.DryRun {
+			continue
+		}
+		c.Send("MULTI")
+		c.Send("SET", db.key("schema:version"), m.Version)
+		c.Send("DEL", db.key("schema:progress"))
+		if _, err := c.Do("EXEC"); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// migrate runs one step over every node, from the saved progress
+func (db *DB) migrate(c redis.Conn, m Migration, o MigrateOptions) (MigrationResult, error) {
+	res := MigrationResult{Version: m.Version, Name: m.Name}
+	nodes, err := db.nodes()
+	if err != nil {
+		return res, err
+	}
+
+	// resume on the node and cursor the last run of this step saved
+	start, cursor := 0, 0
+	if !o.DryRun {
+		saved, err := redis.StringMap(c.Do("HGETALL", db.key("schema:progress")))
+		if err != nil {
+			return res, err
+		}
+		if saved["version"] == strconv.Itoa(m.Version) {
+			for j, addr := range nodes {
+				if addr == saved["node"] {
+					start = j
+					cursor, _ = strconv.Atoi(saved["cursor"])
+				}
+			}
+		}
+	}
+
+	pattern := globEscape(db.namespace) + m.match
+	for j := start; j < len(nodes); j++ {
+		node := db.node(nodes[j])
+		for {
+			r, err := redis.Values(node.Do("SCAN", cursor, "MATCH", pattern,
+				"COUNT", o.Batch))
+			if err != nil {
+				node.Close()
+				return res, err
+			}
+			var keys []string
+			if _, err := redis.Scan(r, &cursor, &keys); err != nil {
+				node.Close()
+				return res, err
+			}
+
+			if len(keys) > 0 {
+				n, err := m.apply(db, c, keys, o.DryRun)
+				if err != nil {
+					node.Close()
+					return res, err
+				}
+				res.Scanned += len(keys)
+				res.Changed += n
+			}
+			if !o.DryRun {
+				// a finished node resumes on the next one
+				at := nodes[j]
+				if cursor == 0 && j+1 < len(nodes) {
+					at = nodes[j+1]
+				}
+				c.Send("HMSET", db.key("schema:progress"), "version",
+					m.Version, "node", at, "cursor", cursor)
+				c.Send("EXPIRE", db.key("schema:lock"), migrateLockTTL)
+				if _, err := c.Do(""); err != nil {
+					node.Close()
+					return res, err
+				}
+			}
+			if o.Progress != nil {
+				o.Progress(res)
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+		node.Close()
+	}
+	return res, nil
+}
+
+// nodes lists the address of every node holding data
+func (db *DB) nodes() ([]string, error) {
+	if db.cluster == nil {
+		return []string{db.options.Addr}, nil
+	}
+	return db.cluster.masters()
+}
+
+// node returns a connection to one of the nodes, for SCAN
+func (db *DB) node(addr string) redis.Conn {
+	if db.cluster == nil {
+		return db.Get()
+	}
+	return db.cluster.pool(addr).Get()
+}
+
+// keyID returns the id of a per user or per status key, eg. 7 for
+// "status:7" or "status:{7}", ok is false for keys like "status:id"
+func (db *DB) keyID(prefix, key string) (int, bool) {
+	s := strings.TrimPrefix(key, db.key(prefix))
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	id, err := strconv.Atoi(s)
+	return id, err == nil
+}
+
+/*********************************************
+************ Migrations *********************/
+
+// 1: statuses written before posts:N existed are added to it
+func indexPosts(db *DB, c redis.Conn, keys []string, dryRun bool) (int, error) {
+	var sids []int
+	for _, key := range keys {
+		if sid, ok := db.keyID("status:", key); ok {
+			sids = append(sids, sid)
+			c.Send("HMGET", key, "uid", "posted")
+		}
+	}
+	if len(sids) == 0 {
+		return 0, nil
+	}
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for j, sid := range sids {
+		var uid int
+		var posted int64
+		fields, _ := redis.Values(r[j], nil)
+		// a status hash without an author or time is left alone
+		if len(fields) != 2 || fields[0] == nil || fields[1] == nil {
+			continue
+		}
+		if _, err := redis.Scan(fields, &uid, &posted); err != nil {
+			continue
+		}
+		posts := db.idKey("posts:", uid)
+		if dryRun {
+			c.Send("ZSCORE", posts, sid)
+		} else {
+			c.Send("ZADD", posts, posted, sid)
+		}
+		sent++
+	}
+	if sent == 0 {
+		return 0, nil
+	}
+	r, err = redis.Values(c.Do(""))
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, v := range r {
+		// ZSCORE of a missing member is nil, ZADD of a new one 1
+		if n, _ := redis.Int(v, nil); v == nil || (!dryRun && n == 1) {
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// 2: user hashes get the followers, following and posts counters they
+// are missing
+func userCounters(db *DB, c redis.Conn, keys []string, dryRun bool) (int, error) {
+	counters := []string{"followers", "following", "posts"}
+	var uids []int
+	for _, key := range keys {
+		uid, ok := db.keyID("user:", key)
+		if !ok {
+			continue
+		}
+		uids = append(uids, uid)
+		for _, field := range counters {
+			if dryRun {
+				c.Send("HEXISTS", key, field)
+			} else {
+				c.Send("HSETNX", key, field, 0)
+			}
+		}
+	}
+	if len(uids) == 0 {
+		return 0, nil
+	}
+	r, err := redis.Ints(c.Do(""))
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	var cached []string
+	for j, uid := range uids {
+		for _, n := range r[j*len(counters) : (j+1)*len(counters)] {
+			// HEXISTS 0 for a missing field, HSETNX 1 when it set it
+			if (dryRun && n == 0) || (!dryRun && n == 1) {
+				changed++
+				cached = append(cached, userCacheKey(uid))
+				break
+			}
+		}
+	}
+	if !dryRun && len(cached) > 0 {
+		db.invalidate(c, cached...)
+	}
+	return changed, nil
+}
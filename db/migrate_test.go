@@ -0,0 +1,115 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+// tests migrating data written before posts:N and the user counters
+func TestMigrate(t *testing.T) {
+	db := newTestDB(t, "migrate")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	// a new store is current and stays so
+	if v, err := db.SchemaVersion(); v != LatestSchema || err != nil {
+		t.Fatalf("version of an empty store == %d, %v\n", v, err)
+	}
+
+	uid, _ := db.CreateUser("migrate", "Migrate")
+	var sids []int
+	for _, msg := range []string{"one", "two"} {
+		sid, _ := db.PostStatus(uid, msg)
+		sids = append(sids, sid)
+	}
+	if v, err := db.SchemaVersion(); v != LatestSchema || err != nil {
+		t.Fatalf("version of a new store == %d, %v\n", v, err)
+	}
+
+	// the layout of schema version 0
+	c.Do("DEL", db.key("schema:version"))
+	c.Do("DEL", db.idKey("posts:", uid))
+	c.Do("HDEL", db.idKey("user:", uid), "posts", "followers")
+
+	if v, err := db.SchemaVersion(); v != 0 || err != nil {
+		t.Fatalf("version == %d, %v\n", v, err)
+	}
+
+	// a dry run counts without writing
+	results, err := db.Migrate(MigrateOptions{DryRun: true, Batch: 1})
+	if err != nil || len(results) != LatestSchema {
+		t.Fatalf("dry run == %+v, %v\n", results, err)
+	}
+	if results[0].Changed != 2 || results[1].Changed != 1 {
+		t.Errorf("dry run == %+v\n", results)
+	}
+	if v, _ := db.SchemaVersion(); v != 0 {
+		t.Errorf("dry run set version %d\n", v)
+	}
+	if n, _ := redis.Int(c.Do("ZCARD", db.idKey("posts:", uid))); n != 0 {
+		t.Errorf("dry run wrote %d posts\n", n)
+	}
+
+	// one step at a time
+	if results, err = db.Migrate(MigrateOptions{To: 1}); err != nil ||
+		len(results) != 1 || results[0].Changed != 2 {
+		t.Fatalf("migrate to 1 == %+v, %v\n", results, err)
+	}
+	if v, _ := db.SchemaVersion(); v != 1 {
+		t.Errorf("version == %d\n", v)
+	}
+	posts, _ := redis.Ints(c.Do("ZREVRANGE", db.idKey("posts:", uid), 0, -1))
+	if len(posts) != 2 || posts[0] != sids[1] || posts[1] != sids[0] {
+		t.Errorf("posts == %v\n", posts)
+	}
+
+	if results, err = db.Migrate(MigrateOptions{}); err != nil ||
+		len(results) != 1 || results[0].Changed != 1 {
+		t.Fatalf("migrate == %+v, %v\n", results, err)
+	}
+	if user, _ := db.GetUser(uid); user.Login != "migrate" || user.Posts != 0 {
+		t.Errorf("user == %+v\n", user)
+	}
+	if n, _ := redis.Int(c.Do("EXISTS", db.key("schema:progress"))); n != 0 {
+		t.Error("schema:progress was left behind")
+	}
+
+	// nothing left to do, and no way down
+	if results, err = db.Migrate(MigrateOptions{}); err != nil || len(results) != 0 {
+		t.Errorf("second migrate == %+v, %v\n", results, err)
+	}
+	if _, err = db.Migrate(MigrateOptions{To: 1}); err == nil {
+		t.Error("migrated down")
+	}
+
+	// a running migration holds the lock
+	c.Do("SET", db.key("schema:lock"), "1")
+	if _, err = db.Migrate(MigrateOptions{}); err != ErrMigrationRunning {
+		t.Errorf("err == %v\n", err)
+	}
+}
+
+// tests that the progress of a step is saved after every batch
+func TestMigrateProgress(t *testing.T) {
+	db := newTestDB(t, "progress")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	for j := 0; j < 5; j++ {
+		db.PostStatus(-1, "status")
+	}
+	batches := 0
+	_, err := db.Migrate(MigrateOptions{To: 1, Batch: 2,
+		Progress: func(r MigrationResult) {
+			batches++
+			saved, _ := redis.StringMap(c.Do("HGETALL", db.key("schema:progress")))
+			if saved["version"] != "1" || saved["node"] == "" {
+				t.Errorf("progress == %v\n", saved)
+			}
+		}})
+	if err != nil || batches == 0 {
+		t.Errorf("migrate == %d batches, %v\n", batches, err)
+	}
+}
@@ -16,4 +16,23 @@ type Status struct {
 	Id      int    `redis:"id" json:"id"`
 	Uid     int    `redis:"uid" json:"uid"`
 	Login   string `redis:"login" json:"login"`
+	// the status this one answers and the one that started the
+	// conversation, 0 if it is not a reply
+	InReplyTo int `redis:"in_reply_to" json:"in_reply_to,omitempty"`
+	Root      int `redis:"root" json:"root,omitempty"`
+	// direct replies
+	Replies int `redis:"replies" json:"replies"`
+	// mentions in the message, RawEntities is how they are stored
+	Entities    *Entities `redis:"-" json:"entities,omitempty"`
+	RawEntities string    `redis:"entities" json:"-"`
+	// users who reshared and liked the status
+	Reshares int `redis:"reshares" json:"reshares"`
+	Likes    int `redis:"likes" json:"likes"`
+	// who reshared it into the timeline it was read from, see ResharedBy
+	ResharedBy int `redis:"-" json:"reshared_by,omitempty"`
+	// when the message was last edited and how often, 0 if never
+	Edited    int64 `redis:"edited" json:"edited,omitempty"`
+	Revisions int   `redis:"revisions" json:"revisions,omitempty"`
+	// set on the tombstone DeleteStatus leaves behind
+	Deleted int64 `redis:"deleted" json:"-"`
 }
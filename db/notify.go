@@ -0,0 +1,159 @@
+package myredisDB
+
+import (
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"time"
+)
+
+/*
+ * notifications
+ *
+ * Follow, PostStatus, PostReply, Like and Reshare notify the user they
+ * concern. events of the same type about the same status, or every
+ * follow, are grouped, so a user reads "5 people liked your status"
+ * instead of five notifications:
+ *
+ *   notifications:<uid>  zset of group -> time of its latest event
+ *   notices:<uid>        hash of group -> JSON of the Notification
+ *   notified:<uid>       unix time the user read up to
+ *   notifiers:<uid>      hash of group -> JSON object of every actor
+ *
+ * a group whose latest event was read starts over with the next one.
+ * only the newest maxNotifications groups are kept, each showing its
+ * latest notifyActors actors and counting every actor once. the keys
+ * of a user share a slot.
+ */
+
+const (
+	// groups kept per user
+	maxNotifications = 200
+	// actors kept per group
+	notifyActors = 10
+)
+
+// types of notification
+const (
+	NotifyFollow  = "follow"
+	NotifyMention = "mention"
+	NotifyReply   = "reply"
+	NotifyLike    = "like"
+	NotifyReshare = "reshare"
+)
+
+// Notification is a group of events of one type about one status
+type Notification struct {
+	Type string `json:"type"`
+	// the status the events are about, the status answered for a reply
+	// and 0 for a follow
+	Object int `json:"object,omitempty"`
+	// the latest actors first, at most notifyActors
+	Actors []int `json:"actors"`
+	// actors in the group
+	Count int `json:"count"`
+	// time of the latest event
+	At     int64 `json:"at"`
+	Unread bool  `json:"unread"`
+}
+
+// notifyGroup returns the group an event belongs to
+func notifyGroup(typ string, object int) string {
+	if typ == NotifyFollow {
+		return typ
+	}
+	return typ + ":" + strconv.Itoa(object)
+}
+
+// notify records that actor did typ to uid, or to uid's status object.
+// nobody is notified of what they did themselves.
+func (db *DB) notify(c redis.Conn, uid int, typ string, object, actor int) error {
+	if uid == actor || uid == 0 {
+		return nil
+	}
+	keys := []string{db.idKey("notifications:", uid), db.idKey("notices:", uid),
+		db.idKey("notified:", uid), db.idKey("notifiers:", uid)}
+	_, err := notifyScript.run(c, keys, notifyGroup(typ, object), typ, object,
+		actor, time.Now().Unix(), maxNotifications, notifyActors)
+	return err
+}
+
+// notifyAuthor notifies the author of sid
+func (db *DB) notifyAuthor(c redis.Conn, sid int, typ string, actor int) error {
+	author, err := redis.Int(c.Do("HGET", db.idKey("status:", sid), "uid"))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return db.notify(c, author, typ, sid, actor)
+}
+
+// Notifications returns a page of the notifications of uid, the latest
+// first
+func (db *DB) Notifications(uid, page, count int) ([]Notification, error) {
+	c := db.Get()
+	defer c.Close()
+
+	c.Send("ZREVRANGE", db.idKey("notifications:", uid), (page-1)*count, page*count-1)
+	c.Send("GET", db.idKey("notified:", uid))
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	groups, err := redis.Strings(r[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	read, _ := redis.Int64(r[1], nil)
+	notifications := []Notification{}
+	if len(groups) == 0 {
+		return notifications, nil
+	}
+
+	raw, err := redis.Strings(c.Do("HMGET", redis.Args{}.Add(db.idKey("notices:", uid)).AddFlat(groups)...))
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range raw {
+		// dropped by a newer event since the ZREVRANGE
+		if s == "" {
+			continue
+		}
+		var n Notification
+		if err := json.Unmarshal([]byte(s), &n); err != nil {
+			return nil, err
+		}
+		n.Unread = n.At > read
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
+
+// UnreadNotifications counts the notifications of uid that were not read
+func (db *DB) UnreadNotifications(uid int) (int, error) {
+	c := db.Get()
+	defer c.Close()
+
+	read, err := redis.Int64(c.Do("GET", db.idKey("notified:", uid)))
+	if err != nil && err != redis.ErrNil {
+		return 0, err
+	}
+	return redis.Int(c.Do("ZCOUNT", db.idKey("notifications:", uid),
+		"("+strconv.FormatInt(read, 10), "+inf"))
+}
+
+// MarkNotificationsRead marks the notifications of uid up to the unix
+// time upTo as read, 0 marks all of them. notifications that were read
+// stay read.
+func (db *DB) MarkNotificationsRead(uid int, upTo int64) error {
+	if upTo == 0 {
+		upTo = time.Now().Unix()
+	}
+	c := db.Get()
+	defer c.Close()
+
+	_, err := markReadScript.run(c, []string{db.idKey("notified:", uid)}, upTo)
+	return err
+}
@@ -0,0 +1,134 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+	"time"
+)
+
+// findNotification returns the notification of type typ about object
+func findNotification(ns []Notification, typ string, object int) *Notification {
+	for j := range ns {
+		if ns[j].Type == typ && ns[j].Object == object {
+			return &ns[j]
+		}
+	}
+	return nil
+}
+
+// tests that events are grouped, counted as unread until they are read
+// and that a group read starts over
+func TestNotifications(t *testing.T) {
+	db := newTestDB(t, "notify")
+	defer db.DropNamespace()
+
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	c, _ := db.CreateUser("c", "C")
+	sid, _ := db.PostStatus(a, "hello")
+
+	db.Follow(b, a)
+	db.Follow(c, a)
+	db.Like(b, sid)
+	db.Like(c, sid)
+	db.Like(a, sid)
+	db.Reshare(b, sid)
+	db.PostReply(c, sid, "hi")
+	db.PostStatus(b, "hey @a and @b")
+
+	ns, err := db.Notifications(a, 1, 30)
+	if err != nil || len(ns) != 5 {
+		t.Fatalf("notifications == %+v, %v\n", ns, err)
+	}
+	follow := findNotification(ns, NotifyFollow, 0)
+	if follow == nil || follow.Count != 2 || len(follow.Actors) != 2 ||
+		follow.Actors[0] != c || !follow.Unread {
+		t.Errorf("follow == %+v\n", follow)
+	}
+	// liking your own status is no news
+	if like := findNotification(ns, NotifyLike, sid); like == nil || like.Count != 2 {
+		t.Errorf("like == %+v\n", like)
+	}
+	if reshare := findNotification(ns, NotifyReshare, sid); reshare == nil || reshare.Actors[0] != b {
+		t.Errorf("reshare == %+v\n", reshare)
+	}
+	if reply := findNotification(ns, NotifyReply, sid); reply == nil || reply.Actors[0] != c {
+		t.Errorf("reply == %+v\n", reply)
+	}
+	if ns, _ := db.Notifications(b, 1, 30); len(ns) != 0 {
+		t.Errorf("self mention notified %+v\n", ns)
+	}
+	if unread, _ := db.UnreadNotifications(a); unread != 5 {
+		t.Errorf("unread == %d\n", unread)
+	}
+	if page, _ := db.Notifications(a, 2, 3); len(page) != 2 {
+		t.Errorf("second page == %+v\n", page)
+	}
+
+	// read past this second, so the next follow lands in the read group
+	now := time.Now().Unix()
+	if err := db.MarkNotificationsRead(a, now+1); err != nil {
+		t.Fatal("error marking read ", err)
+	}
+	// reading is never undone
+	db.MarkNotificationsRead(a, now-60)
+	if unread, _ := db.UnreadNotifications(a); unread != 0 {
+		t.Errorf("unread after read == %d\n", unread)
+	}
+	d, _ := db.CreateUser("d", "D")
+	db.Follow(d, a)
+	ns, _ = db.Notifications(a, 1, 30)
+	if follow := findNotification(ns, NotifyFollow, 0); follow == nil ||
+		follow.Count != 1 || follow.Actors[0] != d {
+		t.Errorf("follow after read == %+v\n", follow)
+	}
+
+	db.DeleteUser(a)
+	if ns, _ := db.Notifications(a, 1, 30); len(ns) != 0 {
+		t.Errorf("notifications of a deleted user == %+v\n", ns)
+	}
+	conn := db.Get()
+	defer conn.Close()
+	if n, _ := redis.Int(conn.Do("EXISTS", db.idKey("notifiers:", a))); n != 0 {
+		t.Error("the notifiers of a deleted user are left behind")
+	}
+}
+
+// tests that only the newest groups are kept
+func TestNotificationsCapped(t *testing.T) {
+	db := newTestDB(t, "notifycap")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	for object := 1; object <= maxNotifications+5; object++ {
+		if err := db.notify(c, 1, NotifyLike, object, 2); err != nil {
+			t.Fatal("error notifying ", err)
+		}
+	}
+	if unread, _ := db.UnreadNotifications(1); unread != maxNotifications {
+		t.Errorf("unread == %d\n", unread)
+	}
+	if n, _ := c.Do("HLEN", db.idKey("notices:", 1)); n != int64(maxNotifications) {
+		t.Errorf("notices == %v\n", n)
+	}
+}
+
+// tests that an actor who dropped out of the kept actors is not counted
+// again
+func TestNotificationsDistinct(t *testing.T) {
+	db := newTestDB(t, "notifydistinct")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	for actor := 2; actor <= notifyActors+3; actor++ {
+		db.notify(c, 1, NotifyLike, 7, actor)
+	}
+	db.notify(c, 1, NotifyLike, 7, 2)
+	ns, _ := db.Notifications(1, 1, 30)
+	if len(ns) != 1 || ns[0].Count != notifyActors+2 ||
+		len(ns[0].Actors) != notifyActors || ns[0].Actors[0] != 2 {
+		t.Errorf("notifications == %+v\n", ns)
+	}
+}
@@ -0,0 +1,103 @@
+package myredisDB
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"os"
+	"time"
+)
+
+// Options are the connection settings of a DB
+type Options struct {
+	// host:port of the redis server, or of a seed node with Cluster
+	Addr string
+
+	// sent with AUTH after connecting when Password is set. Username
+	// selects a redis 6 ACL user, the default user is used without it
+	Username string
+	Password string
+	// database index selected after connecting, must be 0 on a cluster
+	Database int
+
+	// 0 waits forever
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// connections kept idle and open at most, per node on a cluster
+	MaxIdle     int
+	MaxActive   int
+	IdleTimeout time.Duration
+
+	// connect with TLS. the server certificate is checked against the
+	// system roots, or the PEM encoded certificates in TLSCAFile
+	TLS           bool
+	TLSCAFile     string
+	TLSServerName string
+	TLSSkipVerify bool
+}
+
+// DefaultOptions are the settings NewDB uses for a local redis server
+func DefaultOptions() Options {
+	return Options{
+		Addr:        "localhost:6379",
+		MaxIdle:     10,
+		IdleTimeout: 240 * time.Second,
+		MaxActive:   1000, // limit to 1000 active users
+	}
+}
+
+// tlsConfig builds the client TLS configuration, nil without TLS
+func (o Options) tlsConfig() (*tls.Config, error) {
+	if !o.TLS {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName:         o.TLSServerName,
+		InsecureSkipVerify: o.TLSSkipVerify,
+	}
+	if o.TLSCAFile != "" {
+		pem, err := os.ReadFile(o.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("myredisDB: no certificates in %s", o.TLSCAFile)
+		}
+	}
+	return config, nil
+}
+
+// dial opens an authenticated connection to addr
+func (o Options) dial(addr string, config *tls.Config) (redis.Conn, error) {
+	c, err := redis.Dial("tcp", addr,
+		redis.DialConnectTimeout(o.DialTimeout),
+		redis.DialReadTimeout(o.ReadTimeout),
+		redis.DialWriteTimeout(o.WriteTimeout),
+		redis.DialUseTLS(config != nil),
+		redis.DialTLSConfig(config))
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Password != "" {
+		args := redis.Args{}
+		if o.Username != "" {
+			args = args.Add(o.Username)
+		}
+		if _, err := c.Do("AUTH", args.Add(o.Password)...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if o.Database != 0 {
+		if _, err := c.Do("SELECT", o.Database); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,200 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"sort"
+)
+
+/*
+ * reply threads
+ *
+ * a reply is a status with in_reply_to, the status it answers, and root,
+ * the status that started the conversation. replies:<sid> holds the
+ * direct replies of a status and conversation:<root> every reply in the
+ * conversation, both scored by posted time. the replies field of a status
+ * counts its direct replies.
+ *
+ * a deleted reply leaves both zsets and is counted down, its tombstone
+ * keeps in_reply_to and root until then. replies to a deleted status stay
+ * in the conversation but are no longer part of the tree.
+ */
+
+// ReplyTree is a reply with the replies to it
+type ReplyTree struct {
+	Status
+	Children []ReplyTree `json:"children,omitempty"`
+}
+
+// Conversation is a status with the statuses it answers and the replies
+// to it
+type Conversation struct {
+	// from the root down to the parent of Status
+	Ancestors []Status `json:"ancestors"`
+	Status    Status   `json:"status"`
+	// oldest first, on every level
+	Replies []ReplyTree `json:"replies"`
+}
+
+// PostReply posts a status of uid in reply to parent. the status is
+// published together with its place in the thread, an error notifying
+// the author of parent is only logged.
+func (db *DB) PostReply(uid, parent int, message string) (int, error) {
+	p, err := db.GetStatus(parent)
+	if err != nil {
+		return -1, err
+	}
+	if p.Id == 0 {
+		return -1, ErrNotFound
+	}
+	root := p.Root
+	if root == 0 {
+		root = parent
+	}
+
+	sid, err := db.postStatus(uid, message, parent, root)
+	if err != nil {
+		return sid, err
+	}
+	c := db.Get()
+	defer c.Close()
+
+	db.invalidate(c, statusCacheKey(parent))
+	if err := db.notify(c, p.Uid, NotifyReply, parent, uid); err != nil {
+		log.Printf("notifying %d of reply %d: %v\n", p.Uid, sid, err)
+	}
+	return sid, nil
+}
+
+// Conversation returns the thread around sid
+func (db *DB) Conversation(sid int) (Conversation, error) {
+	status, err := db.GetStatus(sid)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if status.Id == 0 {
+		return Conversation{}, ErrNotFound
+	}
+	root := status.Root
+	if root == 0 {
+		root = sid
+	}
+
+	c := db.Get()
+	ids, err := redis.Ints(c.Do("ZRANGE", db.idKey("conversation:", root), 0, -1))
+	c.Close()
+	if err != nil {
+		return Conversation{}, err
+	}
+	thread, _, err := db.GetStatuses(append([]int{root}, ids...))
+	if err != nil {
+		return Conversation{}, err
+	}
+	return buildConversation(status, thread), nil
+}
+
+// buildConversation arranges the statuses of a thread around status
+func buildConversation(status Status, thread []Status) Conversation {
+	sort.SliceStable(thread, func(i, j int) bool {
+		if thread[i].Posted != thread[j].Posted {
+			return thread[i].Posted < thread[j].Posted
+		}
+		return thread[i].Id < thread[j].Id
+	})
+	byID := make(map[int]Status, len(thread))
+	children := make(map[int][]Status)
+	for _, s := range thread {
+		byID[s.Id] = s
+		if s.InReplyTo != 0 {
+			children[s.InReplyTo] = append(children[s.InReplyTo], s)
+		}
+	}
+
+	conv := Conversation{Ancestors: []Status{}, Status: status}
+	// stops at a deleted ancestor
+	for id := status.InReplyTo; id != 0; {
+		parent, ok := byID[id]
+		if !ok {
+			break
+		}
+		conv.Ancestors = append([]Status{parent}, conv.Ancestors...)
+		id = parent.InReplyTo
+	}
+
+	var tree func(id int) []ReplyTree
+	tree = func(id int) []ReplyTree {
+		replies := make([]ReplyTree, 0, len(children[id]))
+		for _, s := range children[id] {
+			replies = append(replies, ReplyTree{Status: s, Children: tree(s.Id)})
+		}
+		return replies
+	}
+	conv.Replies = tree(status.Id)
+	return conv
+}
+
+// thread is where a reply sits
+type thread struct {
+	sid, parent, root int
+}
+
+// threads reads the place of every reply in sids, from the status or
+// its tombstone
+func (db *DB) threads(c redis.Conn, sids []int) ([]thread, error) {
+	for _, sid := range sids {
+		c.Send("HMGET", db.idKey("status:", sid), "in_reply_to", "root")
+	}
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	var threads []thread
+	for j, sid := range sids {
+		var t thread
+		fields, _ := redis.Values(r[j], nil)
+		if _, err := redis.Scan(fields, &t.parent, &t.root); err != nil {
+			return nil, err
+		}
+		if t.parent != 0 {
+			t.sid = sid
+			threads = append(threads, t)
+		}
+	}
+	return threads, nil
+}
+
+// addToThread adds a reply to the conversation of its root and the
+// replies of its parent, only once however often it runs
+func (db *DB) addToThread(c redis.Conn, t thread, posted int64) error {
+	if _, err := c.Do("ZADD", db.idKey("conversation:", t.root), posted, t.sid); err != nil {
+		return err
+	}
+	// a parent deleted meanwhile is not counted up
+	_, err := addReplyScript.run(c, []string{db.idKey("status:", t.parent),
+		db.idKey("replies:", t.parent)}, t.sid, posted)
+	return err
+}
+
+// unthread takes replies out of their threads and counts down their
+// parents, only once however often it runs
+func (db *DB) unthread(c redis.Conn, threads []thread) error {
+	if len(threads) == 0 {
+		return nil
+	}
+	var cached []string
+	for _, t := range threads {
+		keys := []string{db.idKey("replies:", t.parent), db.idKey("status:", t.parent)}
+		if _, err := unlinkScript.run(c, keys, t.sid, "replies"); err != nil {
+			return err
+		}
+		cached = append(cached, statusCacheKey(t.parent))
+	}
+	for _, t := range threads {
+		c.Send("ZREM", db.idKey("conversation:", t.root), t.sid)
+	}
+	if _, err := c.Do(""); err != nil {
+		return err
+	}
+	db.invalidate(c, cached...)
+	return nil
+}
@@ -0,0 +1,66 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+// tests that replies are counted and arranged into a conversation
+func TestConversation(t *testing.T) {
+	db := newTestDB(t, "reply")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	root, _ := db.PostStatus(a, "root")
+	first, err := db.PostReply(b, root, "first")
+	if err != nil {
+		t.Fatal("error replying ", err)
+	}
+	second, _ := db.PostReply(a, root, "second")
+	nested, _ := db.PostReply(a, first, "nested")
+	if _, err := db.PostReply(a, -5, "nowhere"); err != ErrNotFound {
+		t.Errorf("reply to a missing status err == %v\n", err)
+	}
+
+	if status, _ := db.GetStatus(root); status.Replies != 2 {
+		t.Errorf("root replies == %d\n", status.Replies)
+	}
+	if status, _ := db.GetStatus(nested); status.InReplyTo != first || status.Root != root {
+		t.Errorf("nested == %+v\n", status)
+	}
+
+	conv, err := db.Conversation(root)
+	if err != nil {
+		t.Fatal("error reading conversation ", err)
+	}
+	if len(conv.Ancestors) != 0 || len(conv.Replies) != 2 ||
+		conv.Replies[0].Id != first || conv.Replies[1].Id != second ||
+		len(conv.Replies[0].Children) != 1 || conv.Replies[0].Children[0].Id != nested {
+		t.Errorf("conversation of the root == %+v\n", conv)
+	}
+	conv, _ = db.Conversation(nested)
+	if len(conv.Ancestors) != 2 || conv.Ancestors[0].Id != root ||
+		conv.Ancestors[1].Id != first || len(conv.Replies) != 0 {
+		t.Errorf("conversation of a reply == %+v\n", conv)
+	}
+
+	// a deleted reply leaves the thread once
+	db.DeleteStatus(a, second)
+	db.DeleteStatus(a, second)
+	if status, _ := db.GetStatus(root); status.Replies != 1 {
+		t.Errorf("root replies after delete == %d\n", status.Replies)
+	}
+	if n, _ := redis.Int(c.Do("ZCARD", db.idKey("conversation:", root))); n != 2 {
+		t.Errorf("conversation:%d has %d\n", root, n)
+	}
+
+	// and so do the replies of a deleted user
+	db.DeleteUser(b)
+	conv, _ = db.Conversation(root)
+	if conv.Status.Replies != 0 || len(conv.Replies) != 0 {
+		t.Errorf("conversation without b == %+v\n", conv)
+	}
+}
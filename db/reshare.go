@@ -0,0 +1,197 @@
+package myredisDB
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+/*
+ * reshares
+ *
+ * a reshare pushes someone else's status into the timelines of the
+ * resharer's followers with syndicateStatus, scored by the time of the
+ * reshare. a follower who has the status already keeps it where it is,
+ * one who gets it through the reshare has it recorded in via:<follower>,
+ * so the timeline can say who reshared it and an undo knows what to take
+ * back.
+ *
+ *   resharers:<sid>  zset of the users who reshared the status
+ *   reshares:<uid>   zset of the statuses the user reshared
+ *
+ * both are scored by the time of the reshare, the reshares field of the
+ * status counts resharers:<sid>. reshares are always pushed, also with
+ * AsyncFanout or for users above the FanoutThreshold.
+ */
+
+// ErrOwnStatus is returned by Reshare for a status of the resharer
+var ErrOwnStatus = errors.New("myredisDB: a status can not be reshared by its author")
+
+// Reshare pushes sid into the timelines of uid's followers. it returns
+// false when uid had reshared it already, calling it again finishes an
+// interrupted reshare.
+func (db *DB) Reshare(uid, sid int) (bool, error) {
+	c := db.Get()
+	defer c.Close()
+
+	author, err := redis.Int(c.Do("HGET", db.idKey("status:", sid), "uid"))
+	if err == redis.ErrNil {
+		return false, ErrNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	if author == uid {
+		return false, ErrOwnStatus
+	}
+
+	now := time.Now().Unix()
+	res, err := redis.Int(markStatusScript.run(c, []string{db.idKey("status:", sid),
+		db.idKey("resharers:", sid)}, uid, now, "reshares"))
+	if err != nil {
+		return false, err
+	}
+	if res == -1 {
+		return false, ErrNotFound
+	}
+	db.invalidate(c, statusCacheKey(sid))
+
+	if _, err := c.Do("ZADD", db.idKey("reshares:", uid), "NX", now, sid); err != nil {
+		return false, err
+	}
+	if err := db.syndicateStatus(c, uid, sid, now, true); err != nil {
+		return false, err
+	}
+	if res == 1 {
+		if err := db.notify(c, author, NotifyReshare, sid, uid); err != nil {
+			return true, err
+		}
+	}
+	return res == 1, nil
+}
+
+// Unreshare takes a reshare back, the followers of uid lose the status
+// unless they had it from somewhere else. it returns false when uid had
+// not reshared sid.
+func (db *DB) Unreshare(uid, sid int) (bool, error) {
+	c := db.Get()
+	defer c.Close()
+
+	author, err := redis.Int(c.Do("HGET", db.idKey("status:", sid), "uid"))
+	if err != nil && err != redis.ErrNil {
+		return false, err
+	}
+	res, err := redis.Int(unlinkScript.run(c, []string{db.idKey("resharers:", sid),
+		db.idKey("status:", sid)}, uid, "reshares"))
+	if err != nil {
+		return false, err
+	}
+	db.invalidate(c, statusCacheKey(sid))
+	if res == 0 {
+		// unless an earlier call stopped half way, there is nothing to undo
+		r, err := c.Do("ZSCORE", db.idKey("reshares:", uid), sid)
+		if err != nil || r == nil {
+			return false, err
+		}
+	}
+
+	// also run when the status is gone, the timelines still hold it
+	if err := db.retractReshare(c, uid, sid, author); err != nil {
+		return false, err
+	}
+	if _, err := c.Do("ZREM", db.idKey("reshares:", uid), sid); err != nil {
+		return false, err
+	}
+	return res == 1, nil
+}
+
+// ResharedBy tells who reshared the statuses of uid's timeline into it,
+// statuses uid got from their author are left out
+func (db *DB) ResharedBy(uid int, sids []int) (map[int]int, error) {
+	via := make(map[int]int)
+	if len(sids) == 0 {
+		return via, nil
+	}
+	c := db.Get()
+	defer c.Close()
+
+	r, err := redis.Values(c.Do("HMGET", redis.Args{}.Add(db.idKey("via:", uid)).AddFlat(sids)...))
+	if err != nil {
+		return nil, err
+	}
+	for j, sid := range sids {
+		if resharer, err := redis.Int(r[j], nil); err == nil {
+			via[sid] = resharer
+		}
+	}
+	return via, nil
+}
+
+// pushReshare pushes a reshared status to a batch of followers of uid
+func (db *DB) pushReshare(c redis.Conn, followers []int, uid, sid int, reshared int64) error {
+	for _, follower := range followers {
+		keys := []string{db.idKey("timeline:", follower), db.idKey("via:", follower)}
+		if _, err := pushReshareScript.run(c, keys, sid, reshared, uid,
+			db.maxTimeline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retractReshare removes sid from the timelines of the followers of uid
+// that got it through uid's reshare
+func (db *DB) retractReshare(c redis.Conn, uid, sid, author int) error {
+	return zsetMembers(c, db.idKey("followers:", uid), func(follower int, score int64) error {
+		keys := []string{db.idKey("timeline:", follower), db.idKey("via:", follower),
+			db.idKey("following:", follower)}
+		_, err := retractReshareScript.run(c, keys, sid, uid, author, follower)
+		return err
+	})
+}
+
+// unreshareStatus takes back every reshare of a status that is being
+// deleted
+func (db *DB) unreshareStatus(c redis.Conn, sid, author int) error {
+	resharers := db.idKey("resharers:", sid)
+	for {
+		uids, err := redis.Ints(c.Do("ZRANGE", resharers, 0, syndicateBatch-1))
+		if err != nil {
+			return err
+		}
+		if len(uids) == 0 {
+			return nil
+		}
+		for _, uid := range uids {
+			if err := db.retractReshare(c, uid, sid, author); err != nil {
+				return err
+			}
+		}
+		for _, uid := range uids {
+			c.Send("ZREM", db.idKey("reshares:", uid), sid)
+		}
+		c.Send("ZREM", redis.Args{}.Add(resharers).AddFlat(uids)...)
+		if _, err := c.Do(""); err != nil {
+			return err
+		}
+	}
+}
+
+// unreshareUser takes back every reshare of a user that is being deleted
+func (db *DB) unreshareUser(c redis.Conn, uid int) error {
+	reshares := db.idKey("reshares:", uid)
+	for {
+		sids, err := redis.Ints(c.Do("ZRANGE", reshares, 0, syndicateBatch-1))
+		if err != nil {
+			return err
+		}
+		if len(sids) == 0 {
+			return nil
+		}
+		for _, sid := range sids {
+			if _, err := db.Unreshare(uid, sid); err != nil {
+				return err
+			}
+		}
+	}
+}
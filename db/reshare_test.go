@@ -0,0 +1,91 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+// tests that a reshare reaches the resharer's followers once and can be
+// taken back
+func TestReshare(t *testing.T) {
+	db := newTestDB(t, "reshare")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	author, _ := db.CreateUser("author", "Author")
+	resharer, _ := db.CreateUser("resharer", "Resharer")
+	fan, _ := db.CreateUser("fan", "Fan")
+	both, _ := db.CreateUser("both", "Both")
+	db.Follow(fan, resharer)
+	db.Follow(both, resharer)
+	db.Follow(both, author)
+	sid, _ := db.PostStatus(author, "worth sharing")
+	later, _ := db.PostStatus(author, "later")
+
+	if _, err := db.Reshare(author, sid); err != ErrOwnStatus {
+		t.Errorf("reshare by the author err == %v\n", err)
+	}
+	if _, err := db.Reshare(resharer, -5); err != ErrNotFound {
+		t.Errorf("reshare of a missing status err == %v\n", err)
+	}
+	if res, err := db.Reshare(resharer, sid); !res || err != nil {
+		t.Fatal("error resharing ", err)
+	}
+	if res, _ := db.Reshare(resharer, sid); res {
+		t.Error("reshared twice")
+	}
+	if status, _ := db.GetStatus(sid); status.Reshares != 1 {
+		t.Errorf("reshares == %d\n", status.Reshares)
+	}
+
+	// fan gets it through the reshare, both had it already
+	if tl, _ := db.GetUserTimeline(fan, 1, 30); len(tl) != 1 || tl[0] != sid {
+		t.Errorf("timeline:%d == %v\n", fan, tl)
+	}
+	if tl, _ := db.GetUserTimeline(both, 1, 30); len(tl) != 2 || tl[0] != later {
+		t.Errorf("timeline:%d == %v\n", both, tl)
+	}
+	if via, _ := db.ResharedBy(fan, []int{sid}); via[sid] != resharer {
+		t.Errorf("via == %v\n", via)
+	}
+	if via, _ := db.ResharedBy(both, []int{sid}); len(via) != 0 {
+		t.Errorf("via == %v\n", via)
+	}
+
+	if res, err := db.Unreshare(resharer, sid); !res || err != nil {
+		t.Fatal("error taking the reshare back ", err)
+	}
+	if tl, _ := db.GetUserTimeline(fan, 1, 30); len(tl) != 0 {
+		t.Errorf("timeline:%d after undo == %v\n", fan, tl)
+	}
+	if tl, _ := db.GetUserTimeline(both, 1, 30); len(tl) != 2 {
+		t.Errorf("timeline:%d after undo == %v\n", both, tl)
+	}
+	if status, _ := db.GetStatus(sid); status.Reshares != 0 {
+		t.Errorf("reshares after undo == %d\n", status.Reshares)
+	}
+
+	// deleting the status takes every reshare back
+	db.Reshare(resharer, sid)
+	db.DeleteStatus(author, sid)
+	if tl, _ := db.GetUserTimeline(fan, 1, 30); len(tl) != 0 {
+		t.Errorf("timeline:%d after delete == %v\n", fan, tl)
+	}
+	for _, key := range []string{db.idKey("via:", fan), db.idKey("reshares:", resharer),
+		db.idKey("resharers:", sid)} {
+		if n, _ := redis.Int(c.Do("EXISTS", key)); n != 0 {
+			t.Errorf("%s kept after delete\n", key)
+		}
+	}
+
+	// and so does deleting the resharer
+	db.Reshare(resharer, later)
+	db.DeleteUser(resharer)
+	if tl, _ := db.GetUserTimeline(fan, 1, 30); len(tl) != 0 {
+		t.Errorf("timeline:%d after deleting the resharer == %v\n", fan, tl)
+	}
+	if status, _ := db.GetStatus(later); status.Reshares != 0 {
+		t.Errorf("reshares after deleting the resharer == %d\n", status.Reshares)
+	}
+}
@@ -0,0 +1,449 @@
+package myredisDB
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+)
+
+/*********************************************
+************ Script runner ******************/
+
+// script is a lua script that runs server side with EVALSHA
+type script struct {
+	src  string
+	hash string
+}
+
+func newScript(src string) *script {
+	sum := sha1.Sum([]byte(src))
+	return &script{src: src, hash: hex.EncodeToString(sum[:])}
+}
+
+// run calls the script by its hash. the source is only sent with
+// SCRIPT LOAD when redis answers NOSCRIPT (first use, restart or
+// SCRIPT FLUSH), after which the call is retried once.
+func (s *script) run(c redis.Conn, keys []string, args ...interface{}) (interface{}, error) {
+	a := redis.Args{s.hash, len(keys)}.AddFlat(keys).Add(args...)
+	r, err := c.Do("EVALSHA", a...)
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		if _, err := c.Do("SCRIPT", "LOAD", s.src); err != nil {
+			return nil, err
+		}
+		r, err = c.Do("EVALSHA", a...)
+	}
+	return r, err
+}
+
+/*********************************************
+************ Scripts ************************/
+
+/*
+ * publishes a status in one atomic step: takes its id, writes it, counts
+ * it and hands it to the followers. every key is declared, so the caller
+ * reads the next id and the followers first, and the script writes
+ * nothing and returns 0 when either changed since. it returns 1 when the
+ * status was published.
+ *
+ * KEYS[1] status:<sid>		the new status hash
+ * KEYS[2] user:<uid>		author hash
+ * KEYS[3] timeline:<uid>	author timeline
+ * KEYS[4] followers:<uid>	author followers
+ * KEYS[5] posts:<uid>		statuses written by the author
+ * KEYS[6] fanout:pull		authors whose statuses are pulled on read
+ * KEYS[7] fanout:jobs		stream of queued fan-out jobs
+ * KEYS[8] status:id		counter the status ids are taken from
+ * KEYS[9] status:<parent>	only for a reply, the status answered
+ * KEYS[10] replies:<parent>	only for a reply
+ * KEYS[11] conversation:<root>	only for a reply
+ * KEYS[...] timeline:<follower>	one per follower in ARGV[11...]
+ * ARGV[1] uid
+ * ARGV[2] sid, the value status:id is expected to take
+ * ARGV[3] message
+ * ARGV[4] posted, unix time used as the timeline score
+ * ARGV[5] fan-out threshold, 0 always pushes
+ * ARGV[6] "1" queues the fan-out on KEYS[7] instead of pushing
+ * ARGV[7] longest a timeline may grow, 0 does not trim
+ * ARGV[8] entities of the message as JSON, "" for none
+ * ARGV[9] parent, 0 for a status that answers none
+ * ARGV[10] root of the conversation of a reply
+ * ARGV[11...] the followers in ZRANGE order, when they are pushed to
+ */
+var postStatusScript = newScript(`
+if tonumber(redis.call('GET', KEYS[8]) or '0') + 1 ~= tonumber(ARGV[2]) then
+	return 0
+end
+
+-- too many followers to push to, readers merge posts:<uid> instead.
+-- the author is never removed from the set again, so statuses that
+-- were not pushed stay visible if the follower count drops
+local fanout = 'push'
+local threshold = tonumber(ARGV[5])
+if threshold > 0 and redis.call('ZCARD', KEYS[4]) > threshold then
+	fanout = 'pull'
+elseif ARGV[6] == '1' then
+	fanout = 'queue'
+end
+local first = 9
+if ARGV[9] ~= '0' then
+	first = 12
+end
+if fanout == 'push' then
+	local followers = redis.call('ZRANGE', KEYS[4], 0, -1)
+	if #followers ~= #ARGV - 10 then
+		return 0
+	end
+	for i, follower in ipairs(followers) do
+		if follower ~= ARGV[10 + i] then
+			return 0
+		end
+	end
+end
+
+redis.call('INCR', KEYS[8])
+local login = redis.call('HGET', KEYS[2], 'login') or ''
+redis.call('HMSET', KEYS[1], 'message', ARGV[3], 'posted', ARGV[4],
+	'id', ARGV[2], 'uid', ARGV[1], 'login', login)
+if ARGV[8] ~= '' then
+	redis.call('HSET', KEYS[1], 'entities', ARGV[8])
+end
+
+-- a reply joins its thread, a deleted parent is not counted up
+if ARGV[9] ~= '0' then
+	redis.call('HMSET', KEYS[1], 'in_reply_to', ARGV[9], 'root', ARGV[10])
+	redis.call('ZADD', KEYS[11], ARGV[4], ARGV[2])
+	if redis.call('EXISTS', KEYS[9]) == 1 and
+		redis.call('HEXISTS', KEYS[9], 'deleted') == 0 and
+		redis.call('ZADD', KEYS[10], ARGV[4], ARGV[2]) == 1 then
+		redis.call('HINCRBY', KEYS[9], 'replies', 1)
+	end
+end
+
+redis.call('HINCRBY', KEYS[2], 'posts', 1)
+redis.call('ZADD', KEYS[5], ARGV[4], ARGV[2])
+
+local maxTimeline = tonumber(ARGV[7])
+local timelines = {KEYS[3]}
+if fanout == 'push' then
+	for i = first, #KEYS do
+		table.insert(timelines, KEYS[i])
+	end
+elseif fanout == 'pull' then
+	redis.call('SADD', KEYS[6], ARGV[1])
+else
+	-- the fan-out workers push the status
+	redis.call('XADD', KEYS[7], '*', 'uid', ARGV[1], 'sid', ARGV[2],
+		'posted', ARGV[4])
+end
+for _, timeline in ipairs(timelines) do
+	redis.call('ZADD', timeline, ARGV[4], ARGV[2])
+	if maxTimeline > 0 then
+		redis.call('ZREMRANGEBYRANK', timeline, 0, -(maxTimeline + 1))
+	end
+end
+return 1
+`)
+
+/*
+ * removes one half of a follow edge and counts it down, only if it was
+ * there, so an unfollow or a deletion that is resumed never counts an
+ * edge twice. the keys belong to one user and share its hash slot on a
+ * cluster. replies, reshares and likes are taken back from the zsets of
+ * a status the same way.
+ *
+ * KEYS[1] followers:<id> or following:<id> of the other user
+ * KEYS[2] user:<id>		the other user's hash
+ * ARGV[1] uid of the user at the other end of the edge
+ * ARGV[2] "followers" or "following", the counter in KEYS[2]
+ */
+var unlinkScript = newScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	redis.call('HINCRBY', KEYS[2], ARGV[2], -1)
+end
+return 1
+`)
+
+/*
+ * adds one half of a follow edge and counts it up, only if it was not
+ * there, so a follow that is run again never counts an edge twice. the
+ * keys belong to one user and share its hash slot on a cluster.
+ *
+ * KEYS[1] followers:<id> or following:<id>
+ * KEYS[2] user:<id>		the hash holding the counter
+ * ARGV[1] uid of the user at the other end of the edge
+ * ARGV[2] unix time
+ * ARGV[3] "followers" or "following", the counter in KEYS[2]
+ */
+var linkScript = newScript(`
+if redis.call('ZADD', KEYS[1], 'NX', ARGV[2], ARGV[1]) == 0 then
+	return 0
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	redis.call('HINCRBY', KEYS[2], ARGV[3], 1)
+end
+return 1
+`)
+
+/*
+ * replaces a status with a tombstone that expires, if uid wrote it.
+ * returns 1 when the status was replaced, 0 when it already was a
+ * tombstone of uid, -1 when there is no such status and -2 when it
+ * belongs to another user. the tombstone keeps in_reply_to, root and
+ * entities.
+ *
+ * KEYS[1] status:<sid>
+ * KEYS[2] revisions:<sid>	old messages, deleted with the status
+ * ARGV[1] uid
+ * ARGV[2] sid
+ * ARGV[3] deleted, unix time
+ * ARGV[4] seconds the tombstone is kept
+ */
+var deleteStatusScript = newScript(`
+local owner = redis.call('HGET', KEYS[1], 'uid')
+if not owner then
+	return -1
+end
+if owner ~= ARGV[1] then
+	return -2
+end
+if redis.call('HEXISTS', KEYS[1], 'deleted') == 1 then
+	return 0
+end
+-- a reply keeps its place in the thread and the entities are kept, so
+-- the status can be taken out of the thread and the mentions
+local kept = redis.call('HMGET', KEYS[1], 'in_reply_to', 'root', 'entities')
+redis.call('DEL', KEYS[1], KEYS[2])
+redis.call('HMSET', KEYS[1], 'id', ARGV[2], 'uid', owner, 'deleted', ARGV[3])
+if kept[1] then
+	redis.call('HMSET', KEYS[1], 'in_reply_to', kept[1], 'root', kept[2])
+end
+if kept[3] then
+	redis.call('HSET', KEYS[1], 'entities', kept[3])
+end
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+return 1
+`)
+
+/*
+ * adds a reply to the replies of its parent and counts it, unless the
+ * parent is missing or deleted. returns 1 when the reply was added.
+ *
+ * KEYS[1] status:<parent>
+ * KEYS[2] replies:<parent>
+ * ARGV[1] sid of the reply
+ * ARGV[2] posted time of the reply
+ */
+var addReplyScript = newScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 or
+	redis.call('HEXISTS', KEYS[1], 'deleted') == 1 then
+	return 0
+end
+if redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1]) == 1 then
+	redis.call('HINCRBY', KEYS[1], 'replies', 1)
+end
+return 1
+`)
+
+/*
+ * replaces the message of a status written by uid and keeps the old one.
+ * the posted time, and so the place in the timelines, does not change.
+ * returns 1 when edited, -1 for a missing or deleted status, -2 for a
+ * status of another user and -3 when the edit window has passed.
+ *
+ * KEYS[1] status:<sid>
+ * KEYS[2] revisions:<sid>	"<unix time>:<message>" of every old message
+ * ARGV[1] uid
+ * ARGV[2] message
+ * ARGV[3] edited, unix time
+ * ARGV[4] seconds after posting a status can be edited, 0 is forever
+ * ARGV[5] entities of the new message as JSON, "" for none
+ */
+var editStatusScript = newScript(`
+local status = redis.call('HMGET', KEYS[1], 'uid', 'posted', 'edited',
+	'message', 'deleted')
+if not status[1] or status[5] then
+	return -1
+end
+if status[1] ~= ARGV[1] then
+	return -2
+end
+local window = tonumber(ARGV[4])
+if window > 0 and tonumber(ARGV[3]) - tonumber(status[2]) > window then
+	return -3
+end
+
+-- the old message was written when posted or last edited
+local written = status[3] or status[2]
+redis.call('RPUSH', KEYS[2], written .. ':' .. status[4])
+redis.call('HMSET', KEYS[1], 'message', ARGV[2], 'edited', ARGV[3])
+redis.call('HINCRBY', KEYS[1], 'revisions', 1)
+if ARGV[5] == '' then
+	redis.call('HDEL', KEYS[1], 'entities')
+else
+	redis.call('HSET', KEYS[1], 'entities', ARGV[5])
+end
+return 1
+`)
+
+/*
+ * records that uid reshared or liked a live status and counts it.
+ * returns 1 when it is new, 0 when uid had done it already and -1 for a
+ * missing or deleted status.
+ *
+ * KEYS[1] status:<sid>
+ * KEYS[2] resharers:<sid> or likers:<sid>
+ * ARGV[1] uid
+ * ARGV[2] unix time
+ * ARGV[3] "reshares" or "likes", the counter in KEYS[1]
+ */
+var markStatusScript = newScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 or
+	redis.call('HEXISTS', KEYS[1], 'deleted') == 1 then
+	return -1
+end
+if redis.call('ZADD', KEYS[2], 'NX', ARGV[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HINCRBY', KEYS[1], ARGV[3], 1)
+return 1
+`)
+
+/*
+ * pushes a reshared status into the timeline of one follower of the
+ * resharer. a status already in the timeline keeps its place and is not
+ * annotated, so it is never listed twice. returns 1 when pushed.
+ *
+ * KEYS[1] timeline:<follower>
+ * KEYS[2] via:<follower>	sid -> uid of the resharer it came from
+ * ARGV[1] sid
+ * ARGV[2] reshared, unix time used as the timeline score
+ * ARGV[3] uid of the resharer
+ * ARGV[4] longest a timeline may grow, 0 does not trim
+ */
+var pushReshareScript = newScript(`
+if redis.call('ZADD', KEYS[1], 'NX', ARGV[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+local max = tonumber(ARGV[4])
+if max > 0 then
+	local old = redis.call('ZRANGE', KEYS[1], 0, -(max + 1))
+	if #old > 0 then
+		redis.call('ZREM', KEYS[1], unpack(old))
+		redis.call('HDEL', KEYS[2], unpack(old))
+	end
+end
+return 1
+`)
+
+/*
+ * takes back a status one follower got through a reshare of ARGV[2].
+ * the entry stays when the follower is the author or follows the
+ * author. returns 1 when the entry was removed.
+ *
+ * KEYS[1] timeline:<follower>
+ * KEYS[2] via:<follower>
+ * KEYS[3] following:<follower>
+ * ARGV[1] sid
+ * ARGV[2] uid of the resharer
+ * ARGV[3] uid of the author
+ * ARGV[4] uid of the follower
+ */
+var retractReshareScript = newScript(`
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('HDEL', KEYS[2], ARGV[1])
+if ARGV[4] == ARGV[3] or redis.call('ZSCORE', KEYS[3], ARGV[3]) then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+return 1
+`)
+
+/*
+ * adds an event to the notification group it belongs to. a group that
+ * was read starts over, the latest actors are kept first and every
+ * actor of the group is counted once. only the newest groups are kept.
+ * returns the count of the group.
+ *
+ * KEYS[1] notifications:<uid>	group -> time of its latest event
+ * KEYS[2] notices:<uid>		group -> JSON of the group
+ * KEYS[3] notified:<uid>		time the notifications were read up to
+ * KEYS[4] notifiers:<uid>		group -> JSON object of its actors
+ * ARGV[1] group, "follow" or "<type>:<sid>"
+ * ARGV[2] type of the event
+ * ARGV[3] sid the event is about, 0 for a follow
+ * ARGV[4] uid of the actor
+ * ARGV[5] unix time of the event
+ * ARGV[6] groups kept at most
+ * ARGV[7] actors kept per group at most
+ */
+var notifyScript = newScript(`
+local read = tonumber(redis.call('GET', KEYS[3]) or '0')
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+local n, seen
+if score and tonumber(score) > read then
+	local raw = redis.call('HGET', KEYS[2], ARGV[1])
+	if raw then
+		n = cjson.decode(raw)
+		raw = redis.call('HGET', KEYS[4], ARGV[1])
+		if raw then
+			seen = cjson.decode(raw)
+		else
+			seen = {}
+			for _, a in ipairs(n.actors) do
+				seen[tostring(a)] = 1
+			end
+		end
+	end
+end
+if not n then
+	n = {type = ARGV[2], object = tonumber(ARGV[3]), actors = {}, count = 0}
+	seen = {}
+end
+local actor = tonumber(ARGV[4])
+local actors = {actor}
+for _, a in ipairs(n.actors) do
+	if a ~= actor and #actors < tonumber(ARGV[7]) then
+		table.insert(actors, a)
+	end
+end
+if not seen[ARGV[4]] then
+	seen[ARGV[4]] = 1
+	n.count = n.count + 1
+end
+n.actors = actors
+n.at = tonumber(ARGV[5])
+redis.call('HSET', KEYS[2], ARGV[1], cjson.encode(n))
+redis.call('HSET', KEYS[4], ARGV[1], cjson.encode(seen))
+redis.call('ZADD', KEYS[1], ARGV[5], ARGV[1])
+local max = tonumber(ARGV[6])
+local old = redis.call('ZRANGE', KEYS[1], 0, -(max + 1))
+if #old > 0 then
+	redis.call('ZREM', KEYS[1], unpack(old))
+	redis.call('HDEL', KEYS[2], unpack(old))
+	redis.call('HDEL', KEYS[4], unpack(old))
+end
+return n.count
+`)
+
+/*
+ * moves the time notifications were read up to forward, never back.
+ * returns 1 when it moved.
+ *
+ * KEYS[1] notified:<uid>
+ * ARGV[1] unix time
+ */
+var markReadScript = newScript(`
+local read = tonumber(redis.call('GET', KEYS[1]) or '0')
+if tonumber(ARGV[1]) <= read then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1])
+return 1
+`)
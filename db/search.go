@@ -0,0 +1,382 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * full-text search
+ *
+ * a message is split into words, runs of letters, digits and "_" in
+ * lower case, and the status is added to
+ *
+ *   search:<word>  zset of the statuses with the word, scored by posted time
+ *
+ * for every word it has. PostStatus and EditStatus index the words,
+ * DeleteStatus and DeleteUser take them out. Search walks the rarest
+ * word of a query newest first and checks every candidate against its
+ * status hash, so entries left behind by an interrupted delete or edit
+ * are never returned. RebuildSearch writes the index again from the
+ * status hashes.
+ */
+
+const (
+	// candidates read per ZREVRANGEBYSCORE
+	searchBatch = 100
+	// matches ranked by relevance at most, the newest ones
+	searchLimit = 1000
+)
+
+// SearchQuery selects the statuses Search returns
+type SearchQuery struct {
+	// words and "quoted phrases", a status has to have all of them
+	Text string
+	// only statuses of this author, 0 for every author
+	Uid int
+	// posted at or after Since and at or before Until, 0 for no bound
+	Since int64
+	Until int64
+	// rank by how well the words match instead of newest first
+	ByRelevance bool
+	Page        int
+	Count       int
+}
+
+// searchTerms is a parsed query
+type searchTerms struct {
+	// every word, without repeats
+	words []string
+	// phrases of more than one word
+	phrases [][]string
+}
+
+// searchHit is a status that matched
+type searchHit struct {
+	sid    int
+	posted int64
+	score  float64
+}
+
+// words splits a text into the words that are indexed
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !loginRune(r)
+	})
+}
+
+// distinct drops the repeats of a list of words
+func distinct(list []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, w := range list {
+		if !seen[w] {
+			seen[w] = true
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// parseQuery reads the words and phrases of a query, the text between
+// two double quotes is a phrase and an unclosed quote runs to the end
+func parseQuery(text string) searchTerms {
+	var t searchTerms
+	var all []string
+	for j, part := range strings.Split(text, `"`) {
+		w := words(part)
+		if j%2 == 1 && len(w) > 1 {
+			t.phrases = append(t.phrases, w)
+		}
+		all = append(all, w...)
+	}
+	t.words = distinct(all)
+	return t
+}
+
+// match tells if a message has every word and phrase of the query and
+// scores it: the times each word occurs weighted by its idf, over the
+// square root of the length of the message
+func (t searchTerms) match(message string, idf map[string]float64) (float64, bool) {
+	msg := words(message)
+	counts := make(map[string]int)
+	for _, w := range msg {
+		counts[w]++
+	}
+	score := 0.0
+	for _, w := range t.words {
+		if counts[w] == 0 {
+			return 0, false
+		}
+		score += float64(counts[w]) * idf[w]
+	}
+	for _, phrase := range t.phrases {
+		if !hasPhrase(msg, phrase) {
+			return 0, false
+		}
+	}
+	return score / math.Sqrt(float64(len(msg))), true
+}
+
+// hasPhrase tells if phrase is a run of msg
+func hasPhrase(msg, phrase []string) bool {
+	for start := 0; start+len(phrase) <= len(msg); start++ {
+		j := 0
+		for j < len(phrase) && msg[start+j] == phrase[j] {
+			j++
+		}
+		if j == len(phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchIdf is the weight of a word found in df of total statuses
+func searchIdf(total, df int) float64 {
+	return math.Log(1 + float64(total)/float64(df))
+}
+
+// sortHits orders the hits newest first, or by relevance and then
+// newest first
+func sortHits(hits []searchHit, byRelevance bool) {
+	sort.SliceStable(hits, func(i, j int) bool {
+		if byRelevance && hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		if hits[i].posted != hits[j].posted {
+			return hits[i].posted > hits[j].posted
+		}
+		return hits[i].sid > hits[j].sid
+	})
+}
+
+// pageHits orders the hits and returns the statuses of the page
+func pageHits(hits []searchHit, q SearchQuery) []int {
+	sortHits(hits, q.ByRelevance)
+	start, end := (q.Page-1)*q.Count, q.Page*q.Count
+	if start < 0 || start >= len(hits) {
+		return nil
+	}
+	if end > len(hits) {
+		end = len(hits)
+	}
+	sids := make([]int, 0, end-start)
+	for _, h := range hits[start:end] {
+		sids = append(sids, h.sid)
+	}
+	return sids
+}
+
+// Search returns a page of the statuses that match a query
+func (db *DB) Search(q SearchQuery) ([]int, error) {
+	t := parseQuery(q.Text)
+	if len(t.words) == 0 || q.Page < 1 || q.Count < 1 {
+		return nil, nil
+	}
+	c := db.Get()
+	defer c.Close()
+
+	for _, w := range t.words {
+		c.Send("ZCARD", db.key("search:"+w))
+	}
+	c.Send("GET", db.key("status:id"))
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	total, _ := redis.Int(r[len(t.words)], nil)
+	idf := make(map[string]float64)
+	rarest, least := "", 0
+	for j, w := range t.words {
+		df, err := redis.Int(r[j], nil)
+		if err != nil {
+			return nil, err
+		}
+		// a word nothing has
+		if df == 0 {
+			return nil, nil
+		}
+		if rarest == "" || df < least {
+			rarest, least = w, df
+		}
+		idf[w] = searchIdf(total, df)
+	}
+
+	// newest first stops at the page, relevance ranks the newest matches
+	wanted := q.Page * q.Count
+	if q.ByRelevance {
+		wanted = searchLimit
+	}
+	min, max := "-inf", "+inf"
+	if q.Since > 0 {
+		min = strconv.FormatInt(q.Since, 10)
+	}
+	if q.Until > 0 {
+		max = strconv.FormatInt(q.Until, 10)
+	}
+	var hits []searchHit
+	key := db.key("search:" + rarest)
+	for offset := 0; ; offset += searchBatch {
+		r, err := redis.Int64s(c.Do("ZREVRANGEBYSCORE", key, max, min,
+			"WITHSCORES", "LIMIT", offset, searchBatch))
+		if err != nil {
+			return nil, err
+		}
+		sids := make([]int, 0, len(r)/2)
+		var last int64
+		for j := 0; j+1 < len(r); j += 2 {
+			sids = append(sids, int(r[j]))
+			last = r[j+1]
+		}
+		found, err := db.searchStatuses(c, t, q.Uid, idf, sids)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, found...)
+		if len(sids) < searchBatch {
+			break
+		}
+		// the index breaks ties by the text of the id, statuses posted
+		// in the second of the last hit kept may still come and
+		// outrank it
+		if len(hits) >= wanted {
+			sortHits(hits, false)
+			if last < hits[wanted-1].posted {
+				break
+			}
+		}
+	}
+	// the newest matches, in the order of the ids not of their text
+	sortHits(hits, false)
+	if len(hits) > wanted {
+		hits = hits[:wanted]
+	}
+	return pageHits(hits, q), nil
+}
+
+// searchStatuses reads candidates and keeps the ones that match
+func (db *DB) searchStatuses(c redis.Conn, t searchTerms, uid int,
+	idf map[string]float64, sids []int) ([]searchHit, error) {
+	if len(sids) == 0 {
+		return nil, nil
+	}
+	for _, sid := range sids {
+		c.Send("HMGET", db.idKey("status:", sid), "uid", "posted", "message", "deleted")
+	}
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	var hits []searchHit
+	for j, sid := range sids {
+		fields, _ := redis.Values(r[j], nil)
+		// gone, or a tombstone
+		if len(fields) != 4 || fields[2] == nil || fields[3] != nil {
+			continue
+		}
+		var author int
+		var posted int64
+		var message string
+		if _, err := redis.Scan(fields[:3], &author, &posted, &message); err != nil {
+			return nil, err
+		}
+		if uid != 0 && author != uid {
+			continue
+		}
+		if score, ok := t.match(message, idf); ok {
+			hits = append(hits, searchHit{sid: sid, posted: posted, score: score})
+		}
+	}
+	return hits, nil
+}
+
+// sendIndexWords queues adding a status to the index of its words
+func (db *DB) sendIndexWords(c redis.Conn, sid int, posted int64, message string) int {
+	n := 0
+	for _, w := range distinct(words(message)) {
+		c.Send("ZADD", db.key("search:"+w), posted, sid)
+		n++
+	}
+	return n
+}
+
+// sendUnindexWords queues taking a status out of the index of its words
+func (db *DB) sendUnindexWords(c redis.Conn, sid int, message string) int {
+	n := 0
+	for _, w := range distinct(words(message)) {
+		c.Send("ZREM", db.key("search:"+w), strconv.Itoa(sid))
+		n++
+	}
+	return n
+}
+
+// indexWords adds a status to the index of every word of its message
+func (db *DB) indexWords(c redis.Conn, sid int, posted int64, message string) error {
+	if db.sendIndexWords(c, sid, posted, message) == 0 {
+		return nil
+	}
+	_, err := c.Do("")
+	return err
+}
+
+// RebuildSearch drops the search index and writes it again from the
+// status hashes, it returns how many statuses it indexed. statuses
+// posted while it runs may be missing, run it on a quiet server.
+func (db *DB) RebuildSearch() (int, error) {
+	c := db.Get()
+	defer c.Close()
+
+	err := db.scanKeys("search:*", func(keys []string) error {
+		for _, key := range keys {
+			c.Send("DEL", key)
+		}
+		_, err := c.Do("")
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	indexed := 0
+	err = db.scanKeys("status:*", func(keys []string) error {
+		var sids []int
+		for _, key := range keys {
+			// skips the "status:id" counter
+			if sid, ok := db.keyID("status:", key); ok {
+				sids = append(sids, sid)
+				c.Send("HMGET", key, "posted", "message", "deleted")
+			}
+		}
+		if len(sids) == 0 {
+			return nil
+		}
+		r, err := redis.Values(c.Do(""))
+		if err != nil {
+			return err
+		}
+		pending := 0
+		for j, sid := range sids {
+			fields, _ := redis.Values(r[j], nil)
+			if len(fields) != 3 || fields[1] == nil || fields[2] != nil {
+				continue
+			}
+			var posted int64
+			var message string
+			if _, err := redis.Scan(fields[:2], &posted, &message); err != nil {
+				return err
+			}
+			pending += db.sendIndexWords(c, sid, posted, message)
+			indexed++
+		}
+		if pending == 0 {
+			return nil
+		}
+		_, err = c.Do("")
+		return err
+	})
+	return indexed, err
+}
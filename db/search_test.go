@@ -0,0 +1,88 @@
+package myredisDB
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	q := parseQuery(`Redis "fan out" redis "alone" "unclosed quote`)
+	if want := []string{"redis", "fan", "out", "alone", "unclosed", "quote"}; !reflect.DeepEqual(q.words, want) {
+		t.Errorf("words == %v\n", q.words)
+	}
+	if want := [][]string{{"fan", "out"}, {"unclosed", "quote"}}; !reflect.DeepEqual(q.phrases, want) {
+		t.Errorf("phrases == %v\n", q.phrases)
+	}
+}
+
+// tests the words, phrases, filters and order of a search and that the
+// index follows edits and deletes and can be rebuilt
+func TestSearch(t *testing.T) {
+	db := newTestDB(t, "search")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	a, _ := db.CreateUser("a", "A")
+	b, _ := db.CreateUser("b", "B")
+	first, _ := db.PostStatus(a, "Redis fan out is fast")
+	second, _ := db.PostStatus(b, "out of redis, fan of go")
+	third, _ := db.PostStatus(a, "redis redis redis")
+	// the order does not depend on statuses posted in the same second
+	c.Do("HSET", db.idKey("status:", first), "posted", 100)
+	c.Do("HSET", db.idKey("status:", second), "posted", 200)
+	c.Do("HSET", db.idKey("status:", third), "posted", 300)
+	db.RebuildSearch()
+
+	tests := []struct {
+		q    SearchQuery
+		want []int
+	}{
+		{SearchQuery{Text: "REDIS"}, []int{third, second, first}},
+		{SearchQuery{Text: "fan redis"}, []int{second, first}},
+		{SearchQuery{Text: `"fan out"`}, []int{first}},
+		{SearchQuery{Text: "redis nowhere"}, nil},
+		{SearchQuery{Text: "redis", Uid: a}, []int{third, first}},
+		{SearchQuery{Text: "redis", Since: 150, Until: 250}, []int{second}},
+		{SearchQuery{Text: "redis", ByRelevance: true}, []int{third, first, second}},
+		{SearchQuery{Text: "redis", Page: 2, Count: 2}, []int{first}},
+	}
+	for _, test := range tests {
+		if test.q.Page == 0 {
+			test.q.Page, test.q.Count = 1, 30
+		}
+		if got, err := db.Search(test.q); err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Search(%+v) == %v, %v, want %v\n", test.q, got, err, test.want)
+		}
+	}
+
+	db.EditStatus(a, first, "now about lua")
+	db.DeleteStatus(b, second)
+	if got, _ := db.Search(SearchQuery{Text: "redis", Page: 1, Count: 30}); !reflect.DeepEqual(got, []int{third}) {
+		t.Errorf("after edit and delete == %v\n", got)
+	}
+	if got, _ := db.Search(SearchQuery{Text: "lua", Page: 1, Count: 30}); !reflect.DeepEqual(got, []int{first}) {
+		t.Errorf("edited words == %v\n", got)
+	}
+	if n, _ := c.Do("EXISTS", db.key("search:fast")); n.(int64) != 0 {
+		t.Error("the words of the old message are still indexed")
+	}
+	if n, err := db.RebuildSearch(); n != 2 || err != nil {
+		t.Errorf("rebuild == %d, %v\n", n, err)
+	}
+
+	// statuses of one second are paged by id, not by the text of it
+	var tied []int
+	for j := 0; j < 12; j++ {
+		sid, _ := db.PostStatus(b, "tied")
+		c.Do("HSET", db.idKey("status:", sid), "posted", 500)
+		tied = append(tied, sid)
+	}
+	db.RebuildSearch()
+	for page := 1; page <= 4; page++ {
+		want := []int{tied[12-3*page+2], tied[12-3*page+1], tied[12-3*page]}
+		if got, _ := db.Search(SearchQuery{Text: "tied", Page: page, Count: 3}); !reflect.DeepEqual(got, want) {
+			t.Errorf("tied page %d == %v, want %v\n", page, got, want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package myredisDB
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+)
+
+/*
+ * Store is everything the http handlers need from the data layer.
+ * DB implements it on top of redis, MemoryDB keeps the same data model
+ * in process memory so the service can run without a redis server.
+ */
+type Store interface {
+	CreateUser(login, name string) (int, error)
+	DeleteUser(uid int) (bool, error)
+	GetUser(uid int) (*User, error)
+	UpdateProfile(uid int, name string) (bool, error)
+	SearchUsers(q string, count int) ([]int, error)
+
+	PostStatus(uid int, message string) (int, error)
+	GetStatus(sid int) (Status, error)
+	GetStatuses(ids []int) ([]Status, []int, error)
+	DeleteStatus(uid, sid int) (bool, error)
+	EditStatus(uid, sid int, message string) (bool, error)
+	StatusHistory(sid int) ([]Revision, error)
+	PostReply(uid, parent int, message string) (int, error)
+	Conversation(sid int) (Conversation, error)
+	Reshare(uid, sid int) (bool, error)
+	Unreshare(uid, sid int) (bool, error)
+	ResharedBy(uid int, sids []int) (map[int]int, error)
+	Like(uid, sid int) (bool, error)
+	Unlike(uid, sid int) (bool, error)
+	Likers(sid, page, count int) ([]int, error)
+	Liked(uid, page, count int) ([]int, error)
+	GetMentions(uid, page, count int) ([]int, error)
+	GetTagTimeline(tag string, page, count int) ([]int, error)
+	Search(q SearchQuery) ([]int, error)
+	Trending(window string, n int) ([]Trend, error)
+
+	Notifications(uid, page, count int) ([]Notification, error)
+	UnreadNotifications(uid int) (int, error)
+	MarkNotificationsRead(uid int, upTo int64) error
+
+	GetUserTimeline(uid, page, count int) ([]int, error)
+
+	Follow(uid, otherid int) (bool, error)
+	Unfollow(uid, otherid int) (bool, error)
+}
+
+// both backends must satisfy the interface
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*MemoryDB)(nil)
+)
+
+var (
+	// ErrNotFound is returned by DeleteUser and the status changes for a user or
+	// status that does not exist. it is redis.ErrNil, which both backends
+	// have always returned for a missing user
+	ErrNotFound = redis.ErrNil
+	// ErrNotOwner is returned for a change to a status of another user
+	ErrNotOwner = errors.New("myredisDB: the status belongs to another user")
+)
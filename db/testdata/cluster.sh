@@ -0,0 +1,29 @@
+#!/bin/sh
+# starts a three master redis cluster on ports 7000-7002 for the cluster
+# tests, then run them with
+#
+#	REDIS_CLUSTER=127.0.0.1:7000 go test
+#
+# "cluster.sh stop" shuts the nodes down again.
+set -e
+dir=${TMPDIR:-/tmp}/simple-cluster
+ports="7000 7001 7002"
+
+if [ "$1" = "stop" ]; then
+	for port in $ports; do
+		redis-cli -p $port shutdown nosave || true
+	done
+	rm -rf "$dir"
+	exit 0
+fi
+
+nodes=""
+for port in $ports; do
+	mkdir -p "$dir/$port"
+	redis-server --port $port --cluster-enabled yes \
+		--cluster-config-file "$dir/$port/nodes.conf" --dir "$dir/$port" \
+		--save "" --appendonly no --daemonize yes
+	nodes="$nodes 127.0.0.1:$port"
+done
+sleep 1
+redis-cli --cluster create $nodes --cluster-replicas 0 --cluster-yes
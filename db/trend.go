@@ -0,0 +1,228 @@
+package myredisDB
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+ * trending hashtags
+ *
+ * PostStatus counts the hashtags of every new status in time buckets,
+ * for each trend window:
+ *
+ *   trend:<window>:<bucket start>  zset of tag -> uses in the bucket
+ *
+ * a bucket expires once it has left the window after its own, so the
+ * buckets of the last two windows are kept. Trending ranks the tags by
+ * velocity: the uses per hour in the window, each weighing half as much
+ * for every quarter of the window that has passed since, less the uses
+ * per hour in the window before. a tag used as much as before does not
+ * trend, however common it is. edits and deletes do not change the
+ * counts.
+ */
+
+const (
+	// tags read per bucket, the rest is too rare to trend
+	trendScan = 1000
+)
+
+// ErrUnknownWindow is returned by Trending for a window that is not
+// configured
+var ErrUnknownWindow = errors.New("myredisDB: unknown trend window")
+
+// TrendWindow is a period hashtags are ranked over, counted in buckets
+// of Bucket. Length must be a multiple of Bucket.
+type TrendWindow struct {
+	Name   string
+	Length time.Duration
+	Bucket time.Duration
+}
+
+// Trend is a hashtag ranked by Trending
+type Trend struct {
+	Tag string `json:"tag"`
+	// uses in the window
+	Count int `json:"count"`
+	// uses in the window before
+	Previous int `json:"previous"`
+	// decayed uses per hour, less the uses per hour in the window before
+	Score float64 `json:"score"`
+}
+
+// DefaultTrendWindows are the last hour in 5 minute buckets and the last
+// day in hourly buckets
+func DefaultTrendWindows() []TrendWindow {
+	return []TrendWindow{
+		{Name: "1h", Length: time.Hour, Bucket: 5 * time.Minute},
+		{Name: "24h", Length: 24 * time.Hour, Bucket: time.Hour},
+	}
+}
+
+// TrendWindows replaces the windows hashtags are counted and ranked in.
+// NewDBWithOptions fails for windows checkTrendWindows does not accept.
+func TrendWindows(windows ...TrendWindow) Option {
+	return func(db *DB) {
+		db.trendWindows = windows
+	}
+}
+
+// checkTrendWindows tells why windows can not be counted in: a bucket
+// has to be a whole number of seconds and a window a whole number of
+// buckets
+func checkTrendWindows(windows []TrendWindow) error {
+	for _, w := range windows {
+		switch {
+		case w.Bucket < time.Second || w.Bucket%time.Second != 0:
+			return fmt.Errorf("myredisDB: trend window %q: bucket %v is not a whole number of seconds",
+				w.Name, w.Bucket)
+		case w.Length < w.Bucket || w.Length%w.Bucket != 0:
+			return fmt.Errorf("myredisDB: trend window %q: length %v is not a multiple of the bucket %v",
+				w.Name, w.Length, w.Bucket)
+		}
+	}
+	return nil
+}
+
+// bucket returns the start of the bucket t falls in
+func (w TrendWindow) bucket(t int64) int64 {
+	size := int64(w.Bucket / time.Second)
+	return t - t%size
+}
+
+// buckets returns the starts of the buckets in the window and in the
+// window before it, newest first
+func (w TrendWindow) buckets(now int64) []int64 {
+	size := int64(w.Bucket / time.Second)
+	n := int(w.Length / w.Bucket)
+	starts := make([]int64, 2*n)
+	for j := range starts {
+		starts[j] = w.bucket(now) - int64(j)*size
+	}
+	return starts
+}
+
+// expires returns when the bucket starting at start leaves the window
+// after its own, the last one it is compared with
+func (w TrendWindow) expires(start int64) int64 {
+	return start + int64((2*w.Length+w.Bucket)/time.Second)
+}
+
+// rankTrends scores the tags counted in the buckets starting at starts,
+// those of the window and then those of the window before, and returns
+// the n best of the tags used in the window
+func rankTrends(w TrendWindow, starts []int64, counts []map[string]int, n int, now int64) []Trend {
+	halfLife := w.Length.Seconds() / 4
+	inWindow := int(w.Length / w.Bucket)
+	byTag := make(map[string]*Trend)
+	for j, start := range starts {
+		// the middle of the bucket, the current one is only partly over
+		age := float64(now-start) - w.Bucket.Seconds()/2
+		if age < 0 {
+			age = 0
+		}
+		weight := math.Pow(0.5, age/halfLife) / w.Length.Hours()
+		for tag, count := range counts[j] {
+			t, ok := byTag[tag]
+			if !ok {
+				t = &Trend{Tag: tag}
+				byTag[tag] = t
+			}
+			if j < inWindow {
+				t.Count += count
+				t.Score += float64(count) * weight
+			} else {
+				t.Previous += count
+				t.Score -= float64(count) / w.Length.Hours()
+			}
+		}
+	}
+
+	trends := make([]Trend, 0, len(byTag))
+	for _, t := range byTag {
+		if t.Count > 0 {
+			trends = append(trends, *t)
+		}
+	}
+	sort.Slice(trends, func(i, j int) bool {
+		if trends[i].Score != trends[j].Score {
+			return trends[i].Score > trends[j].Score
+		}
+		if trends[i].Count != trends[j].Count {
+			return trends[i].Count > trends[j].Count
+		}
+		return trends[i].Tag < trends[j].Tag
+	})
+	if len(trends) > n {
+		trends = trends[:n]
+	}
+	return trends
+}
+
+// findTrendWindow finds a window by name
+func findTrendWindow(windows []TrendWindow, name string) (TrendWindow, bool) {
+	for _, w := range windows {
+		if w.Name == name {
+			return w, true
+		}
+	}
+	return TrendWindow{}, false
+}
+
+// trendKey returns the key of a bucket
+func (db *DB) trendKey(w TrendWindow, start int64) string {
+	return db.key("trend:" + w.Name + ":" + strconv.FormatInt(start, 10))
+}
+
+// countTrends counts the uses of tags at time at in every window
+func (db *DB) countTrends(c redis.Conn, tags []string, at int64) error {
+	if len(tags) == 0 || len(db.trendWindows) == 0 {
+		return nil
+	}
+	for _, w := range db.trendWindows {
+		start := w.bucket(at)
+		key := db.trendKey(w, start)
+		for _, tag := range tags {
+			c.Send("ZINCRBY", key, 1, tag)
+		}
+		c.Send("EXPIREAT", key, w.expires(start))
+	}
+	_, err := c.Do("")
+	return err
+}
+
+// Trending returns the n hashtags whose use grew the most in a window
+// over the window before, recent uses counting more
+func (db *DB) Trending(window string, n int) ([]Trend, error) {
+	return db.trending(window, n, time.Now().Unix())
+}
+
+func (db *DB) trending(window string, n int, now int64) ([]Trend, error) {
+	w, ok := findTrendWindow(db.trendWindows, window)
+	if !ok {
+		return nil, ErrUnknownWindow
+	}
+	c := db.Get()
+	defer c.Close()
+
+	starts := w.buckets(now)
+	for _, start := range starts {
+		c.Send("ZREVRANGE", db.trendKey(w, start), 0, trendScan-1, "WITHSCORES")
+	}
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]map[string]int, len(starts))
+	for j := range starts {
+		if counts[j], err = redis.IntMap(r[j], nil); err != nil {
+			return nil, err
+		}
+	}
+	return rankTrends(w, starts, counts, n, now), nil
+}
@@ -0,0 +1,99 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"testing"
+	"time"
+)
+
+// tests that recent uses outrank older ones, the windows are apart and
+// the buckets expire
+func TestTrending(t *testing.T) {
+	db := newTestDB(t, "trend")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	// the buckets expire at real times
+	now := time.Now().Unix()
+	hour := int64(time.Hour / time.Second)
+	// three old uses of #old, two recent ones of #new
+	db.countTrends(c, []string{"old", "both"}, now-50*60)
+	db.countTrends(c, []string{"old"}, now-50*60)
+	db.countTrends(c, []string{"old"}, now-45*60)
+	db.countTrends(c, []string{"new", "both"}, now-60)
+	db.countTrends(c, []string{"new"}, now)
+	// only in the day
+	db.countTrends(c, []string{"yesterday"}, now-10*hour)
+
+	trends, err := db.trending("1h", 10, now)
+	if err != nil || len(trends) != 3 {
+		t.Fatalf("1h == %+v, %v\n", trends, err)
+	}
+	if trends[0].Tag != "new" || trends[0].Count != 2 || trends[1].Tag != "both" ||
+		trends[2].Tag != "old" || trends[2].Count != 3 {
+		t.Errorf("1h == %+v\n", trends)
+	}
+	if trends, _ := db.trending("1h", 1, now); len(trends) != 1 {
+		t.Errorf("top 1 == %+v\n", trends)
+	}
+	if trends, _ := db.trending("24h", 10, now); len(trends) != 4 || trends[3].Tag != "yesterday" {
+		t.Errorf("24h == %+v\n", trends)
+	}
+	if _, err := db.trending("1w", 10, now); err != ErrUnknownWindow {
+		t.Errorf("unknown window err == %v\n", err)
+	}
+
+	// the hourly bucket of the newest use lives until it leaves the
+	// day after, which it is compared with
+	w, _ := findTrendWindow(db.trendWindows, "24h")
+	ttl, _ := redis.Int64(c.Do("TTL", db.trendKey(w, w.bucket(now))))
+	if ttl <= 48*hour || ttl > 49*hour {
+		t.Errorf("bucket ttl == %d\n", ttl)
+	}
+}
+
+// tests that a tag trends by its growth over the window before, not by
+// how much it is used
+func TestTrendingVelocity(t *testing.T) {
+	db := newTestDB(t, "trendvelocity")
+	defer db.DropNamespace()
+	c := db.Get()
+	defer c.Close()
+
+	now := time.Now().Unix()
+	for j := 0; j < 4; j++ {
+		db.countTrends(c, []string{"steady"}, now-90*60)
+		db.countTrends(c, []string{"steady"}, now-60)
+	}
+	db.countTrends(c, []string{"rising"}, now-60)
+	db.countTrends(c, []string{"rising"}, now)
+	// used before, but not in the window
+	db.countTrends(c, []string{"gone"}, now-90*60)
+
+	trends, err := db.trending("1h", 10, now)
+	if err != nil || len(trends) != 2 {
+		t.Fatalf("1h == %+v, %v\n", trends, err)
+	}
+	if trends[0].Tag != "rising" || trends[0].Previous != 0 ||
+		trends[1].Tag != "steady" || trends[1].Count != 4 || trends[1].Previous != 4 {
+		t.Errorf("1h == %+v\n", trends)
+	}
+}
+
+// tests that windows that can not be counted in are refused
+func TestTrendWindowsChecked(t *testing.T) {
+	bad := []TrendWindow{
+		{Name: "tiny", Length: time.Second, Bucket: time.Millisecond},
+		{Name: "uneven", Length: time.Hour, Bucket: 7 * time.Minute},
+		{Name: "empty", Length: 0, Bucket: time.Minute},
+	}
+	for _, w := range bad {
+		if _, err := NewDBWithOptions(DefaultOptions(), TrendWindows(w)); err == nil {
+			t.Errorf("window %+v was accepted\n", w)
+		}
+	}
+	if _, err := NewDBWithOptions(DefaultOptions(), TrendWindows(DefaultTrendWindows()...)); err != nil {
+		t.Errorf("default windows err == %v\n", err)
+	}
+}
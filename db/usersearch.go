@@ -0,0 +1,328 @@
+package myredisDB
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * user search
+ *
+ *   names:  zset of "<term>:<uid>", all scored 0. the terms of a user are
+ *           the login and the words of the login and name, in lower case
+ *
+ * a prefix is looked up with ZRANGEBYLEX. a query word of fuzzyMinLength
+ * characters or more also finds terms that start one typo away from it,
+ * a wrong, missing, extra or swapped character, as long as the typo is
+ * not in the first half of the word. CreateUser,
+ * UpdateProfile and DeleteUser keep the index up to date,
+ * RebuildUserSearch writes it from the user hashes.
+ */
+
+const (
+	// terms read per ZRANGEBYLEX, a prefix matching more terms is ranked
+	// among the first ones only
+	userScan = 1000
+	// shortest query word that is matched with a typo
+	fuzzyMinLength = 4
+)
+
+// userTerms returns what a user is found by
+func userTerms(login, name string) []string {
+	terms := []string{strings.ToLower(login)}
+	terms = append(terms, words(login)...)
+	return distinct(append(terms, words(name)...))
+}
+
+// userMembers returns the members of names: for a user
+func userMembers(uid int, login, name string) redis.Args {
+	var members redis.Args
+	for _, term := range userTerms(login, name) {
+		members = append(members, term+":"+strconv.Itoa(uid))
+	}
+	return members
+}
+
+// sendIndexUser queues adding a user to names:
+func (db *DB) sendIndexUser(c redis.Conn, uid int, login, name string) {
+	args := redis.Args{}.Add(db.key("names:"))
+	for _, m := range userMembers(uid, login, name) {
+		args = args.Add(0, m)
+	}
+	c.Send("ZADD", args...)
+}
+
+// sendUnindexUser queues taking a user out of names:
+func (db *DB) sendUnindexUser(c redis.Conn, uid int, login, name string) {
+	c.Send("ZREM", redis.Args{}.Add(db.key("names:")).Add(userMembers(uid, login, name)...)...)
+}
+
+// UpdateProfile changes the name of a user
+func (db *DB) UpdateProfile(uid int, name string) (bool, error) {
+	c := db.Get()
+	defer c.Close()
+
+	r, err := redis.Values(c.Do("HMGET", db.idKey("user:", uid), "login", "name"))
+	if err != nil {
+		return false, err
+	}
+	if r[0] == nil {
+		return false, ErrNotFound
+	}
+	var login, old string
+	if _, err := redis.Scan(r, &login, &old); err != nil {
+		return false, err
+	}
+
+	c.Send("HSET", db.idKey("user:", uid), "name", name)
+	db.sendUnindexUser(c, uid, login, old)
+	db.sendIndexUser(c, uid, login, name)
+	if _, err := c.Do(""); err != nil {
+		return false, err
+	}
+	db.invalidate(c, userCacheKey(uid))
+	return true, nil
+}
+
+// userQuery is a parsed user search
+type userQuery []string
+
+// parseUserQuery reads the words of a user search, an "@" in front of a
+// login is dropped
+func parseUserQuery(q string) userQuery {
+	return userQuery(distinct(words(q)))
+}
+
+// match tells if every word of the query starts one of the terms, and
+// if that takes a typo
+func (q userQuery) match(terms []string) (ok, exact bool) {
+	exact = true
+	for _, w := range q {
+		found, typo := false, false
+		for _, term := range terms {
+			if strings.HasPrefix(term, w) {
+				found = true
+				break
+			}
+			if fuzzyPrefix(term, w) {
+				typo = true
+			}
+		}
+		if !found && !typo {
+			return false, false
+		}
+		if !found {
+			exact = false
+		}
+	}
+	return true, exact
+}
+
+// fuzzyPrefix tells if term starts one typo away from w
+func fuzzyPrefix(term, w string) bool {
+	t, p := []rune(term), []rune(w)
+	if len(p) < fuzzyMinLength {
+		return false
+	}
+	for n := len(p) - 1; n <= len(p)+1; n++ {
+		if n <= len(t) && editDistance(t[:n], p) <= 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// editDistance counts the insertions, deletions, substitutions and
+// swaps of two neighbours between a and b
+func editDistance(a, b []rune) int {
+	// the rows for a[:i-2], a[:i-1] and a[:i]
+	before := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && before[j-2]+1 < cur[j] {
+				cur[j] = before[j-2] + 1
+			}
+		}
+		before, prev, cur = prev, cur, before
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// userHit is a user that matched
+type userHit struct {
+	uid       int
+	login     string
+	followers int
+	exact     bool
+}
+
+// rankUsers puts the users matched without a typo first, then the ones
+// with the most followers, and returns the first count
+func rankUsers(hits []userHit, count int) []int {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].exact != hits[j].exact {
+			return hits[i].exact
+		}
+		if hits[i].followers != hits[j].followers {
+			return hits[i].followers > hits[j].followers
+		}
+		return hits[i].login < hits[j].login
+	})
+	if len(hits) > count {
+		hits = hits[:count]
+	}
+	uids := make([]int, 0, len(hits))
+	for _, h := range hits {
+		uids = append(uids, h.uid)
+	}
+	return uids
+}
+
+// SearchUsers returns up to count users whose login or name words start
+// with the words of q, the ones with the most followers first
+func (db *DB) SearchUsers(q string, count int) ([]int, error) {
+	query := parseUserQuery(q)
+	if len(query) == 0 || count < 1 {
+		return nil, nil
+	}
+	// the longest word has the fewest terms to read
+	longest := query[0]
+	for _, w := range query {
+		if len(w) > len(longest) {
+			longest = w
+		}
+	}
+	c := db.Get()
+	defer c.Close()
+
+	prefixes := []string{longest}
+	if p := []rune(longest); len(p) >= fuzzyMinLength {
+		prefixes = append(prefixes, string(p[:len(p)/2]))
+	}
+	candidates := make(map[int]bool)
+	for _, prefix := range prefixes {
+		members, err := redis.Strings(c.Do("ZRANGEBYLEX", db.key("names:"),
+			"["+prefix, "["+prefix+"\xff", "LIMIT", 0, userScan))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range members {
+			at := strings.LastIndexByte(m, ':')
+			if uid, err := strconv.Atoi(m[at+1:]); err == nil {
+				candidates[uid] = true
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	uids := make([]int, 0, len(candidates))
+	for uid := range candidates {
+		uids = append(uids, uid)
+		c.Send("HMGET", db.idKey("user:", uid), "login", "name", "followers")
+	}
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	var hits []userHit
+	for j, uid := range uids {
+		fields, _ := redis.Values(r[j], nil)
+		// deleted since it was indexed
+		if len(fields) != 3 || fields[0] == nil {
+			continue
+		}
+		var login, name string
+		var followers int
+		if _, err := redis.Scan(fields, &login, &name, &followers); err != nil {
+			return nil, err
+		}
+		if ok, exact := query.match(userTerms(login, name)); ok {
+			hits = append(hits, userHit{uid: uid, login: login,
+				followers: followers, exact: exact})
+		}
+	}
+	return rankUsers(hits, count), nil
+}
+
+// RebuildUserSearch drops names: and writes it again from the user
+// hashes, it returns how many users it indexed
+func (db *DB) RebuildUserSearch() (int, error) {
+	c := db.Get()
+	defer c.Close()
+
+	if _, err := c.Do("DEL", db.key("names:")); err != nil {
+		return 0, err
+	}
+	// users being deleted are left out, like DeleteUser does
+	deleting, err := redis.Ints(c.Do("SMEMBERS", db.key("users:deleting")))
+	if err != nil {
+		return 0, err
+	}
+	skip := make(map[int]bool)
+	for _, uid := range deleting {
+		skip[uid] = true
+	}
+	indexed := 0
+	err = db.scanKeys("user:*", func(keys []string) error {
+		var uids []int
+		for _, key := range keys {
+			// skips the "user:id" counter
+			if uid, ok := db.keyID("user:", key); ok && !skip[uid] {
+				uids = append(uids, uid)
+				c.Send("HMGET", key, "login", "name")
+			}
+		}
+		if len(uids) == 0 {
+			return nil
+		}
+		r, err := redis.Values(c.Do(""))
+		if err != nil {
+			return err
+		}
+		pending := 0
+		for j, uid := range uids {
+			fields, _ := redis.Values(r[j], nil)
+			if len(fields) != 2 || fields[0] == nil {
+				continue
+			}
+			var login, name string
+			if _, err := redis.Scan(fields, &login, &name); err != nil {
+				return err
+			}
+			db.sendIndexUser(c, uid, login, name)
+			pending++
+		}
+		indexed += pending
+		if pending == 0 {
+			return nil
+		}
+		_, err = c.Do("")
+		return err
+	})
+	return indexed, err
+}
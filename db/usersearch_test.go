@@ -0,0 +1,84 @@
+package myredisDB
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFuzzyPrefix(t *testing.T) {
+	tests := []struct {
+		term, w string
+		want    bool
+	}{
+		{"myers", "myres", true},
+		{"myers", "myeers", true},
+		{"myers", "mers", true},
+		{"steven", "stevn", true},
+		{"myers", "mxyz", false},
+		// too short to forgive a typo
+		{"bob", "bib", false},
+	}
+	for _, test := range tests {
+		if got := fuzzyPrefix(test.term, test.w); got != test.want {
+			t.Errorf("fuzzyPrefix(%q, %q) == %v\n", test.term, test.w, got)
+		}
+	}
+}
+
+// tests prefixes, typos, the follower order and that the index follows
+// profile changes and deletes
+func TestSearchUsers(t *testing.T) {
+	db := newTestDB(t, "usersearch")
+	defer db.DropNamespace()
+
+	slm, _ := db.CreateUser("slmyers", "Steven Myers")
+	sly, _ := db.CreateUser("sly", "Sly Stone")
+	other, _ := db.CreateUser("other", "Someone Else")
+	db.Follow(other, sly)
+
+	tests := []struct {
+		q    string
+		want []int
+	}{
+		{"@SL", []int{sly, slm}},
+		{"myers", []int{slm}},
+		{"steven my", []int{slm}},
+		{"myres", []int{slm}},
+		{"nobody", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		if got, err := db.SearchUsers(test.q, 10); err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SearchUsers(%q) == %v, %v, want %v\n", test.q, got, err, test.want)
+		}
+	}
+	if got, _ := db.SearchUsers("sl", 1); !reflect.DeepEqual(got, []int{sly}) {
+		t.Errorf("count 1 == %v\n", got)
+	}
+
+	db.UpdateProfile(slm, "Steve Smith")
+	if got, _ := db.SearchUsers("myers", 10); len(got) != 0 {
+		t.Errorf("old name == %v\n", got)
+	}
+	if got, _ := db.SearchUsers("smith", 10); !reflect.DeepEqual(got, []int{slm}) {
+		t.Errorf("new name == %v\n", got)
+	}
+	if user, _ := db.GetUser(slm); user.Name != "Steve Smith" {
+		t.Errorf("user == %+v\n", user)
+	}
+	if _, err := db.UpdateProfile(other+10, "x"); err != ErrNotFound {
+		t.Errorf("missing user err == %v\n", err)
+	}
+
+	db.DeleteUser(sly)
+	if got, _ := db.SearchUsers("sl", 10); !reflect.DeepEqual(got, []int{slm}) {
+		t.Errorf("after delete == %v\n", got)
+	}
+	if n, err := db.RebuildUserSearch(); n != 2 || err != nil {
+		t.Errorf("rebuild == %d, %v\n", n, err)
+	}
+	// no followers left, ties go by login
+	if got, _ := db.SearchUsers("s", 10); !reflect.DeepEqual(got, []int{other, slm}) {
+		t.Errorf("after rebuild == %v\n", got)
+	}
+}
@@ -0,0 +1,323 @@
+package myredisDB
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * asynchronous fan-out
+ *
+ * with AsyncFanout PostStatus only writes the status and the author's
+ * timeline, the follower fan-out is queued on the fanout:jobs stream.
+ * workers in the "fanout" consumer group push the statuses, acknowledge
+ * and delete the jobs, and take over jobs that a dead worker left
+ * unacknowledged. pushing a status twice is harmless, so a job that is
+ * processed again after a crash does no damage.
+ */
+
+const (
+	fanoutGroup = "fanout"
+	// jobs read per XREADGROUP / XAUTOCLAIM call
+	fanoutBatch = 10
+	// followers pushed per MULTI
+	syndicateBatch = 1000
+	// how long a worker blocks waiting for jobs, also bounds Stop
+	fanoutBlock = time.Second
+)
+
+// AsyncFanout queues the follower fan-out of new statuses on a redis
+// stream, it is done by the workers started with StartFanout.
+func AsyncFanout() Option {
+	return func(db *DB) {
+		db.asyncFanout = true
+	}
+}
+
+// Fanout is a pool of running fan-out workers
+type Fanout struct {
+	db        *DB
+	claimIdle time.Duration
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// FanoutLag tells how far the follower timelines are behind
+type FanoutLag struct {
+	// queued jobs that are not done yet
+	Backlog int `json:"backlog"`
+	// jobs handed to a worker but not acknowledged
+	Pending int `json:"pending"`
+	// age in seconds of the oldest job that is not done
+	Behind float64 `json:"behind"`
+}
+
+// fanoutJob is one entry of the fanout:jobs stream
+type fanoutJob struct {
+	id     string
+	uid    int
+	sid    int
+	posted int64
+}
+
+// StartFanout starts n fan-out workers. jobs that a worker has not
+// acknowledged within claimIdle are taken over by the others.
+func (db *DB) StartFanout(n int, claimIdle time.Duration) (*Fanout, error) {
+	if err := db.createFanoutGroup(); err != nil {
+		return nil, err
+	}
+	f := &Fanout{db: db, claimIdle: claimIdle, stop: make(chan struct{})}
+
+	// consumer names have to be unique across every running server
+	host, _ := os.Hostname()
+	for i := 0; i < n; i++ {
+		f.wg.Add(1)
+		go f.work(fmt.Sprintf("%s-%d-%d", host, os.Getpid(), i))
+	}
+	return f, nil
+}
+
+// Lag reports how far the workers are behind
+func (f *Fanout) Lag() (FanoutLag, error) {
+	return f.db.FanoutLag()
+}
+
+// Stop waits for the workers to finish the jobs they are processing
+func (f *Fanout) Stop() {
+	close(f.stop)
+	f.wg.Wait()
+}
+
+func (f *Fanout) work(consumer string) {
+	defer f.wg.Done()
+	for {
+		select {
+		case <-f.stop:
+			return
+		default:
+		}
+
+		if err := f.step(consumer); err != nil {
+			log.Printf("fanout worker %s: %v\n", consumer, err)
+			select {
+			case <-f.stop:
+			case <-time.After(fanoutBlock):
+			}
+		}
+	}
+}
+
+// step processes one batch of jobs, abandoned ones first
+func (f *Fanout) step(consumer string) error {
+	c := f.db.Get()
+	defer c.Close()
+	stream := f.db.key("fanout:jobs")
+
+	r, err := redis.Values(c.Do("XAUTOCLAIM", stream, fanoutGroup, consumer,
+		int64(f.claimIdle/time.Millisecond), "0-0", "COUNT", fanoutBatch))
+	if err != nil {
+		return err
+	}
+	jobs, gone, err := scanFanoutJobs(r[1])
+	if err != nil {
+		return err
+	}
+	// entries deleted while pending would be claimed again forever
+	if len(gone) > 0 {
+		if _, err := c.Do("XACK", redis.Args{}.Add(stream, fanoutGroup).AddFlat(gone)...); err != nil {
+			return err
+		}
+	}
+
+	if len(jobs) == 0 {
+		r, err := redis.Values(c.Do("XREADGROUP", "GROUP", fanoutGroup, consumer,
+			"COUNT", fanoutBatch, "BLOCK", int64(fanoutBlock/time.Millisecond),
+			"STREAMS", stream, ">"))
+		if err == redis.ErrNil {
+			// nothing arrived while blocking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// one stream was read, reply is [[stream, entries]]
+		streams, err := redis.Values(r[0], nil)
+		if err != nil {
+			return err
+		}
+		if jobs, _, err = scanFanoutJobs(streams[1]); err != nil {
+			return err
+		}
+	}
+
+	for _, job := range jobs {
+		// a status deleted while its job was queued is not pushed
+		live, err := f.db.statusLive(c, job.sid)
+		if err != nil {
+			return err
+		}
+		if live {
+			if err := f.db.syndicateStatus(c, job.uid, job.sid, job.posted, false); err != nil {
+				return err
+			}
+		}
+		c.Send("MULTI")
+		c.Send("XACK", stream, fanoutGroup, job.id)
+		c.Send("XDEL", stream, job.id)
+		if _, err := c.Do("EXEC"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statusLive tells if a status exists and is not a tombstone
+func (db *DB) statusLive(c redis.Conn, sid int) (bool, error) {
+	r, err := redis.Values(c.Do("HMGET", db.idKey("status:", sid), "id", "deleted"))
+	if err != nil {
+		return false, err
+	}
+	return r[0] != nil && r[1] == nil, nil
+}
+
+// syndicateStatus pushes a status to the timelines of the followers of
+// uid, the author or, with reshared, a user who reshared it
+func (db *DB) syndicateStatus(c redis.Conn, uid, sid int, posted int64, reshared bool) error {
+	followers := db.idKey("followers:", uid)
+	for start := 0; ; start += syndicateBatch {
+		batch, err := redis.Ints(c.Do("ZRANGE", followers, start,
+			start+syndicateBatch-1))
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if reshared {
+			err = db.pushReshare(c, batch, uid, sid, posted)
+		} else {
+			c.Send("MULTI")
+			for _, follower := range batch {
+				timeline := db.idKey("timeline:", follower)
+				c.Send("ZADD", timeline, posted, sid)
+				if db.maxTimeline > 0 {
+					c.Send("ZREMRANGEBYRANK", timeline, 0, -(db.maxTimeline + 1))
+				}
+			}
+			_, err = c.Do("EXEC")
+		}
+		if err != nil {
+			return err
+		}
+		if len(batch) < syndicateBatch {
+			return nil
+		}
+	}
+}
+
+// FanoutLag reports the state of the fan-out queue
+func (db *DB) FanoutLag() (FanoutLag, error) {
+	var lag FanoutLag
+	if err := db.createFanoutGroup(); err != nil {
+		return lag, err
+	}
+	c := db.Get()
+	defer c.Close()
+	stream := db.key("fanout:jobs")
+
+	// jobs are deleted once they are done, so the length is the backlog
+	c.Send("XLEN", stream)
+	c.Send("XPENDING", stream, fanoutGroup)
+	c.Send("XRANGE", stream, "-", "+", "COUNT", 1)
+	r, err := redis.Values(c.Do(""))
+	if err != nil {
+		return lag, err
+	}
+
+	if lag.Backlog, err = redis.Int(r[0], nil); err != nil {
+		return lag, err
+	}
+	pending, err := redis.Values(r[1], nil)
+	if err != nil {
+		return lag, err
+	}
+	if lag.Pending, err = redis.Int(pending[0], nil); err != nil {
+		return lag, err
+	}
+
+	oldest, _, err := scanFanoutJobs(r[2])
+	if err != nil {
+		return lag, err
+	}
+	if len(oldest) > 0 {
+		// stream ids start with the time the job was added in ms
+		ms, err := strconv.ParseInt(strings.SplitN(oldest[0].id, "-", 2)[0], 10, 64)
+		if err != nil {
+			return lag, err
+		}
+		lag.Behind = time.Since(time.Unix(0, ms*int64(time.Millisecond))).Seconds()
+	}
+	return lag, nil
+}
+
+// creates the stream and the consumer group if they do not exist
+func (db *DB) createFanoutGroup() error {
+	c := db.Get()
+	defer c.Close()
+
+	_, err := c.Do("XGROUP", "CREATE", db.key("fanout:jobs"), fanoutGroup,
+		"0", "MKSTREAM")
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// scanFanoutJobs reads a list of stream entries, and the ids of the
+// entries that were deleted
+func scanFanoutJobs(reply interface{}) ([]fanoutJob, []string, error) {
+	entries, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jobs := make([]fanoutJob, 0, len(entries))
+	var gone []string
+	for _, entry := range entries {
+		e, err := redis.Values(entry, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		var job fanoutJob
+		if job.id, err = redis.String(e[0], nil); err != nil {
+			return nil, nil, err
+		}
+		// XAUTOCLAIM returns deleted entries without fields
+		if e[1] == nil {
+			gone = append(gone, job.id)
+			continue
+		}
+		fields, err := redis.StringMap(e[1], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if job.uid, err = strconv.Atoi(fields["uid"]); err != nil {
+			return nil, nil, err
+		}
+		if job.sid, err = strconv.Atoi(fields["sid"]); err != nil {
+			return nil, nil, err
+		}
+		if job.posted, err = strconv.ParseInt(fields["posted"], 10, 64); err != nil {
+			return nil, nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, gone, nil
+}
@@ -7,9 +7,16 @@ type UserPayload struct {
 	Name     string `json:"name"`
 }
 
+type ProfilePayload struct {
+	Uid  int    `json:"uid"`
+	Name string `json:"name"`
+}
+
 type StatusPayload struct {
 	Uid int    `json:"uid"`
 	Msg string `json:"msg"`
+	// the status answered, 0 for a new conversation
+	InReplyTo int `json:"in_reply_to"`
 }
 
 type TimelineResponse struct {
@@ -18,6 +25,41 @@ type TimelineResponse struct {
 	Posts Statuses `json:"posts"`
 }
 
+type TagResponse struct {
+	Tag   string   `json:"tag"`
+	Page  int      `json:"page"`
+	Posts Statuses `json:"posts"`
+}
+
+type SearchResponse struct {
+	Query string   `json:"q"`
+	Page  int      `json:"page"`
+	Posts Statuses `json:"posts"`
+}
+
+type AutocompleteResponse struct {
+	Query string            `json:"q"`
+	Users []*myredisDB.User `json:"users"`
+}
+
+type TrendingResponse struct {
+	Window string            `json:"window"`
+	Tags   []myredisDB.Trend `json:"tags"`
+}
+
+type NotificationsResponse struct {
+	Uid           int                      `json:"uid"`
+	Page          int                      `json:"page"`
+	Unread        int                      `json:"unread"`
+	Notifications []myredisDB.Notification `json:"notifications"`
+}
+
+type LikersResponse struct {
+	Sid   int               `json:"sid"`
+	Page  int               `json:"page"`
+	Users []*myredisDB.User `json:"users"`
+}
+
 type Statuses []myredisDB.Status
 
 func (s Statuses) Len() int      { return len(s) }
@@ -6,19 +6,247 @@ package main
 
 import (
 	rdb "./db"
+	"flag"
 	"github.com/slmyers/go-json-rest/rest"
 	"log"
 	"net/http"
 	"net/url"
-	"sort"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
+var (
+	fanoutWorkers = flag.Int("fanout-workers", 0,
+		"push statuses to follower timelines with this many stream workers, "+
+			"0 pushes them while posting")
+	fanoutThreshold = flag.Int("fanout-threshold", 0,
+		"merge statuses of authors with more followers than this into "+
+			"timelines on read instead of pushing them, 0 always pushes")
+	maxTimeline = flag.Int("max-timeline", 0,
+		"keep only this many entries in each timeline, 0 keeps everything")
+	clusterNodes = flag.String("cluster", "",
+		"comma separated nodes of a redis cluster to use instead of a "+
+			"single redis server")
+	cacheSize = flag.Int("cache-size", 0,
+		"keep this many users and statuses in memory, 0 disables the cache")
+	cacheTTL = flag.Duration("cache-ttl", time.Minute,
+		"drop cached users and statuses after this long, 0 keeps them")
+	editWindow = flag.Duration("edit-window", 0,
+		"let statuses be edited this long after posting, 0 always lets them")
+)
+
+// redis connection settings, every flag defaults to an environment variable
+var (
+	defaults = rdb.DefaultOptions()
+
+	redisAddr = flag.String("redis-addr", env("REDIS_ADDR", defaults.Addr),
+		"host:port of the redis server ($REDIS_ADDR)")
+	redisUser = flag.String("redis-user", env("REDIS_USERNAME", ""),
+		"redis ACL user ($REDIS_USERNAME)")
+	// defaults to $REDIS_PASSWORD in redisOptions, so -h never prints it
+	redisPassword = flag.String("redis-password", "",
+		"redis password, better passed as $REDIS_PASSWORD")
+	redisDB = flag.Int("redis-db", envInt("REDIS_DB", defaults.Database),
+		"redis database index ($REDIS_DB)")
+	redisNamespace = flag.String("redis-namespace", env("REDIS_NAMESPACE", ""),
+		"prefix every key with this namespace ($REDIS_NAMESPACE)")
+
+	redisDialTimeout = flag.Duration("redis-dial-timeout",
+		envDuration("REDIS_DIAL_TIMEOUT", defaults.DialTimeout),
+		"connect timeout, 0 waits forever ($REDIS_DIAL_TIMEOUT)")
+	redisReadTimeout = flag.Duration("redis-read-timeout",
+		envDuration("REDIS_READ_TIMEOUT", defaults.ReadTimeout),
+		"read timeout, 0 waits forever ($REDIS_READ_TIMEOUT)")
+	redisWriteTimeout = flag.Duration("redis-write-timeout",
+		envDuration("REDIS_WRITE_TIMEOUT", defaults.WriteTimeout),
+		"write timeout, 0 waits forever ($REDIS_WRITE_TIMEOUT)")
+
+	redisMaxIdle = flag.Int("redis-max-idle",
+		envInt("REDIS_MAX_IDLE", defaults.MaxIdle),
+		"idle connections kept in the pool ($REDIS_MAX_IDLE)")
+	redisMaxActive = flag.Int("redis-max-active",
+		envInt("REDIS_MAX_ACTIVE", defaults.MaxActive),
+		"open connections at most, 0 is unlimited ($REDIS_MAX_ACTIVE)")
+	redisIdleTimeout = flag.Duration("redis-idle-timeout",
+		envDuration("REDIS_IDLE_TIMEOUT", defaults.IdleTimeout),
+		"close connections idle for longer ($REDIS_IDLE_TIMEOUT)")
+
+	redisTLS = flag.Bool("redis-tls", envBool("REDIS_TLS", defaults.TLS),
+		"connect to redis with TLS ($REDIS_TLS)")
+	redisTLSCA = flag.String("redis-tls-ca", env("REDIS_TLS_CA", ""),
+		"PEM file of the CA that signed the redis certificate ($REDIS_TLS_CA)")
+	redisTLSServerName = flag.String("redis-tls-server-name",
+		env("REDIS_TLS_SERVER_NAME", ""),
+		"name expected in the redis certificate ($REDIS_TLS_SERVER_NAME)")
+	redisTLSSkipVerify = flag.Bool("redis-tls-skip-verify",
+		envBool("REDIS_TLS_SKIP_VERIFY", false),
+		"do not verify the redis certificate ($REDIS_TLS_SKIP_VERIFY)")
+)
+
 func main() {
+	flag.Parse()
+	// ./server <command> runs an admin command instead of the server
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Arg(0), flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	i := Impl{}
 	i.InitDB()
 
+	handler, err := i.Handler()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(http.ListenAndServe(":8000", handler))
+}
+
+/* this is included as an example of how to serve files (webpages)*/
+func homeHandler(w rest.ResponseWriter, r *rest.Request) {
+	http.ServeFile(w.(http.ResponseWriter), r.Request,
+		r.URL.Path[1:])
+}
+
+// Impl only depends on rdb.Store, so it can be embedded with
+// rdb.NewMemoryDB() and served without a redis process.
+type Impl struct {
+	DB rdb.Store
+	// running fan-out workers, nil when statuses are pushed while posting
+	Fanout *rdb.Fanout
+	// cache invalidation listener, nil without a cache
+	Cache *rdb.CacheSync
+}
+
+func (i *Impl) InitDB() {
+	db := openDB()
+	i.DB = db
+
+	// the handlers expect the current key layout
+	if v, err := db.SchemaVersion(); err != nil {
+		log.Fatal(err)
+	} else if v < rdb.LatestSchema {
+		log.Printf("the data is in schema version %d of %d, "+
+			"run ./server migrate\n", v, rdb.LatestSchema)
+	}
+
+	// deletions a previous run did not finish
+	go func() {
+		if _, err := db.ResumeDeletes(); err != nil {
+			log.Printf("resuming deletions: %v\n", err)
+		}
+	}()
+
+	if *fanoutWorkers > 0 {
+		// jobs of a worker that died are taken over after a minute
+		f, err := db.StartFanout(*fanoutWorkers, time.Minute)
+		if err != nil {
+			log.Fatal(err)
+		}
+		i.Fanout = f
+	}
+	if *cacheSize > 0 {
+		s, err := db.StartCacheSync()
+		if err != nil {
+			log.Fatal(err)
+		}
+		i.Cache = s
+	}
+}
+
+// opens the redis DB the flags describe
+func openDB() *rdb.DB {
+	opts := []rdb.Option{rdb.Namespace(*redisNamespace),
+		rdb.FanoutThreshold(*fanoutThreshold), rdb.MaxTimeline(*maxTimeline),
+		rdb.EditWindow(*editWindow)}
+	if *fanoutWorkers > 0 {
+		opts = append(opts, rdb.AsyncFanout())
+	}
+	if *clusterNodes != "" {
+		opts = append(opts, rdb.Cluster(strings.Split(*clusterNodes, ",")...))
+	}
+	if *cacheSize > 0 {
+		opts = append(opts, rdb.Cache(*cacheSize, *cacheTTL))
+	}
+	db, err := rdb.NewDBWithOptions(redisOptions(), opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+// collects the redis connection settings from the flags
+func redisOptions() rdb.Options {
+	password := *redisPassword
+	if password == "" {
+		password = os.Getenv("REDIS_PASSWORD")
+	}
+	return rdb.Options{
+		Addr:          *redisAddr,
+		Username:      *redisUser,
+		Password:      password,
+		Database:      *redisDB,
+		DialTimeout:   *redisDialTimeout,
+		ReadTimeout:   *redisReadTimeout,
+		WriteTimeout:  *redisWriteTimeout,
+		MaxIdle:       *redisMaxIdle,
+		MaxActive:     *redisMaxActive,
+		IdleTimeout:   *redisIdleTimeout,
+		TLS:           *redisTLS,
+		TLSCAFile:     *redisTLSCA,
+		TLSServerName: *redisTLSServerName,
+		TLSSkipVerify: *redisTLSSkipVerify,
+	}
+}
+
+// env returns the environment variable name, or def if it is not set
+func env(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("%s: %v\n", name, err)
+	}
+	return n
+}
+
+func envBool(name string, def bool) bool {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("%s: %v\n", name, err)
+	}
+	return b
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s: %v\n", name, err)
+	}
+	return d
+}
+
+// builds the http handler serving all of the api routes
+func (i *Impl) Handler() (http.Handler, error) {
 	api := rest.NewApi()
 	api.Use(rest.DefaultDevStack...)
 
@@ -26,35 +254,40 @@ func main() {
 	router, err := rest.MakeRouter(
 		rest.Post("/user", i.CreateUser),
 		rest.Post("/status", i.PostStatus),
+		rest.Delete("/status", i.DeleteStatus),
+		rest.Put("/status", i.EditStatus),
+		rest.Get("/history", i.GetHistory),
+		rest.Get("/conversation", i.GetConversation),
 		rest.Post("/follow", i.FollowUser),
 		rest.Post("/unfollow", i.UnfollowUser),
+		rest.Post("/reshare", i.Reshare),
+		rest.Post("/unreshare", i.Unreshare),
+		rest.Post("/like", i.Like),
+		rest.Post("/unlike", i.Unlike),
+		rest.Get("/likers", i.GetLikers),
+		rest.Get("/liked", i.GetLiked),
+		rest.Get("/mentions", i.GetMentions),
+		rest.Get("/tag", i.GetTag),
+		rest.Get("/trending", i.GetTrending),
+		rest.Get("/notifications", i.GetNotifications),
+		rest.Get("/notifications/unread", i.GetUnreadNotifications),
+		rest.Post("/notifications/read", i.MarkNotificationsRead),
+		rest.Get("/search", i.Search),
 		rest.Get("/timeline", i.GetTimeline),
 		rest.Get("/user", i.GetUser),
+		rest.Put("/user", i.UpdateProfile),
+		rest.Get("/autocomplete", i.Autocomplete),
+		rest.Delete("/user", i.DeleteUser),
+		rest.Get("/fanout", i.GetFanoutLag),
+		rest.Get("/cache", i.GetCacheStats),
 		// uncomment if you would also like to serve files
 		//rest.Get("/", homeHandler),
 	)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	api.SetApp(router)
-	log.Fatal(http.ListenAndServe(":8000", api.MakeHandler()))
-}
-
-/* this is included as an example of how to serve files (webpages)*/
-func homeHandler(w rest.ResponseWriter, r *rest.Request) {
-	http.ServeFile(w.(http.ResponseWriter), r.Request,
-		r.URL.Path[1:])
-}
-
-type Impl struct {
-	DB *rdb.DB
-}
-
-func (i *Impl) InitDB() {
-	i.DB = rdb.NewDB("localhost:6379")
-	if i.DB == nil {
-		log.Fatal("i.DB is nil")
-	}
+	return api.MakeHandler(), nil
 }
 
 /*
@@ -101,6 +334,7 @@ func (i *Impl) CreateUser(w rest.ResponseWriter, r *rest.Request) {
    {
 		"uid": <user id>
 		"msg": <text string containing message>
+		"in_reply_to": <optional id of the status answered>
    }
 */
 func (i *Impl) PostStatus(w rest.ResponseWriter, r *rest.Request) {
@@ -110,8 +344,18 @@ func (i *Impl) PostStatus(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	sid, err := i.DB.PostStatus(status.Uid, status.Msg)
+	var sid int
+	var err error
+	if status.InReplyTo != 0 {
+		sid, err = i.DB.PostReply(status.Uid, status.InReplyTo, status.Msg)
+	} else {
+		sid, err = i.DB.PostStatus(status.Uid, status.Msg)
+	}
 
+	if err == rdb.ErrNotFound {
+		rest.NotFound(w, r)
+		return
+	}
 	if err != nil {
 		rest.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -229,47 +473,29 @@ func (i *Impl) GetTimeline(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
+	// one pipelined round trip, the statuses keep the timeline's order
+	posts, missing, err := i.DB.GetStatuses(res)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(missing) > 0 {
+		log.Printf("timeline:%d page:%d missing statuses %v\n", uid, page,
+			missing)
+	}
+	via, err := i.DB.ResharedBy(uid, res)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for j := range posts {
+		posts[j].ResharedBy = via[posts[j].Id]
+	}
+
 	output := new(TimelineResponse)
-	output.Posts = make([]rdb.Status, len(res))
+	output.Posts = posts
 	output.Uid = uid
 	output.Page = page
-	outputIndex := 0
-	// channel to send/recieve status structs
-	statuses := make(chan rdb.Status)
-	defer close(statuses)
-	var pst int
-	for j := 0; j < len(res); j++ {
-		pst = res[j]
-		// anon goroutine to get a status in timeline page
-		// this means that all statuses are fetched concurrently
-		go func(post int) {
-			status, err := i.DB.GetStatus(post)
-			if err != nil {
-				log.Printf("error getting post %d, %v\n", post, err)
-				return
-			}
-			// pipe the fetched status into the channel previously made
-			statuses <- status
-		}(pst)
-	}
-
-	// this code is blocking
-Loop:
-	for outputIndex < len(res) {
-		select {
-		case sts := <-statuses:
-			output.Posts[outputIndex] = sts
-			outputIndex++
-		case <-time.After(time.Second * 1):
-			log.Printf("timeout getting timeline:%d page:%d\n", uid,
-				page)
-			break Loop
-		}
-	}
-	// because the statuses were retrieved concurrently we can't be sure
-	// of what order they will appear in output.Posts, so we must sort them
-	// if we want them to appear from newest to oldest
-	sort.Sort(output.Posts)
 	w.WriteJson(&output)
 }
 
@@ -298,3 +524,702 @@ func (i *Impl) GetUser(w rest.ResponseWriter, r *rest.Request) {
 
 	w.WriteJson(&usr)
 }
+
+/*
+ * consumes JSON of the form
+   {
+		"uid": <user id>
+		"name": <new display name>
+   }
+*/
+func (i *Impl) UpdateProfile(w rest.ResponseWriter, r *rest.Request) {
+	var profile ProfilePayload
+	if err := r.DecodeJsonPayload(&profile); err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err := i.DB.UpdateProfile(profile.Uid, profile.Name)
+	switch {
+	case err == rdb.ErrNotFound:
+		rest.NotFound(w, r)
+		return
+	case err != nil:
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	usr, err := i.DB.GetUser(profile.Uid)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteJson(&usr)
+}
+
+/*
+ * handles requests of the form /autocomplete?q=@slm&count=10
+ * returns the users whose login or name starts with the words of q,
+ * forgiving a typo, the ones with the most followers first. count is
+ * optional, 10 by default and 50 at most
+ */
+
+func (i *Impl) Autocomplete(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	count := 10
+	if s := v.Get("count"); s != "" {
+		if count, err = strconv.Atoi(s); err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if count > 50 {
+		count = 50
+	}
+
+	uids, err := i.DB.SearchUsers(v.Get("q"), count)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	output := &AutocompleteResponse{Query: v.Get("q"), Users: []*rdb.User{}}
+	for _, uid := range uids {
+		usr, err := i.DB.GetUser(uid)
+		if err != nil {
+			rest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		output.Users = append(output.Users, usr)
+	}
+	w.WriteJson(&output)
+}
+
+/*
+ * handles requests of the form DELETE /status?uid=7&sid=12
+ * uid has to be the author of the status
+ */
+
+func (i *Impl) DeleteStatus(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uid, err := strconv.Atoi(v.Get("uid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sid, err := strconv.Atoi(v.Get("sid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res, err := i.DB.DeleteStatus(uid, sid)
+	switch {
+	case err == rdb.ErrNotFound:
+		rest.NotFound(w, r)
+		return
+	case err == rdb.ErrNotOwner:
+		rest.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteJson(map[string]string{"sid": v.Get("sid"),
+		"deleted": strconv.FormatBool(res)})
+}
+
+/*
+ * handles requests of the form PUT /status?sid=12 with a StatusPayload
+ * uid has to be the author of the status, the edited status is returned
+ */
+
+func (i *Impl) EditStatus(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sid, err := strconv.Atoi(v.Get("sid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var status StatusPayload
+	if err := r.DecodeJsonPayload(&status); err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = i.DB.EditStatus(status.Uid, sid, status.Msg)
+	switch {
+	case err == rdb.ErrNotFound:
+		rest.NotFound(w, r)
+		return
+	case err == rdb.ErrNotOwner, err == rdb.ErrEditWindow:
+		rest.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	post, err := i.DB.GetStatus(sid)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteJson(&post)
+}
+
+/*
+ * handles requests of the form /history?sid=12
+ * returns every message of the status, oldest first
+ */
+
+func (i *Impl) GetHistory(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sid, err := strconv.Atoi(v.Get("sid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	history, err := i.DB.StatusHistory(sid)
+	switch {
+	case err == rdb.ErrNotFound:
+		rest.NotFound(w, r)
+		return
+	case err != nil:
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteJson(&history)
+}
+
+/*
+ * handles requests of the form /reshare?uid=2&sid=12
+ * the status is pushed to the followers of uid
+ */
+
+func (i *Impl) Reshare(w rest.ResponseWriter, r *rest.Request) {
+	i.statusAction(w, r, i.DB.Reshare, "reshared")
+}
+
+/*
+ * handles requests of the form /unreshare?uid=2&sid=12
+ */
+
+func (i *Impl) Unreshare(w rest.ResponseWriter, r *rest.Request) {
+	i.statusAction(w, r, i.DB.Unreshare, "unreshared")
+}
+
+/*
+ * handles requests of the form /like?uid=2&sid=12
+ */
+
+func (i *Impl) Like(w rest.ResponseWriter, r *rest.Request) {
+	i.statusAction(w, r, i.DB.Like, "liked")
+}
+
+/*
+ * handles requests of the form /unlike?uid=2&sid=12
+ */
+
+func (i *Impl) Unlike(w rest.ResponseWriter, r *rest.Request) {
+	i.statusAction(w, r, i.DB.Unlike, "unliked")
+}
+
+/*
+ * handles requests of the form /likers?sid=12&page=1
+ * returns the users who liked the status, the latest first
+ */
+
+func (i *Impl) GetLikers(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sid, err := strconv.Atoi(v.Get("sid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page, err := strconv.Atoi(v.Get("page"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uids, err := i.DB.Likers(sid, page, 30)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	output := &LikersResponse{Sid: sid, Page: page, Users: []*rdb.User{}}
+	for _, uid := range uids {
+		usr, err := i.DB.GetUser(uid)
+		if err != nil {
+			rest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		output.Users = append(output.Users, usr)
+	}
+	w.WriteJson(&output)
+}
+
+/*
+ * handles requests of the form /liked?uid=7&page=1
+ * returns the statuses the user liked, the latest first
+ */
+
+func (i *Impl) GetLiked(w rest.ResponseWriter, r *rest.Request) {
+	i.statusList(w, r, i.DB.Liked)
+}
+
+/*
+ * handles requests of the form /mentions?uid=7&page=1
+ * returns the statuses that mention the user, the newest first
+ */
+
+func (i *Impl) GetMentions(w rest.ResponseWriter, r *rest.Request) {
+	i.statusList(w, r, i.DB.GetMentions)
+}
+
+/*
+ * handles requests of the form /tag?tag=golang&page=1
+ * returns the statuses with the hashtag, the newest first
+ */
+
+func (i *Impl) GetTag(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tag := rdb.NormalizeTag(v.Get("tag"))
+	if tag == "" {
+		rest.Error(w, "tag is required", http.StatusBadRequest)
+		return
+	}
+	page, err := strconv.Atoi(v.Get("page"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sids, err := i.DB.GetTagTimeline(tag, page, 30)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	posts, _, err := i.DB.GetStatuses(sids)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	output := &TagResponse{Tag: tag, Page: page, Posts: posts}
+	w.WriteJson(&output)
+}
+
+/*
+ * handles requests of the form /trending?window=1h&count=10
+ * returns the hashtags whose use grew the most in the window over the
+ * window before, recent uses counting more. window is 1h or 24h, 1h by
+ * default. count is 10 by default and 50 at most
+ */
+
+func (i *Impl) GetTrending(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	window := v.Get("window")
+	if window == "" {
+		window = "1h"
+	}
+	count := 10
+	if s := v.Get("count"); s != "" {
+		if count, err = strconv.Atoi(s); err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if count > 50 {
+		count = 50
+	}
+
+	tags, err := i.DB.Trending(window, count)
+	switch {
+	case err == rdb.ErrUnknownWindow:
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if tags == nil {
+		tags = []rdb.Trend{}
+	}
+	output := &TrendingResponse{Window: window, Tags: tags}
+	w.WriteJson(&output)
+}
+
+/*
+ * handles requests of the form
+ * /search?q=redis+"fan+out"&uid=7&since=1500000000&until=1600000000&sort=relevance&page=1
+ * returns the statuses with every word and phrase of q, the newest first
+ * or with sort=relevance the best matches first. uid, since and until
+ * are optional
+ */
+
+func (i *Impl) Search(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	q := rdb.SearchQuery{Text: v.Get("q"), Count: 30}
+	if strings.TrimSpace(q.Text) == "" {
+		rest.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	switch v.Get("sort") {
+	case "", "recent":
+	case "relevance":
+		q.ByRelevance = true
+	default:
+		rest.Error(w, "sort is recent or relevance", http.StatusBadRequest)
+		return
+	}
+	if q.Page, err = strconv.Atoi(v.Get("page")); err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s := v.Get("uid"); s != "" {
+		if q.Uid, err = strconv.Atoi(s); err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = strconv.ParseInt(s, 10, 64); err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = strconv.ParseInt(s, 10, 64); err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sids, err := i.DB.Search(q)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	posts, _, err := i.DB.GetStatuses(sids)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	output := &SearchResponse{Query: q.Text, Page: q.Page, Posts: posts}
+	w.WriteJson(&output)
+}
+
+/*
+ * handles requests of the form /notifications?uid=7&page=1
+ * returns the notifications of the user, the latest first, and how many
+ * are unread
+ */
+
+func (i *Impl) GetNotifications(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uid, err := strconv.Atoi(v.Get("uid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page, err := strconv.Atoi(v.Get("page"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	notifications, err := i.DB.Notifications(uid, page, 30)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	unread, err := i.DB.UnreadNotifications(uid)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	output := &NotificationsResponse{Uid: uid, Page: page, Unread: unread,
+		Notifications: notifications}
+	w.WriteJson(&output)
+}
+
+/*
+ * handles requests of the form /notifications/unread?uid=7
+ */
+
+func (i *Impl) GetUnreadNotifications(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uid, err := strconv.Atoi(v.Get("uid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	unread, err := i.DB.UnreadNotifications(uid)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteJson(map[string]int{"uid": uid, "unread": unread})
+}
+
+/*
+ * handles requests of the form /notifications/read?uid=7&at=1500000000
+ * marks the notifications of the user up to the unix time at as read,
+ * without at all of them
+ */
+
+func (i *Impl) MarkNotificationsRead(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uid, err := strconv.Atoi(v.Get("uid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var at int64
+	if s := v.Get("at"); s != "" {
+		if at, err = strconv.ParseInt(s, 10, 64); err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := i.DB.MarkNotificationsRead(uid, at); err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteJson(map[string]string{"uid": v.Get("uid"), "read": "true"})
+}
+
+// statusList answers with a page of the statuses list returns for uid
+func (i *Impl) statusList(w rest.ResponseWriter, r *rest.Request,
+	list func(uid, page, count int) ([]int, error)) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uid, err := strconv.Atoi(v.Get("uid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page, err := strconv.Atoi(v.Get("page"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sids, err := list(uid, page, 30)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	posts, _, err := i.DB.GetStatuses(sids)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	output := &TimelineResponse{Uid: uid, Page: page, Posts: posts}
+	w.WriteJson(&output)
+}
+
+// statusAction reads uid and sid for the reshare and like handlers and
+// answers with the result of change under key
+func (i *Impl) statusAction(w rest.ResponseWriter, r *rest.Request,
+	change func(uid, sid int) (bool, error), key string) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uid, err := strconv.Atoi(v.Get("uid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sid, err := strconv.Atoi(v.Get("sid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res, err := change(uid, sid)
+	switch {
+	case err == rdb.ErrNotFound:
+		rest.NotFound(w, r)
+		return
+	case err == rdb.ErrOwnStatus:
+		rest.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteJson(map[string]string{"uid": v.Get("uid"), "sid": v.Get("sid"),
+		key: strconv.FormatBool(res)})
+}
+
+/*
+ * handles requests of the form /conversation?sid=12
+ * returns the statuses sid answers and the tree of replies to it
+ */
+
+func (i *Impl) GetConversation(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sid, err := strconv.Atoi(v.Get("sid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	conv, err := i.DB.Conversation(sid)
+	switch {
+	case err == rdb.ErrNotFound:
+		rest.NotFound(w, r)
+		return
+	case err != nil:
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteJson(&conv)
+}
+
+/*
+ * handles requests of the form DELETE /user?uid=7
+ * the user's statuses and follow edges are deleted too
+ */
+
+func (i *Impl) DeleteUser(w rest.ResponseWriter, r *rest.Request) {
+	v, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uid, err := strconv.Atoi(v.Get("uid"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res, err := i.DB.DeleteUser(uid)
+	if err == rdb.ErrNotFound {
+		rest.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteJson(map[string]string{"uid": v.Get("uid"),
+		"deleted": strconv.FormatBool(res)})
+}
+
+/*
+ * handles requests of the form /fanout
+ */
+
+func (i *Impl) GetFanoutLag(w rest.ResponseWriter, r *rest.Request) {
+	if i.Fanout == nil {
+		rest.Error(w, "fan-out workers are not running", http.StatusNotFound)
+		return
+	}
+
+	lag, err := i.Fanout.Lag()
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteJson(&lag)
+}
+
+/*
+ * handles requests of the form /cache
+ */
+
+func (i *Impl) GetCacheStats(w rest.ResponseWriter, r *rest.Request) {
+	if i.Cache == nil {
+		rest.Error(w, "the cache is disabled", http.StatusNotFound)
+		return
+	}
+
+	stats := i.Cache.Stats()
+	w.WriteJson(&stats)
+}